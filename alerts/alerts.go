@@ -0,0 +1,311 @@
+package alerts
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+
+	"github.com/alrevuelta/eth-pools-metrics/schemas"
+)
+
+const (
+	Firing   = "firing"
+	Resolved = "resolved"
+)
+
+// Epochs to remember the events that were already notified, to avoid
+// sending them twice if an epoch is processed again
+const eventsRetention = uint64(64)
+
+// Alerts waiting to be sent. New ones are dropped if full
+const alertsQueueSize = 1000
+
+// Everything that was calculated for a pool in an epoch
+type PoolResult struct {
+	Pool        string
+	Epoch       uint64
+	Performance *schemas.ValidatorPerformanceMetrics
+	Proposals   *schemas.ProposalDutiesMetrics
+	// Validators slashed or that initiated the exit since the previous epoch
+	Slashed []uint64
+	Exited  []uint64
+	// Validators missing its attestations for longer than the offline threshold
+	Offline []uint64
+}
+
+type Alert struct {
+	Rule    string    `json:"rule"`
+	Pool    string    `json:"pool"`
+	State   string    `json:"state"`
+	Epoch   uint64    `json:"epoch"`
+	Message string    `json:"message"`
+	Time    time.Time `json:"time"`
+	// Identifies the alert, used for dedup
+	Key string `json:"key"`
+}
+
+func (a Alert) String() string {
+	return fmt.Sprintf("[%s] %s (%s) epoch %d: %s", a.State, a.Rule, a.Pool, a.Epoch, a.Message)
+}
+
+// Evaluates the rules after each epoch and notifies new and resolved alerts.
+// Alerts based on a condition (eg incorrect target rate) fire once and are
+// resolved when the condition is not met anymore. Alerts based on an event
+// (eg a missed proposal) only fire once.
+type Engine struct {
+	rules     []Rule
+	notifiers []Notifier
+	queue     chan Alert
+
+	mutex sync.Mutex
+	// Consecutive epochs matching each rule and pool
+	streaks map[string]uint64
+	// Condition alerts that are firing, by key
+	firing map[string]Alert
+	// Epoch of the event alerts that were notified, by key
+	notified map[string]uint64
+}
+
+func NewEngine(cfg *Config) (*Engine, error) {
+	notifiers := make([]Notifier, 0)
+	for _, notifierCfg := range cfg.Notifiers {
+		notifier, err := NewNotifier(notifierCfg)
+		if err != nil {
+			return nil, err
+		}
+		notifiers = append(notifiers, notifier)
+	}
+
+	engine := &Engine{
+		rules:     cfg.Rules,
+		notifiers: notifiers,
+		queue:     make(chan Alert, alertsQueueSize),
+		streaks:   make(map[string]uint64, 0),
+		firing:    make(map[string]Alert, 0),
+		notified:  make(map[string]uint64, 0),
+	}
+	go engine.sendLoop()
+	return engine, nil
+}
+
+// Evaluates the results of an epoch and sends the alerts in the background
+func (e *Engine) Run(results []PoolResult) {
+	for _, alert := range e.Evaluate(results) {
+		select {
+		case e.queue <- alert:
+		default:
+			log.Warn("Alerts queue is full, dropping alert: ", alert.Key)
+		}
+	}
+}
+
+// Returns the alerts that changed its state with the results of an epoch
+func (e *Engine) Evaluate(results []PoolResult) []Alert {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+
+	alerts := make([]Alert, 0)
+	lastEpoch := uint64(0)
+	for _, result := range results {
+		if result.Epoch > lastEpoch {
+			lastEpoch = result.Epoch
+		}
+		for _, rule := range e.rules {
+			if !appliesTo(rule, result.Pool) {
+				continue
+			}
+			switch rule.Type {
+			case IncorrectTargetRate:
+				alerts = append(alerts, e.evaluateIncorrectTarget(rule, result)...)
+			case MissedProposal:
+				alerts = append(alerts, e.evaluateMissedProposals(rule, result)...)
+			case ValidatorOffline:
+				alerts = append(alerts, e.evaluateOffline(rule, result)...)
+			case Slashing:
+				for _, valIndex := range result.Slashed {
+					alerts = append(alerts, e.event(rule, result,
+						fmt.Sprintf("%d", valIndex),
+						fmt.Sprintf("validator %d was slashed", valIndex))...)
+				}
+			case ValidatorExit:
+				for _, valIndex := range result.Exited {
+					if contains(rule.IgnoreIndexes, valIndex) {
+						continue
+					}
+					alerts = append(alerts, e.event(rule, result,
+						fmt.Sprintf("%d", valIndex),
+						fmt.Sprintf("validator %d initiated its exit", valIndex))...)
+				}
+			}
+		}
+	}
+
+	// Forget old events
+	for key, epoch := range e.notified {
+		if epoch+eventsRetention < lastEpoch {
+			delete(e.notified, key)
+		}
+	}
+	return alerts
+}
+
+func (e *Engine) evaluateIncorrectTarget(rule Rule, result PoolResult) []Alert {
+	performance := result.Performance
+	if performance == nil || performance.NOfValidatingKeys == 0 {
+		return nil
+	}
+
+	key := rule.Name + "/" + result.Pool
+	rate := float64(performance.NOfIncorrectTarget) / float64(performance.NOfValidatingKeys)
+	epochs := rule.Epochs
+	if epochs == 0 {
+		epochs = 1
+	}
+
+	if rate <= rule.Threshold {
+		e.streaks[key] = 0
+		alert, isFiring := e.firing[key]
+		if !isFiring {
+			return nil
+		}
+		delete(e.firing, key)
+		alert.State = Resolved
+		alert.Epoch = performance.Epoch
+		alert.Time = time.Now()
+		alert.Message = fmt.Sprintf("incorrect target rate %.2f%% back below %.2f%%",
+			rate*100, rule.Threshold*100)
+		return []Alert{alert}
+	}
+
+	e.streaks[key]++
+	if _, isFiring := e.firing[key]; isFiring || e.streaks[key] < epochs {
+		return nil
+	}
+	alert := Alert{
+		Rule:  rule.Name,
+		Pool:  result.Pool,
+		State: Firing,
+		Epoch: performance.Epoch,
+		Message: fmt.Sprintf("incorrect target rate %.2f%% above %.2f%% for %d epochs",
+			rate*100, rule.Threshold*100, e.streaks[key]),
+		Time: time.Now(),
+		Key:  key,
+	}
+	e.firing[key] = alert
+	return []Alert{alert}
+}
+
+func (e *Engine) evaluateOffline(rule Rule, result PoolResult) []Alert {
+	// Unknown if the performance couldn't be calculated
+	if result.Performance == nil {
+		return nil
+	}
+
+	alerts := make([]Alert, 0)
+	offline := make(map[string]bool, 0)
+	for _, valIndex := range result.Offline {
+		key := fmt.Sprintf("%s/%s/%d", rule.Name, result.Pool, valIndex)
+		offline[key] = true
+		if _, isFiring := e.firing[key]; isFiring {
+			continue
+		}
+		alert := Alert{
+			Rule:    rule.Name,
+			Pool:    result.Pool,
+			State:   Firing,
+			Epoch:   result.Epoch,
+			Message: fmt.Sprintf("validator %d is offline", valIndex),
+			Time:    time.Now(),
+			Key:     key,
+		}
+		e.firing[key] = alert
+		alerts = append(alerts, alert)
+	}
+
+	for key, alert := range e.firing {
+		if alert.Rule != rule.Name || alert.Pool != result.Pool || offline[key] {
+			continue
+		}
+		delete(e.firing, key)
+		alert.State = Resolved
+		alert.Epoch = result.Epoch
+		alert.Time = time.Now()
+		alerts = append(alerts, alert)
+	}
+	return alerts
+}
+
+func (e *Engine) evaluateMissedProposals(rule Rule, result PoolResult) []Alert {
+	if result.Proposals == nil {
+		return nil
+	}
+	alerts := make([]Alert, 0)
+	for _, duty := range result.Proposals.Missed {
+		alerts = append(alerts, e.event(rule, result,
+			fmt.Sprintf("%d", duty.Slot),
+			fmt.Sprintf("validator %d missed the proposal of slot %d", duty.ValIndex, duty.Slot))...)
+	}
+	return alerts
+}
+
+// Returns the alert of an event unless it was already notified. Events are
+// of a validator, not of a pool, so a validator in a parent and its sub pools
+// is only notified once, with the first pool that contains it
+func (e *Engine) event(rule Rule, result PoolResult, id string, message string) []Alert {
+	key := rule.Name + "/" + id
+	if _, sent := e.notified[key]; sent {
+		return nil
+	}
+	e.notified[key] = result.Epoch
+	return []Alert{{
+		Rule:    rule.Name,
+		Pool:    result.Pool,
+		State:   Firing,
+		Epoch:   result.Epoch,
+		Message: message,
+		Time:    time.Now(),
+		Key:     key,
+	}}
+}
+
+// Sends the alerts in order, one at a time
+func (e *Engine) sendLoop() {
+	for alert := range e.queue {
+		log.WithFields(log.Fields{
+			"Rule":    alert.Rule,
+			"Pool":    alert.Pool,
+			"State":   alert.State,
+			"Epoch":   alert.Epoch,
+			"Message": alert.Message,
+		}).Warn("Alert:")
+
+		for _, notifier := range e.notifiers {
+			if err := notifier.Notify(alert); err != nil {
+				log.Error("Could not notify alert: ", alert.Key, ": ", err)
+			}
+		}
+	}
+}
+
+func appliesTo(rule Rule, pool string) bool {
+	if len(rule.Pools) == 0 {
+		return true
+	}
+	for _, rulePool := range rule.Pools {
+		if rulePool == pool {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(indexes []uint64, index uint64) bool {
+	for _, i := range indexes {
+		if i == index {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,172 @@
+package alerts
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/alrevuelta/eth-pools-metrics/schemas"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestEngine(t *testing.T, rules []Rule) *Engine {
+	engine, err := NewEngine(&Config{Rules: rules})
+	require.NoError(t, err)
+	return engine
+}
+
+func performance(epoch uint64, incorrectTarget uint64) *schemas.ValidatorPerformanceMetrics {
+	return &schemas.ValidatorPerformanceMetrics{
+		Epoch:              epoch,
+		NOfValidatingKeys:  100,
+		NOfIncorrectTarget: incorrectTarget,
+	}
+}
+
+func Test_IncorrectTargetFiresAndResolves(t *testing.T) {
+	engine := newTestEngine(t, []Rule{
+		{Name: "target", Type: IncorrectTargetRate, Threshold: 0.05, Epochs: 2, Pools: []string{"pool1"}},
+	})
+
+	// Other pools are ignored
+	alerts := engine.Evaluate([]PoolResult{{Pool: "pool2", Epoch: 1, Performance: performance(1, 50)}})
+	require.Equal(t, 0, len(alerts))
+
+	alerts = engine.Evaluate([]PoolResult{{Pool: "pool1", Epoch: 1, Performance: performance(1, 10)}})
+	require.Equal(t, 0, len(alerts))
+
+	alerts = engine.Evaluate([]PoolResult{{Pool: "pool1", Epoch: 2, Performance: performance(2, 10)}})
+	require.Equal(t, 1, len(alerts))
+	require.Equal(t, Firing, alerts[0].State)
+	require.Equal(t, "pool1", alerts[0].Pool)
+
+	// Dedup while firing
+	alerts = engine.Evaluate([]PoolResult{{Pool: "pool1", Epoch: 3, Performance: performance(3, 10)}})
+	require.Equal(t, 0, len(alerts))
+
+	alerts = engine.Evaluate([]PoolResult{{Pool: "pool1", Epoch: 4, Performance: performance(4, 1)}})
+	require.Equal(t, 1, len(alerts))
+	require.Equal(t, Resolved, alerts[0].State)
+	require.Equal(t, uint64(4), alerts[0].Epoch)
+
+	alerts = engine.Evaluate([]PoolResult{{Pool: "pool1", Epoch: 5, Performance: performance(5, 1)}})
+	require.Equal(t, 0, len(alerts))
+}
+
+func Test_EventsAreNotifiedOnce(t *testing.T) {
+	engine := newTestEngine(t, []Rule{
+		{Name: "proposal", Type: MissedProposal},
+		{Name: "slashing", Type: Slashing},
+		{Name: "exit", Type: ValidatorExit, IgnoreIndexes: []uint64{9}},
+	})
+
+	result := PoolResult{
+		Pool:  "pool1",
+		Epoch: 10,
+		Proposals: &schemas.ProposalDutiesMetrics{
+			Missed: []schemas.Duty{{ValIndex: 3, Slot: 320}},
+		},
+		Slashed: []uint64{4},
+		Exited:  []uint64{5, 9},
+	}
+
+	alerts := engine.Evaluate([]PoolResult{result})
+	require.Equal(t, 3, len(alerts))
+	require.Equal(t, "proposal", alerts[0].Rule)
+	require.Equal(t, "slashing", alerts[1].Rule)
+	require.Equal(t, "exit", alerts[2].Rule)
+	require.Contains(t, alerts[2].Message, "validator 5")
+
+	// Same epoch processed again
+	alerts = engine.Evaluate([]PoolResult{result})
+	require.Equal(t, 0, len(alerts))
+}
+
+func Test_EventsAreNotifiedOnceAcrossPools(t *testing.T) {
+	engine := newTestEngine(t, []Rule{{Name: "slashing", Type: Slashing}})
+
+	// Same validator in a parent and one of its sub pools
+	alerts := engine.Evaluate([]PoolResult{
+		{Pool: "rocketpool", Epoch: 10, Slashed: []uint64{4}},
+		{Pool: "rocketpool-0xabc", Epoch: 10, Slashed: []uint64{4}},
+	})
+	require.Equal(t, 1, len(alerts))
+	require.Equal(t, "rocketpool", alerts[0].Pool)
+}
+
+func Test_OfflineFiresAndResolves(t *testing.T) {
+	engine := newTestEngine(t, []Rule{{Name: "offline", Type: ValidatorOffline}})
+
+	alerts := engine.Evaluate([]PoolResult{{Pool: "pool1", Epoch: 1, Performance: performance(1, 0), Offline: []uint64{3, 4}}})
+	require.Equal(t, 2, len(alerts))
+	require.Equal(t, Firing, alerts[0].State)
+
+	// Unknown performance doesn't resolve them
+	alerts = engine.Evaluate([]PoolResult{{Pool: "pool1", Epoch: 2}})
+	require.Equal(t, 0, len(alerts))
+
+	alerts = engine.Evaluate([]PoolResult{{Pool: "pool1", Epoch: 3, Performance: performance(3, 0), Offline: []uint64{4}}})
+	require.Equal(t, 1, len(alerts))
+	require.Equal(t, Resolved, alerts[0].State)
+	// Same message, the state tells it's resolved
+	require.Equal(t, "validator 3 is offline", alerts[0].Message)
+	require.Equal(t, "offline/pool1/3", alerts[0].Key)
+}
+
+func Test_LoadConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "alerts.json")
+	content := `{
+		"rules": [{"name": "target", "type": "incorrect_target_rate", "threshold": 0.05}],
+		"notifiers": [{"type": "telegram", "token": "abc", "chat_id": "123"}]
+	}`
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+
+	cfg, err := LoadConfig(path)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(cfg.Rules))
+	require.Equal(t, "123", cfg.Notifiers[0].ChatId)
+
+	invalid := []Config{
+		{Rules: []Rule{{Name: "target", Type: IncorrectTargetRate}}},
+		{Rules: []Rule{{Name: "unknown", Type: "unknown"}}},
+		{Rules: []Rule{{Name: "a", Type: Slashing}, {Name: "a", Type: Slashing}}},
+		{Notifiers: []NotifierConfig{{Type: SlackNotifierType}}},
+		{Notifiers: []NotifierConfig{{Type: TelegramNotifierType, Token: "abc"}}},
+	}
+	for _, cfg := range invalid {
+		require.Error(t, cfg.Validate())
+	}
+}
+
+func Test_Notifiers(t *testing.T) {
+	received := make(map[string]map[string]interface{}, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body := make(map[string]interface{}, 0)
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		received[r.URL.Path] = body
+	}))
+	defer server.Close()
+
+	prevTelegramApi := telegramApi
+	telegramApi = server.URL
+	defer func() { telegramApi = prevTelegramApi }()
+
+	alert := Alert{Rule: "slashing", Pool: "pool1", State: Firing, Epoch: 10, Message: "validator 4 was slashed"}
+	for _, cfg := range []NotifierConfig{
+		{Type: WebhookNotifierType, Url: server.URL + "/webhook"},
+		{Type: SlackNotifierType, Url: server.URL + "/slack"},
+		{Type: TelegramNotifierType, Token: "abc", ChatId: "123"},
+	} {
+		notifier, err := NewNotifier(cfg)
+		require.NoError(t, err)
+		require.NoError(t, notifier.Notify(alert))
+	}
+
+	require.Equal(t, "slashing", received["/webhook"]["rule"])
+	require.Equal(t, alert.String(), received["/slack"]["text"])
+	require.Equal(t, "123", received["/botabc/sendMessage"]["chat_id"])
+	require.Equal(t, alert.String(), received["/botabc/sendMessage"]["text"])
+}
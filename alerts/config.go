@@ -0,0 +1,113 @@
+package alerts
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/pkg/errors"
+)
+
+// Supported rule types
+const (
+	// Incorrect target votes over validating keys above threshold for n epochs
+	IncorrectTargetRate = "incorrect_target_rate"
+	// Any scheduled block that was not proposed
+	MissedProposal = "missed_proposal"
+	// Any validator that was slashed since the previous epoch
+	Slashing = "slashing"
+	// Any validator that initiated its exit since the previous epoch
+	ValidatorExit = "validator_exit"
+	// Any validator missing its attestations for longer than --offline-epochs
+	ValidatorOffline = "validator_offline"
+)
+
+// Supported notifier types
+const (
+	WebhookNotifierType  = "webhook"
+	SlackNotifierType    = "slack"
+	TelegramNotifierType = "telegram"
+)
+
+type Rule struct {
+	Name string `json:"name"`
+	Type string `json:"type"`
+	// Pools the rule applies to, all if empty
+	Pools []string `json:"pools"`
+	// Only used by incorrect_target_rate, eg 0.05 for 5%
+	Threshold float64 `json:"threshold"`
+	// Consecutive epochs above the threshold before firing, 1 if not set
+	Epochs uint64 `json:"epochs"`
+	// Validators that are expected to exit, only used by validator_exit
+	IgnoreIndexes []uint64 `json:"ignore_indexes"`
+}
+
+type NotifierConfig struct {
+	Type string `json:"type"`
+	// Used by webhook and slack
+	Url string `json:"url"`
+	// Used by telegram
+	Token  string `json:"token"`
+	ChatId string `json:"chat_id"`
+}
+
+type Config struct {
+	Rules     []Rule           `json:"rules"`
+	Notifiers []NotifierConfig `json:"notifiers"`
+}
+
+func LoadConfig(path string) (*Config, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read alerts config")
+	}
+
+	cfg := &Config{}
+	if err := json.Unmarshal(content, cfg); err != nil {
+		return nil, errors.Wrap(err, "could not parse alerts config")
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func (c *Config) Validate() error {
+	names := make(map[string]bool, 0)
+	for _, rule := range c.Rules {
+		if rule.Name == "" {
+			return errors.New("alert rule without name")
+		}
+		if names[rule.Name] {
+			return errors.New(fmt.Sprintf("duplicated alert rule: %s", rule.Name))
+		}
+		names[rule.Name] = true
+
+		switch rule.Type {
+		case IncorrectTargetRate:
+			if rule.Threshold <= 0 || rule.Threshold > 1 {
+				return errors.New(fmt.Sprintf("threshold of rule %s must be in (0, 1]", rule.Name))
+			}
+		case MissedProposal, Slashing, ValidatorExit, ValidatorOffline:
+		default:
+			return errors.New(fmt.Sprintf("unknown type of rule %s: %s", rule.Name, rule.Type))
+		}
+	}
+
+	for _, notifier := range c.Notifiers {
+		switch notifier.Type {
+		case WebhookNotifierType, SlackNotifierType:
+			if notifier.Url == "" {
+				return errors.New(fmt.Sprintf("%s notifier requires an url", notifier.Type))
+			}
+		case TelegramNotifierType:
+			if notifier.Token == "" || notifier.ChatId == "" {
+				return errors.New("telegram notifier requires a token and a chat_id")
+			}
+		default:
+			return errors.New(fmt.Sprintf("unknown notifier type: %s", notifier.Type))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package alerts
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var telegramApi = "https://api.telegram.org"
+
+type Notifier interface {
+	Notify(alert Alert) error
+}
+
+func NewNotifier(cfg NotifierConfig) (Notifier, error) {
+	client := &http.Client{Timeout: 10 * time.Second}
+	switch cfg.Type {
+	case WebhookNotifierType:
+		return &WebhookNotifier{url: cfg.Url, client: client}, nil
+	case SlackNotifierType:
+		return &SlackNotifier{url: cfg.Url, client: client}, nil
+	case TelegramNotifierType:
+		return &TelegramNotifier{
+			url:    fmt.Sprintf("%s/bot%s/sendMessage", telegramApi, cfg.Token),
+			chatId: cfg.ChatId,
+			client: client,
+		}, nil
+	}
+	return nil, errors.New(fmt.Sprintf("unknown notifier type: %s", cfg.Type))
+}
+
+// Posts the alert as json
+type WebhookNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (n *WebhookNotifier) Notify(alert Alert) error {
+	return postJson(n.client, n.url, alert)
+}
+
+// Posts the alert as a message to a slack compatible incoming webhook
+type SlackNotifier struct {
+	url    string
+	client *http.Client
+}
+
+func (n *SlackNotifier) Notify(alert Alert) error {
+	return postJson(n.client, n.url, map[string]string{
+		"text": alert.String(),
+	})
+}
+
+// Sends the alert as a message of a telegram bot
+type TelegramNotifier struct {
+	url    string
+	chatId string
+	client *http.Client
+}
+
+func (n *TelegramNotifier) Notify(alert Alert) error {
+	return postJson(n.client, n.url, map[string]string{
+		"chat_id": n.chatId,
+		"text":    alert.String(),
+	})
+}
+
+func postJson(client *http.Client, url string, body interface{}) error {
+	payload, err := json.Marshal(body)
+	if err != nil {
+		return errors.Wrap(err, "could not encode notification")
+	}
+
+	resp, err := client.Post(url, "application/json", bytes.NewBuffer(payload))
+	if err != nil {
+		return errors.Wrap(err, "could not send notification")
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New(fmt.Sprintf("notification rejected with status: %d", resp.StatusCode))
+	}
+	return nil
+}
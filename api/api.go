@@ -0,0 +1,216 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alrevuelta/eth-pools-metrics/config"
+	"github.com/alrevuelta/eth-pools-metrics/schemas"
+	"github.com/alrevuelta/eth-pools-metrics/store"
+	log "github.com/sirupsen/logrus"
+)
+
+// Missed attestations streaks and upcoming duties, only kept in memory
+type Live interface {
+	GetTopStreaks(poolName string, limit int) []schemas.ValidatorStreak
+	GetLookahead(poolName string) (*schemas.PoolLookahead, bool)
+}
+
+type Api struct {
+	store store.Store
+	live  Live
+	// Windows of the rolling aggregates
+	windows []time.Duration
+}
+
+func NewApi(source store.Store, live Live, windows []time.Duration) *Api {
+	return &Api{
+		store:   source,
+		live:    live,
+		windows: windows,
+	}
+}
+
+// Serves the api in the background, the returned server is used to stop it
+func Run(port int, source store.Store, live Live, windows []time.Duration) *http.Server {
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", port),
+		Handler: NewApi(source, live, windows).Handler(),
+	}
+	go func() {
+		log.Info("Serving api on port: ", port)
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Error("Api server stopped: ", err)
+		}
+	}()
+	return server
+}
+
+// Routes:
+// /api/v1/pools
+// /api/v1/pools/{name}/epochs?from=&to=
+// /api/v1/pools/{name}/proposals?from=&to=
+// /api/v1/pools/{name}/aggregates
+// /api/v1/pools/{name}/streaks?limit=
+// /api/v1/pools/{name}/lookahead
+// /api/v1/validators/{index}
+func (a *Api) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/api/v1/pools", a.handlePools)
+	mux.HandleFunc("/api/v1/pools/", a.handlePool)
+	mux.HandleFunc("/api/v1/validators/", a.handleValidator)
+	return mux
+}
+
+func (a *Api) handlePools(w http.ResponseWriter, r *http.Request) {
+	pools, err := a.store.GetPools()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJson(w, pools)
+}
+
+func (a *Api) handlePool(w http.ResponseWriter, r *http.Request) {
+	fields := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/v1/pools/"), "/")
+	if len(fields) != 2 || fields[0] == "" {
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown path: %s", r.URL.Path))
+		return
+	}
+	poolName := fields[0]
+
+	from, to, err := parseEpochRange(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	switch fields[1] {
+	case "epochs":
+		summaries, err := a.store.GetPoolSummaries(poolName, from, to)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJson(w, summaries)
+	case "proposals":
+		proposals, err := a.store.GetPoolProposals(poolName, from, to)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJson(w, proposals)
+	case "aggregates":
+		aggregates, err := a.store.GetPoolAggregates(poolName, a.windows, time.Now())
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJson(w, aggregates)
+	case "streaks":
+		limit, err := parseLimit(r)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJson(w, a.live.GetTopStreaks(poolName, limit))
+	case "lookahead":
+		lookahead, exists := a.live.GetLookahead(poolName)
+		if !exists {
+			writeError(w, http.StatusNotFound, fmt.Errorf("no lookahead for pool: %s", poolName))
+			return
+		}
+		writeJson(w, lookahead)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("unknown path: %s", r.URL.Path))
+	}
+}
+
+func (a *Api) handleValidator(w http.ResponseWriter, r *http.Request) {
+	indexStr := strings.TrimPrefix(r.URL.Path, "/api/v1/validators/")
+	valIndex, err := strconv.ParseUint(indexStr, 10, 64)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid validator index: %s", indexStr))
+		return
+	}
+
+	history, err := a.store.GetValidatorHistory(valIndex)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJson(w, history)
+}
+
+// Both from and to are optional and inclusive. Either epochs or RFC3339 times,
+// converted to the epoch at that time
+func parseEpochRange(r *http.Request) (uint64, uint64, error) {
+	from := uint64(0)
+	// Max int64 since postgres doesn't support unsigned integers
+	to := uint64(math.MaxInt64)
+
+	var err error
+	if fromStr := r.URL.Query().Get("from"); fromStr != "" {
+		from, err = parseEpoch(fromStr)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid from epoch: %s", fromStr)
+		}
+	}
+	if toStr := r.URL.Query().Get("to"); toStr != "" {
+		to, err = parseEpoch(toStr)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid to epoch: %s", toStr)
+		}
+	}
+	if to > math.MaxInt64 {
+		to = math.MaxInt64
+	}
+	if from > to {
+		return 0, 0, fmt.Errorf("from epoch %d is greater than to epoch %d", from, to)
+	}
+	return from, to, nil
+}
+
+func parseEpoch(value string) (uint64, error) {
+	epoch, err := strconv.ParseUint(value, 10, 64)
+	if err == nil {
+		return epoch, nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return 0, err
+	}
+	return config.EpochAt(t), nil
+}
+
+// Max amount of results, 100 by default
+func parseLimit(r *http.Request) (int, error) {
+	limitStr := r.URL.Query().Get("limit")
+	if limitStr == "" {
+		return 100, nil
+	}
+	limit, err := strconv.Atoi(limitStr)
+	if err != nil || limit <= 0 {
+		return 0, fmt.Errorf("invalid limit: %s", limitStr)
+	}
+	return limit, nil
+}
+
+func writeJson(w http.ResponseWriter, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		log.Error("Could not encode api response: ", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
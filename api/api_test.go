@@ -0,0 +1,97 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alrevuelta/eth-pools-metrics/config"
+	"github.com/alrevuelta/eth-pools-metrics/schemas"
+	"github.com/alrevuelta/eth-pools-metrics/store"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Api(t *testing.T) {
+	require.True(t, config.ApplyNetworkPreset("mainnet"))
+	memory := store.NewMemory(10)
+	for epoch := uint64(1); epoch <= 5; epoch++ {
+		memory.StoreValidatorPerformance(schemas.ValidatorPerformanceMetrics{
+			PoolName:         "pool1",
+			Epoch:            epoch,
+			IndexesMissedAtt: []uint64{3},
+		})
+	}
+	server := httptest.NewServer(NewApi(memory, &testLive{}, []time.Duration{time.Hour}).Handler())
+	defer server.Close()
+
+	var pools []string
+	require.Equal(t, http.StatusOK, get(t, server.URL+"/api/v1/pools", &pools))
+	require.Equal(t, []string{"pool1"}, pools)
+
+	var summaries []schemas.PoolSummary
+	require.Equal(t, http.StatusOK, get(t, server.URL+"/api/v1/pools/pool1/epochs?from=2&to=4", &summaries))
+	require.Equal(t, 3, len(summaries))
+	require.Equal(t, uint64(2), summaries[0].Epoch)
+
+	// Same range by time
+	from := config.EpochTime(2).UTC().Format(time.RFC3339)
+	to := config.EpochTime(4).UTC().Format(time.RFC3339)
+	require.Equal(t, http.StatusOK, get(t, server.URL+"/api/v1/pools/pool1/epochs?from="+from+"&to="+to, &summaries))
+	require.Equal(t, 3, len(summaries))
+	require.Equal(t, uint64(2), summaries[0].Epoch)
+
+	var aggregates []schemas.PoolAggregate
+	require.Equal(t, http.StatusOK, get(t, server.URL+"/api/v1/pools/pool1/aggregates", &aggregates))
+	require.Equal(t, 1, len(aggregates))
+	require.Equal(t, "1h", aggregates[0].Window)
+
+	var streaks []schemas.ValidatorStreak
+	require.Equal(t, http.StatusOK, get(t, server.URL+"/api/v1/pools/pool1/streaks?limit=1", &streaks))
+	require.Equal(t, 1, len(streaks))
+	require.Equal(t, uint64(5), streaks[0].Epochs)
+
+	var lookahead schemas.PoolLookahead
+	require.Equal(t, http.StatusOK, get(t, server.URL+"/api/v1/pools/pool1/lookahead", &lookahead))
+	require.Equal(t, uint64(330), lookahead.Proposals[0].Slot)
+
+	var history schemas.ValidatorHistory
+	require.Equal(t, http.StatusOK, get(t, server.URL+"/api/v1/validators/3", &history))
+	require.Equal(t, 5, len(history.Epochs))
+
+	var apiErr map[string]string
+	require.Equal(t, http.StatusBadRequest, get(t, server.URL+"/api/v1/pools/pool1/epochs?from=4&to=2", &apiErr))
+	require.Equal(t, http.StatusBadRequest, get(t, server.URL+"/api/v1/validators/abc", &apiErr))
+	require.Equal(t, http.StatusNotFound, get(t, server.URL+"/api/v1/pools/pool1/unknown", &apiErr))
+	require.Equal(t, http.StatusNotFound, get(t, server.URL+"/api/v1/pools/pool2/lookahead", &apiErr))
+}
+
+type testLive struct{}
+
+func (s *testLive) GetTopStreaks(poolName string, limit int) []schemas.ValidatorStreak {
+	streaks := []schemas.ValidatorStreak{
+		{Pool: poolName, ValIndex: 3, Epochs: 5, Since: 1},
+		{Pool: poolName, ValIndex: 4, Epochs: 2, Since: 4},
+	}
+	return streaks[:limit]
+}
+
+func (s *testLive) GetLookahead(poolName string) (*schemas.PoolLookahead, bool) {
+	if poolName != "pool1" {
+		return nil, false
+	}
+	return &schemas.PoolLookahead{
+		Pool:      poolName,
+		Epoch:     10,
+		Proposals: []schemas.UpcomingProposal{{ValIndex: 3, Slot: 330}},
+	}, true
+}
+
+func get(t *testing.T, url string, response interface{}) int {
+	resp, err := http.Get(url)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(response))
+	return resp.StatusCode
+}
@@ -0,0 +1,327 @@
+package beacon
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	api "github.com/attestantio/go-eth2-client/api/v1"
+	"github.com/attestantio/go-eth2-client/spec"
+	"github.com/attestantio/go-eth2-client/spec/altair"
+	"github.com/attestantio/go-eth2-client/spec/bellatrix"
+	"github.com/attestantio/go-eth2-client/spec/capella"
+	"github.com/pkg/errors"
+
+	"github.com/alrevuelta/eth-pools-metrics/config"
+)
+
+// Returned when the data was never saved
+var ErrNotCached = errors.New("not found in the cache")
+
+// Directory with the fetched beacon states, proposer duties and block headers,
+// to replay an epoch without a beacon node. The files can also be downloaded
+// from the beacon api by hand:
+//
+//	states/<slot>_<state root>_<fork>.ssz: /eth/v2/debug/beacon/states/<slot> as ssz
+//	states/<slot>_<state root>.json: /eth/v2/debug/beacon/states/<slot> as json
+//	duties/<epoch>.json: /eth/v1/validator/duties/proposer/<epoch>
+//	headers/<slot>.json: /eth/v1/beacon/headers/<slot>, without data if the slot was skipped
+//	spec.json: /eth/v1/config/spec
+//	genesis.json: /eth/v1/beacon/genesis
+type Cache struct {
+	dir string
+	// Slots with a saved state that are kept, all if 0
+	keepStates int
+}
+
+// Used for the duties and headers, same format as the beacon api responses
+type cachedResponse struct {
+	Version string          `json:"version,omitempty"`
+	Data    json.RawMessage `json:"data"`
+}
+
+// Only the states of the last keepStates slots are kept, all if 0
+func NewCache(dir string, keepStates int) (*Cache, error) {
+	for _, subDir := range []string{"states", "duties", "headers"} {
+		if err := os.MkdirAll(filepath.Join(dir, subDir), 0755); err != nil {
+			return nil, errors.Wrap(err, "could not create the cache directory")
+		}
+	}
+	return &Cache{dir: dir, keepStates: keepStates}, nil
+}
+
+// States are content addressed by slot and state root, so a reorged state is
+// never reused. An empty root matches any state of the slot, for offline use
+func (c *Cache) LoadState(slot uint64, root string, preset config.Preset) (*spec.VersionedBeaconState, error) {
+	pattern := fmt.Sprintf("%d_%s*", slot, root)
+	if root == "" {
+		pattern = fmt.Sprintf("%d_*", slot)
+	}
+	matches, err := filepath.Glob(filepath.Join(c.dir, "states", pattern))
+	if err != nil {
+		return nil, err
+	}
+	// Ignore the partial downloads
+	files := make([]string, 0)
+	for _, match := range matches {
+		if strings.HasSuffix(match, ".ssz") || strings.HasSuffix(match, ".json") {
+			files = append(files, match)
+		}
+	}
+	if len(files) == 0 {
+		return nil, ErrNotCached
+	}
+	if len(files) > 1 {
+		return nil, errors.Errorf("found %d states for slot %d, remove the reorged ones", len(files), slot)
+	}
+
+	file, err := os.Open(files[0])
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if strings.HasSuffix(files[0], ".json") {
+		return decodeStateJSON(bufio.NewReader(file))
+	}
+	// The fork is the last part of the name
+	name := strings.TrimSuffix(filepath.Base(files[0]), ".ssz")
+	version, err := parseDataVersion(name[strings.LastIndex(name, "_")+1:])
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid state file name: "+files[0])
+	}
+	return DecodeBeaconState(version, preset, bufio.NewReaderSize(file, 1<<20))
+}
+
+// Where a ssz state is downloaded before knowing its fork
+func (c *Cache) createStateFile(slot uint64) (*os.File, error) {
+	return os.CreateTemp(filepath.Join(c.dir, "states"), fmt.Sprintf("%d_*.partial", slot))
+}
+
+// Gives the downloaded state its final name once it was decoded
+func (c *Cache) commitStateFile(file *os.File, slot uint64, root string, version spec.DataVersion) error {
+	if err := file.Close(); err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	name := fmt.Sprintf("%d_%s_%s.ssz", slot, root, version.String())
+	if err := os.Rename(file.Name(), filepath.Join(c.dir, "states", name)); err != nil {
+		return err
+	}
+	return c.pruneStates()
+}
+
+func (c *Cache) discardStateFile(file *os.File) {
+	file.Close()
+	os.Remove(file.Name())
+}
+
+// Used when the node only served the state as json
+func (c *Cache) SaveStateJSON(slot uint64, root string, state *spec.VersionedBeaconState) error {
+	var data interface{}
+	switch state.Version {
+	case spec.DataVersionAltair:
+		data = state.Altair
+	case spec.DataVersionBellatrix:
+		data = state.Bellatrix
+	case spec.DataVersionCapella:
+		data = state.Capella
+	default:
+		return errors.New("unsupported consensus version: " + state.Version.String())
+	}
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	if err := c.write(filepath.Join("states", fmt.Sprintf("%d_%s.json", slot, root)), state.Version.String(), encoded); err != nil {
+		return err
+	}
+	return c.pruneStates()
+}
+
+// Removes the states of the oldest slots, a state is hundreds of MB. Partial
+// downloads are left alone, they may be in progress
+func (c *Cache) pruneStates() error {
+	if c.keepStates <= 0 {
+		return nil
+	}
+	entries, err := os.ReadDir(filepath.Join(c.dir, "states"))
+	if err != nil {
+		return err
+	}
+	filesBySlot := make(map[uint64][]string, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasSuffix(name, ".ssz") && !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		slot, err := strconv.ParseUint(strings.SplitN(name, "_", 2)[0], 10, 64)
+		if err != nil {
+			continue
+		}
+		filesBySlot[slot] = append(filesBySlot[slot], name)
+	}
+	if len(filesBySlot) <= c.keepStates {
+		return nil
+	}
+
+	slots := make([]uint64, 0, len(filesBySlot))
+	for slot := range filesBySlot {
+		slots = append(slots, slot)
+	}
+	sort.Slice(slots, func(i, j int) bool { return slots[i] < slots[j] })
+	for _, slot := range slots[:len(slots)-c.keepStates] {
+		for _, name := range filesBySlot[slot] {
+			if err := os.Remove(filepath.Join(c.dir, "states", name)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *Cache) SaveSpec(spec map[string]string, genesis genesisData) error {
+	encoded, err := json.Marshal(spec)
+	if err != nil {
+		return err
+	}
+	if err := c.write("spec.json", "", encoded); err != nil {
+		return err
+	}
+	encoded, err = json.Marshal(genesis)
+	if err != nil {
+		return err
+	}
+	return c.write("genesis.json", "", encoded)
+}
+
+func (c *Cache) LoadSpec() (*config.ChainSpec, error) {
+	spec := make(map[string]string, 0)
+	found, err := c.read("spec.json", &spec)
+	if err != nil {
+		return nil, err
+	}
+	var genesis genesisData
+	foundGenesis, err := c.read("genesis.json", &genesis)
+	if err != nil {
+		return nil, err
+	}
+	if !found || !foundGenesis {
+		return nil, ErrNotCached
+	}
+	return config.ParseChainSpec(spec, genesis.GenesisTime)
+}
+
+func (c *Cache) LoadDuties(epoch uint64) ([]*api.ProposerDuty, error) {
+	duties := make([]*api.ProposerDuty, 0)
+	found, err := c.read(filepath.Join("duties", fmt.Sprintf("%d.json", epoch)), &duties)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrNotCached
+	}
+	return duties, nil
+}
+
+func (c *Cache) SaveDuties(epoch uint64, duties []*api.ProposerDuty) error {
+	encoded, err := json.Marshal(duties)
+	if err != nil {
+		return err
+	}
+	return c.write(filepath.Join("duties", fmt.Sprintf("%d.json", epoch)), "", encoded)
+}
+
+// Returns nil if the slot was skipped, same as the beacon node
+func (c *Cache) LoadBlockHeader(slot uint64) (*api.BeaconBlockHeader, error) {
+	path := filepath.Join("headers", fmt.Sprintf("%d.json", slot))
+	if _, err := os.Stat(filepath.Join(c.dir, path)); os.IsNotExist(err) {
+		return nil, ErrNotCached
+	}
+	header := &api.BeaconBlockHeader{}
+	found, err := c.read(path, header)
+	if err != nil || !found {
+		return nil, err
+	}
+	return header, nil
+}
+
+func (c *Cache) SaveBlockHeader(slot uint64, header *api.BeaconBlockHeader) error {
+	encoded := []byte("null")
+	if header != nil {
+		var err error
+		encoded, err = json.Marshal(header)
+		if err != nil {
+			return err
+		}
+	}
+	return c.write(filepath.Join("headers", fmt.Sprintf("%d.json", slot)), "", encoded)
+}
+
+// Decodes the data of a cached response. False if there is no data
+func (c *Cache) read(path string, data interface{}) (bool, error) {
+	content, err := os.ReadFile(filepath.Join(c.dir, path))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	var response cachedResponse
+	if err := json.Unmarshal(content, &response); err != nil {
+		return false, errors.Wrap(err, "could not decode "+path)
+	}
+	if len(response.Data) == 0 || string(response.Data) == "null" {
+		return false, nil
+	}
+	if err := json.Unmarshal(response.Data, data); err != nil {
+		return false, errors.Wrap(err, "could not decode "+path)
+	}
+	return true, nil
+}
+
+// Written to a temporary file first, to never leave a partial file
+func (c *Cache) write(path string, version string, data []byte) error {
+	encoded, err := json.Marshal(cachedResponse{Version: version, Data: data})
+	if err != nil {
+		return err
+	}
+	path = filepath.Join(c.dir, path)
+	if err := os.WriteFile(path+".partial", encoded, 0644); err != nil {
+		return err
+	}
+	return os.Rename(path+".partial", path)
+}
+
+func decodeStateJSON(r *bufio.Reader) (*spec.VersionedBeaconState, error) {
+	var response cachedResponse
+	if err := json.NewDecoder(r).Decode(&response); err != nil {
+		return nil, errors.Wrap(err, "could not decode the state")
+	}
+	version, err := parseDataVersion(response.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	state := &spec.VersionedBeaconState{Version: version}
+	switch version {
+	case spec.DataVersionAltair:
+		state.Altair = &altair.BeaconState{}
+		err = json.Unmarshal(response.Data, state.Altair)
+	case spec.DataVersionBellatrix:
+		state.Bellatrix = &bellatrix.BeaconState{}
+		err = json.Unmarshal(response.Data, state.Bellatrix)
+	case spec.DataVersionCapella:
+		state.Capella = &capella.BeaconState{}
+		err = json.Unmarshal(response.Data, state.Capella)
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "could not decode the state")
+	}
+	return state, nil
+}
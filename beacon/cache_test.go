@@ -0,0 +1,112 @@
+package beacon
+
+import (
+	"testing"
+
+	api "github.com/attestantio/go-eth2-client/api/v1"
+	"github.com/attestantio/go-eth2-client/spec"
+	"github.com/attestantio/go-eth2-client/spec/phase0"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alrevuelta/eth-pools-metrics/config"
+)
+
+func Test_Cache_States(t *testing.T) {
+	cache, err := NewCache(t.TempDir(), 0)
+	require.NoError(t, err)
+
+	_, err = cache.LoadState(3200031, "0xaa", config.MainnetPreset)
+	require.Equal(t, ErrNotCached, err)
+
+	encoded, err := testAltairState().MarshalSSZ()
+	require.NoError(t, err)
+	file, err := cache.createStateFile(3200031)
+	require.NoError(t, err)
+	_, err = file.Write(encoded)
+	require.NoError(t, err)
+	require.NoError(t, cache.commitStateFile(file, 3200031, "0xaa", spec.DataVersionAltair))
+
+	// A partial download is ignored
+	file, err = cache.createStateFile(3200031)
+	require.NoError(t, err)
+	_, err = file.Write(encoded[:100])
+	require.NoError(t, err)
+
+	state, err := cache.LoadState(3200031, "0xaa", config.MainnetPreset)
+	require.NoError(t, err)
+	require.Equal(t, phase0.Slot(3200031), state.Altair.Slot)
+
+	// The slot was reorged
+	_, err = cache.LoadState(3200031, "0xbb", config.MainnetPreset)
+	require.Equal(t, ErrNotCached, err)
+
+	// Any root offline
+	state, err = cache.LoadState(3200031, "", config.MainnetPreset)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(state.Altair.Validators))
+
+	// Saved as json by a node without ssz
+	require.NoError(t, cache.SaveStateJSON(3200063, "0xcc", &spec.VersionedBeaconState{
+		Version: spec.DataVersionAltair,
+		Altair:  testAltairState(),
+	}))
+	state, err = cache.LoadState(3200063, "", config.MainnetPreset)
+	require.NoError(t, err)
+	require.Equal(t, spec.DataVersionAltair, state.Version)
+	require.Equal(t, testAltairState().Balances, state.Altair.Balances)
+}
+
+func Test_Cache_PruneStates(t *testing.T) {
+	cache, err := NewCache(t.TempDir(), 2)
+	require.NoError(t, err)
+
+	state := &spec.VersionedBeaconState{Version: spec.DataVersionAltair, Altair: testAltairState()}
+	for _, slot := range []uint64{95, 31, 63} {
+		require.NoError(t, cache.SaveStateJSON(slot, "0xaa", state))
+	}
+	// A reorged state of a kept slot
+	require.NoError(t, cache.SaveStateJSON(63, "0xbb", state))
+
+	_, err = cache.LoadState(31, "", config.MainnetPreset)
+	require.Equal(t, ErrNotCached, err)
+	_, err = cache.LoadState(63, "0xbb", config.MainnetPreset)
+	require.NoError(t, err)
+	_, err = cache.LoadState(95, "", config.MainnetPreset)
+	require.NoError(t, err)
+}
+
+func Test_Cache_DutiesAndHeaders(t *testing.T) {
+	cache, err := NewCache(t.TempDir(), 0)
+	require.NoError(t, err)
+
+	_, err = cache.LoadDuties(100000)
+	require.Equal(t, ErrNotCached, err)
+	_, err = cache.LoadBlockHeader(3200000)
+	require.Equal(t, ErrNotCached, err)
+
+	duties := []*api.ProposerDuty{
+		{PubKey: phase0.BLSPubKey{1}, Slot: 3200000, ValidatorIndex: 5},
+		{PubKey: phase0.BLSPubKey{2}, Slot: 3200001, ValidatorIndex: 9},
+	}
+	require.NoError(t, cache.SaveDuties(100000, duties))
+	loaded, err := cache.LoadDuties(100000)
+	require.NoError(t, err)
+	require.Equal(t, duties, loaded)
+
+	header := &api.BeaconBlockHeader{
+		Canonical: true,
+		Header: &phase0.SignedBeaconBlockHeader{
+			Message: &phase0.BeaconBlockHeader{Slot: 3200000, ProposerIndex: 5},
+		},
+	}
+	require.NoError(t, cache.SaveBlockHeader(3200000, header))
+	loadedHeader, err := cache.LoadBlockHeader(3200000)
+	require.NoError(t, err)
+	require.Equal(t, header, loadedHeader)
+
+	// Skipped slot
+	require.NoError(t, cache.SaveBlockHeader(3200001, nil))
+	loadedHeader, err = cache.LoadBlockHeader(3200001)
+	require.NoError(t, err)
+	require.Nil(t, loadedHeader)
+}
@@ -0,0 +1,684 @@
+package beacon
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	eth2client "github.com/attestantio/go-eth2-client"
+	api "github.com/attestantio/go-eth2-client/api/v1"
+	"github.com/attestantio/go-eth2-client/http"
+	"github.com/attestantio/go-eth2-client/spec"
+	"github.com/attestantio/go-eth2-client/spec/phase0"
+	"github.com/pkg/errors"
+	"github.com/rs/zerolog"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/alrevuelta/eth-pools-metrics/config"
+	"github.com/alrevuelta/eth-pools-metrics/prometheus"
+)
+
+// Timeout of every request but the beacon state
+const requestTimeout = 60 * time.Second
+
+type node struct {
+	address string
+	// Label used in the metrics, without credentials
+	name   string
+	client *http.Service
+
+	// Updated by the health checks
+	healthy  bool
+	headSlot uint64
+	// Disagreed with the other nodes on a state root, not used until then
+	suspectUntil time.Time
+	// The node can't serve the state as ssz
+	jsonStates bool
+	// Closes the events subscription, nil if not subscribed. See Events
+	cancelEvents context.CancelFunc
+	// Last event received, or when it was subscribed
+	lastEvent time.Time
+}
+
+// Events that are followed, to subscribe the nodes that were down later
+type eventsSubscription struct {
+	ctx     context.Context
+	topics  []string
+	handler eth2client.EventHandlerFunc
+}
+
+// Shared clients of all beacon nodes. Requests go to the first healthy node in
+// the configured order and fail over to the next one on errors or timeouts.
+// Nodes that are syncing or behind the others are not healthy
+type Pool struct {
+	nodes        []*node
+	mutex        sync.RWMutex
+	maxSyncLag   uint64
+	stateTimeout time.Duration
+	// Saves what is fetched, nil if disabled
+	cache *Cache
+	// Set by Start, nil until the spec is loaded
+	spec *config.ChainSpec
+
+	// Nil until Events is called. Subscriptions are done one at a time
+	events      *eventsSubscription
+	eventsMutex sync.Mutex
+}
+
+// Only checks the health once, see Start
+func NewPool(addresses []string, maxSyncLag uint64, stateTimeout time.Duration, cache *Cache) (*Pool, error) {
+	if len(addresses) == 0 {
+		return nil, errors.New("at least one beacon node endpoint is required")
+	}
+
+	pool := &Pool{
+		maxSyncLag:   maxSyncLag,
+		stateTimeout: stateTimeout,
+		cache:        cache,
+	}
+	connected := 0
+	for _, address := range addresses {
+		n := &node{
+			address: address,
+			name:    endpointName(address),
+		}
+		client, err := connect(address)
+		if err != nil {
+			log.Warn("Could not connect to beacon node: ", n.name, ": ", err)
+		} else {
+			connected++
+		}
+		n.client = client
+		pool.nodes = append(pool.nodes, n)
+	}
+	if connected == 0 {
+		return nil, errors.New("could not connect to any beacon node")
+	}
+
+	pool.CheckHealth()
+	return pool, nil
+}
+
+// Checks the health every slot once the spec is loaded, see ChainSpec. The
+// health checks stop when the context is cancelled
+func (p *Pool) Start(ctx context.Context, spec *config.ChainSpec) {
+	p.spec = spec
+	for _, fork := range spec.Forks {
+		if _, supported := supportedForks[fork.Name]; !supported && fork.Name != "phase0" {
+			log.Warn("Fork ", fork.Name, " at epoch ", fork.Epoch, " is not supported, its states can't be processed")
+		}
+	}
+	go p.healthLoop(ctx)
+}
+
+// Layout of the ssz states, mainnet until the spec is loaded
+func (p *Pool) preset() config.Preset {
+	if p.spec == nil {
+		return config.MainnetPreset
+	}
+	return p.spec.Preset
+}
+
+func connect(address string) (*http.Service, error) {
+	client, err := http.New(context.Background(),
+		http.WithTimeout(requestTimeout),
+		http.WithAddress(address),
+		http.WithLogLevel(zerolog.WarnLevel),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return client.(*http.Service), nil
+}
+
+func (p *Pool) healthLoop(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(p.spec.SecondsPerSlot) * time.Second):
+			p.CheckHealth()
+		}
+	}
+}
+
+// Updates the head of each node, reconnecting to the ones that were down. The
+// requests are done without holding the lock, a node can be slow
+func (p *Pool) CheckHealth() {
+	type status struct {
+		client   *http.Service
+		headSlot uint64
+		synced   bool
+	}
+
+	maxHeadSlot := uint64(0)
+	statuses := make(map[*node]status, 0)
+	for _, n := range p.nodes {
+		p.mutex.RLock()
+		client := n.client
+		p.mutex.RUnlock()
+
+		if client == nil {
+			var err error
+			client, err = connect(n.address)
+			if err != nil {
+				log.Debug("Beacon node still down: ", n.name, ": ", err)
+				continue
+			}
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		start := time.Now()
+		syncState, err := client.NodeSyncing(ctx)
+		observeRequest(n, "/eth/v1/node/syncing", start, err)
+		cancel()
+		if err != nil {
+			log.Warn("Could not get sync status of beacon node: ", n.name, ": ", err)
+			statuses[n] = status{client: client}
+			continue
+		}
+		if uint64(syncState.HeadSlot) > maxHeadSlot {
+			maxHeadSlot = uint64(syncState.HeadSlot)
+		}
+		statuses[n] = status{
+			client:   client,
+			headSlot: uint64(syncState.HeadSlot),
+			synced:   !syncState.IsSyncing,
+		}
+	}
+
+	p.mutex.Lock()
+	for _, n := range p.nodes {
+		nodeStatus, exists := statuses[n]
+		if exists {
+			n.client = nodeStatus.client
+			n.headSlot = nodeStatus.headSlot
+		}
+		wasHealthy := n.healthy
+		n.healthy = nodeStatus.synced && nodeStatus.headSlot+p.maxSyncLag >= maxHeadSlot
+		if wasHealthy && !n.healthy {
+			log.Warn("Beacon node is not healthy, head slot: ", n.headSlot, " best head slot: ", maxHeadSlot, ": ", n.name)
+			n.unsubscribe()
+		}
+		setPrometheusHealth(n)
+	}
+	p.mutex.Unlock()
+
+	// Nodes that were down or whose stream stopped
+	p.subscribeEvents()
+}
+
+// Fails if no node is synced, as of the last health check
+func (p *Pool) Status() error {
+	healthy := len(p.healthyNodes(time.Now()))
+	if healthy == 0 {
+		return errors.Errorf("none of the %d beacon nodes is synced", len(p.nodes))
+	}
+	return nil
+}
+
+// Healthy nodes first, in the configured order. The rest are only used as a
+// last resort
+func (p *Pool) orderedNodes(now time.Time) []*node {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	ordered := make([]*node, 0, len(p.nodes))
+	fallback := make([]*node, 0)
+	for _, n := range p.nodes {
+		if n.client == nil {
+			continue
+		}
+		if n.healthy && now.After(n.suspectUntil) {
+			ordered = append(ordered, n)
+		} else {
+			fallback = append(fallback, n)
+		}
+	}
+	return append(ordered, fallback...)
+}
+
+func (p *Pool) healthyNodes(now time.Time) []*node {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+
+	healthy := make([]*node, 0, len(p.nodes))
+	for _, n := range p.nodes {
+		if n.client != nil && n.healthy && now.After(n.suspectUntil) {
+			healthy = append(healthy, n)
+		}
+	}
+	return healthy
+}
+
+// Client of a node, nil if it's down
+func (p *Pool) clientOf(n *node) *http.Service {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return n.client
+}
+
+// Runs a request against the nodes until one succeeds. Not found errors are
+// returned as is, eg a block in a skipped slot. The path of the beacon api is
+// only used in the metrics
+func (p *Pool) do(ctx context.Context, path string, timeout time.Duration, request func(ctx context.Context, n *node, client *http.Service) error) error {
+	return p.try(ctx, path, timeout, false, request)
+}
+
+// Same as do, but on not found errors the next node is tried, for what a node
+// may not have, eg a pruned state
+func (p *Pool) try(ctx context.Context, path string, timeout time.Duration, failoverNotFound bool, request func(ctx context.Context, n *node, client *http.Service) error) error {
+	var lastErr error = errors.New("no beacon node available")
+	for _, n := range p.orderedNodes(time.Now()) {
+		client := p.clientOf(n)
+		if client == nil {
+			continue
+		}
+		reqCtx, cancel := context.WithTimeout(ctx, timeout)
+		start := time.Now()
+		err := request(reqCtx, n, client)
+		observeRequest(n, path, start, err)
+		cancel()
+		if err == nil {
+			return nil
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if isNotFound(err) {
+			if !failoverNotFound {
+				return err
+			}
+			log.Warn("Beacon node does not have it, trying the next one: ", n.name, ": ", err)
+			lastErr = err
+			continue
+		}
+
+		log.Warn("Beacon node request failed, trying the next one: ", n.name, ": ", err)
+		prometheus.BeaconNodeFailovers.WithLabelValues(n.name).Inc()
+		p.mutex.Lock()
+		n.healthy = false
+		n.unsubscribe()
+		setPrometheusHealth(n)
+		p.mutex.Unlock()
+		lastErr = err
+	}
+	return errors.Wrap(lastErr, "all beacon nodes failed")
+}
+
+func (p *Pool) NodeSyncing(ctx context.Context) (*api.SyncState, error) {
+	var syncState *api.SyncState
+	err := p.do(ctx, "/eth/v1/node/syncing", requestTimeout, func(ctx context.Context, n *node, client *http.Service) error {
+		var err error
+		syncState, err = client.NodeSyncing(ctx)
+		return err
+	})
+	return syncState, err
+}
+
+func (p *Pool) Finality(ctx context.Context, stateID string) (*api.Finality, error) {
+	var finality *api.Finality
+	err := p.do(ctx, "/eth/v1/beacon/states/{state_id}/finality_checkpoints", requestTimeout, func(ctx context.Context, n *node, client *http.Service) error {
+		var err error
+		finality, err = client.Finality(ctx, stateID)
+		return err
+	})
+	return finality, err
+}
+
+// Fetched as ssz keeping only the fields that are used, with json as fallback.
+// Nodes that don't have the state, eg pruned, are skipped, and so are the ones
+// that don't follow the fork schedule of the spec. States of forks that are not
+// supported are not requested
+func (p *Pool) BeaconState(ctx context.Context, stateID string) (*spec.VersionedBeaconState, error) {
+	if slot, err := strconv.ParseUint(stateID, 10, 64); err == nil {
+		if err := p.checkFork(slot); err != nil {
+			return nil, err
+		}
+	}
+	var beaconState *spec.VersionedBeaconState
+	err := p.try(ctx, "/eth/v2/debug/beacon/states/{state_id}", p.stateTimeout, true, func(ctx context.Context, n *node, client *http.Service) error {
+		var err error
+		beaconState, err = p.fetchState(ctx, n, client, stateID)
+		if err != nil {
+			return err
+		}
+		return p.checkStateFork(beaconState)
+	})
+	return beaconState, err
+}
+
+// Fails if the fork scheduled at the slot is not supported
+func (p *Pool) checkFork(slot uint64) error {
+	if p.spec == nil {
+		return nil
+	}
+	fork, known := p.spec.ForkAt(slot / p.spec.SlotsPerEpoch)
+	if !known {
+		return nil
+	}
+	if _, supported := supportedForks[fork.Name]; !supported {
+		return errors.Errorf("state at slot %d is of fork %s, not supported", slot, fork.Name)
+	}
+	return nil
+}
+
+// Fails if the state is not of the fork scheduled at its slot
+func (p *Pool) checkStateFork(beaconState *spec.VersionedBeaconState) error {
+	slot, err := stateSlot(beaconState)
+	if err != nil {
+		return err
+	}
+	if p.spec == nil {
+		return nil
+	}
+	fork, known := p.spec.ForkAt(slot / p.spec.SlotsPerEpoch)
+	version := strings.ToLower(beaconState.Version.String())
+	if known && fork.Name != version {
+		return errors.Errorf("state at slot %d is of fork %s, but %s is scheduled", slot, version, fork.Name)
+	}
+	return nil
+}
+
+func (p *Pool) fetchState(ctx context.Context, n *node, client *http.Service, stateID string) (*spec.VersionedBeaconState, error) {
+	// Only states by slot are cached, the root tells if the slot was reorged.
+	// Without the cache the root is not needed
+	slot, err := strconv.ParseUint(stateID, 10, 64)
+	cached := p.cache != nil && err == nil
+	root := ""
+	if cached {
+		stateRoot, err := client.BeaconStateRoot(ctx, stateID)
+		if err != nil {
+			return nil, err
+		}
+		if stateRoot == nil {
+			return nil, errors.New("404: state not found: " + stateID)
+		}
+		root = stateRoot.String()
+		beaconState, err := p.cache.LoadState(slot, root, p.preset())
+		if err == nil {
+			log.Info("Using cached beacon state at slot: ", slot)
+			return beaconState, nil
+		}
+		if err != ErrNotCached {
+			log.Warn("Could not load cached beacon state, fetching it: ", err)
+		}
+	}
+
+	p.mutex.RLock()
+	jsonStates := n.jsonStates
+	p.mutex.RUnlock()
+	if !jsonStates {
+		beaconState, err := p.downloadStateSSZ(ctx, n, stateID, cached, slot, root)
+		var decodeErr *decodeError
+		switch {
+		case err == errSSZUnsupported:
+			log.Warn("Beacon node does not serve ssz states, using json: ", n.name)
+			p.mutex.Lock()
+			n.jsonStates = true
+			p.mutex.Unlock()
+		case errors.As(err, &decodeErr):
+			log.Warn("Could not decode the ssz state, using json: ", n.name, ": ", err)
+		default:
+			return beaconState, err
+		}
+	}
+
+	beaconState, err := client.BeaconState(ctx, stateID)
+	if err != nil || beaconState == nil {
+		return beaconState, err
+	}
+	if cached {
+		if err := p.cache.SaveStateJSON(slot, root, beaconState); err != nil {
+			log.Warn("Could not cache beacon state: ", err)
+		}
+	}
+	return beaconState, nil
+}
+
+// The raw state is saved while it is decoded
+func (p *Pool) downloadStateSSZ(ctx context.Context, n *node, stateID string, cached bool, slot uint64, root string) (*spec.VersionedBeaconState, error) {
+	if !cached {
+		return fetchStateSSZ(ctx, n.address, stateID, p.preset(), nil)
+	}
+	file, err := p.cache.createStateFile(slot)
+	if err != nil {
+		log.Warn("Could not cache beacon state: ", err)
+		return fetchStateSSZ(ctx, n.address, stateID, p.preset(), nil)
+	}
+	beaconState, err := fetchStateSSZ(ctx, n.address, stateID, p.preset(), file)
+	if err != nil {
+		p.cache.discardStateFile(file)
+		return nil, err
+	}
+	if err := p.cache.commitStateFile(file, slot, root, beaconState.Version); err != nil {
+		log.Warn("Could not cache beacon state: ", err)
+	}
+	return beaconState, nil
+}
+
+func (p *Pool) ProposerDuties(ctx context.Context, epoch phase0.Epoch, indexes []phase0.ValidatorIndex) ([]*api.ProposerDuty, error) {
+	var duties []*api.ProposerDuty
+	err := p.do(ctx, "/eth/v1/validator/duties/proposer/{epoch}", requestTimeout, func(ctx context.Context, n *node, client *http.Service) error {
+		var err error
+		duties, err = client.ProposerDuties(ctx, epoch, indexes)
+		return err
+	})
+	// Only all duties are saved, to replay an epoch offline
+	if err == nil && p.cache != nil && len(indexes) == 0 {
+		if err := p.cache.SaveDuties(uint64(epoch), duties); err != nil {
+			log.Warn("Could not cache proposer duties: ", err)
+		}
+	}
+	return duties, err
+}
+
+func (p *Pool) BeaconBlockHeader(ctx context.Context, blockID string) (*api.BeaconBlockHeader, error) {
+	var header *api.BeaconBlockHeader
+	err := p.do(ctx, "/eth/v1/beacon/headers/{block_id}", requestTimeout, func(ctx context.Context, n *node, client *http.Service) error {
+		var err error
+		header, err = client.BeaconBlockHeader(ctx, blockID)
+		return err
+	})
+	if slot, parseErr := strconv.ParseUint(blockID, 10, 64); err == nil && parseErr == nil && p.cache != nil {
+		if err := p.cache.SaveBlockHeader(slot, header); err != nil {
+			log.Warn("Could not cache block header: ", err)
+		}
+	}
+	return header, err
+}
+
+// Subscribes to the events of every node that is up, duplicated events are
+// expected. Nodes that are down, fail over or stop sending events are
+// subscribed again by the health checks
+func (p *Pool) Events(ctx context.Context, topics []string, handler eth2client.EventHandlerFunc) error {
+	p.eventsMutex.Lock()
+	p.events = &eventsSubscription{
+		ctx:     ctx,
+		topics:  topics,
+		handler: handler,
+	}
+	p.eventsMutex.Unlock()
+
+	if p.subscribeEvents() == 0 {
+		return errors.New("could not subscribe to the events of any beacon node")
+	}
+	return nil
+}
+
+// Subscribes the nodes that are not subscribed yet, and the ones without events
+// for an epoch since the client doesn't tell when the stream ends. Returns how
+// many are subscribed
+func (p *Pool) subscribeEvents() int {
+	p.eventsMutex.Lock()
+	defer p.eventsMutex.Unlock()
+	if p.events == nil || p.events.ctx.Err() != nil {
+		return 0
+	}
+	staleAfter := time.Duration(p.spec.SlotsPerEpoch*p.spec.SecondsPerSlot) * time.Second
+
+	subscribed := 0
+	for _, n := range p.orderedNodes(time.Now()) {
+		p.mutex.Lock()
+		client := n.client
+		if n.cancelEvents != nil {
+			if time.Since(n.lastEvent) < staleAfter {
+				p.mutex.Unlock()
+				subscribed++
+				continue
+			}
+			log.Warn("No events from beacon node since ", n.lastEvent.Format(time.RFC3339), ", subscribing again: ", n.name)
+			n.unsubscribe()
+		}
+		p.mutex.Unlock()
+
+		ctx, cancel := context.WithCancel(p.events.ctx)
+		handler := p.nodeHandler(n, p.events.handler)
+		if err := client.Events(ctx, p.events.topics, handler); err != nil {
+			cancel()
+			log.Warn("Could not subscribe to events of beacon node: ", n.name, ": ", err)
+			continue
+		}
+		log.Info("Subscribed to the events of beacon node: ", n.name)
+		p.mutex.Lock()
+		n.cancelEvents = cancel
+		n.lastEvent = time.Now()
+		p.mutex.Unlock()
+		subscribed++
+	}
+	return subscribed
+}
+
+// Keeps track of the last event of the node before handling it
+func (p *Pool) nodeHandler(n *node, handler eth2client.EventHandlerFunc) eth2client.EventHandlerFunc {
+	return func(event *api.Event) {
+		p.mutex.Lock()
+		n.lastEvent = time.Now()
+		p.mutex.Unlock()
+		handler(event)
+	}
+}
+
+// Must be called with the lock held. Closes the events stream of the node, it
+// is subscribed again on the next health check
+func (n *node) unsubscribe() {
+	if n.cancelEvents != nil {
+		n.cancelEvents()
+		n.cancelEvents = nil
+	}
+}
+
+// Compares the state root of all healthy nodes, to detect a buggy client. Nodes
+// that disagree with the majority are not used for an epoch. If there is no
+// majority, the first node in the configured order is trusted so that the
+// processing doesn't stop
+func (p *Pool) CheckStateRoot(ctx context.Context, stateID string) error {
+	healthy := p.healthyNodes(time.Now())
+	roots := make(map[string][]*node, 0)
+	for _, n := range healthy {
+		reqCtx, cancel := context.WithTimeout(ctx, requestTimeout)
+		start := time.Now()
+		root, err := p.clientOf(n).BeaconStateRoot(reqCtx, stateID)
+		observeRequest(n, "/eth/v1/beacon/states/{state_id}/root", start, err)
+		cancel()
+		if err != nil || root == nil {
+			log.Warn("Could not get state root from beacon node: ", n.name, ": ", err)
+			continue
+		}
+		roots[root.String()] = append(roots[root.String()], n)
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	majority, ok := majorityRoot(roots, healthy)
+	if !ok {
+		log.Error("Beacon nodes disagree on the state root of ", stateID, " without a majority, using: ", majority)
+	}
+	for root, nodes := range roots {
+		if root == majority {
+			continue
+		}
+		for _, n := range nodes {
+			log.Error("Beacon node disagrees on the state root of ", stateID, ": ", n.name, ": ", root)
+			prometheus.StateRootMismatches.WithLabelValues(n.name).Inc()
+			p.mutex.Lock()
+			n.suspectUntil = time.Now().Add(
+				time.Duration(p.spec.SlotsPerEpoch*p.spec.SecondsPerSlot) * time.Second)
+			p.mutex.Unlock()
+		}
+	}
+	return nil
+}
+
+// Returns the root shared by most nodes. On a tie, the one of the first node
+// in order, and false
+func majorityRoot(roots map[string][]*node, order []*node) (string, bool) {
+	majority := ""
+	tie := false
+	for root, nodes := range roots {
+		if majority == "" || len(nodes) > len(roots[majority]) {
+			majority = root
+			tie = false
+		} else if len(nodes) == len(roots[majority]) {
+			tie = true
+		}
+	}
+	if !tie {
+		return majority, true
+	}
+
+	for _, n := range order {
+		for root, nodes := range roots {
+			if len(nodes) == len(roots[majority]) && containsNode(nodes, n) {
+				return root, false
+			}
+		}
+	}
+	return majority, false
+}
+
+func containsNode(nodes []*node, n *node) bool {
+	for _, other := range nodes {
+		if other == n {
+			return true
+		}
+	}
+	return false
+}
+
+func isNotFound(err error) bool {
+	return strings.Contains(err.Error(), "Could not find requested block") ||
+		strings.Contains(err.Error(), "404")
+}
+
+// Host of the endpoint, to avoid exporting credentials in the url
+func endpointName(address string) string {
+	if !strings.HasPrefix(address, "http") {
+		address = "http://" + address
+	}
+	parsed, err := url.Parse(address)
+	if err != nil || parsed.Host == "" {
+		return "invalid"
+	}
+	return parsed.Host
+}
+
+// Not found is a valid response, eg a skipped slot
+func observeRequest(n *node, path string, start time.Time, err error) {
+	prometheus.BeaconRequestDuration.WithLabelValues(n.name, path).Observe(time.Since(start).Seconds())
+	if err != nil && !isNotFound(err) {
+		prometheus.BeaconRequestErrors.WithLabelValues(n.name, path).Inc()
+	}
+}
+
+func setPrometheusHealth(n *node) {
+	healthy := float64(0)
+	if n.healthy {
+		healthy = 1
+	}
+	prometheus.BeaconNodeHealthy.WithLabelValues(n.name).Set(healthy)
+	prometheus.BeaconNodeHeadSlot.WithLabelValues(n.name).Set(float64(n.headSlot))
+}
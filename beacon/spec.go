@@ -0,0 +1,96 @@
+package beacon
+
+import (
+	"context"
+	"encoding/json"
+	nethttp "net/http"
+
+	"github.com/attestantio/go-eth2-client/http"
+	"github.com/pkg/errors"
+
+	"github.com/alrevuelta/eth-pools-metrics/config"
+)
+
+const (
+	specPath    = "/eth/v1/config/spec"
+	genesisPath = "/eth/v1/beacon/genesis"
+)
+
+type genesisData struct {
+	GenesisTime string `json:"genesis_time"`
+}
+
+// Loads the chain parameters from the beacon nodes, saving them in the cache
+// to replay epochs offline
+func (p *Pool) ChainSpec(ctx context.Context) (*config.ChainSpec, error) {
+	var spec map[string]string
+	err := p.do(ctx, specPath, requestTimeout, func(ctx context.Context, n *node, _ *http.Service) error {
+		var err error
+		spec, err = fetchSpec(ctx, n.address)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get the spec")
+	}
+
+	var genesis genesisData
+	err = p.do(ctx, genesisPath, requestTimeout, func(ctx context.Context, n *node, _ *http.Service) error {
+		return fetchData(ctx, n.address, genesisPath, &genesis)
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get the genesis")
+	}
+
+	chainSpec, err := config.ParseChainSpec(spec, genesis.GenesisTime)
+	if err != nil {
+		return nil, err
+	}
+	if p.cache != nil {
+		if err := p.cache.SaveSpec(spec, genesis); err != nil {
+			return nil, errors.Wrap(err, "could not cache the spec")
+		}
+	}
+	return chainSpec, nil
+}
+
+// Only the string values are kept, newer forks add lists that are not used
+func fetchSpec(ctx context.Context, address string) (map[string]string, error) {
+	raw := make(map[string]json.RawMessage, 0)
+	if err := fetchData(ctx, address, specPath, &raw); err != nil {
+		return nil, err
+	}
+	spec := make(map[string]string, len(raw))
+	for key, value := range raw {
+		var str string
+		if err := json.Unmarshal(value, &str); err == nil {
+			spec[key] = str
+		}
+	}
+	return spec, nil
+}
+
+// Decodes the data of a json response of the beacon api
+func fetchData(ctx context.Context, address string, path string, data interface{}) error {
+	req, err := nethttp.NewRequestWithContext(ctx, nethttp.MethodGet, baseURL(address)+path, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := sszClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != nethttp.StatusOK {
+		return errors.Errorf("unexpected status code %d fetching %s", resp.StatusCode, path)
+	}
+
+	response := struct {
+		Data interface{} `json:"data"`
+	}{Data: data}
+	if err := json.NewDecoder(resp.Body).Decode(&response); err != nil {
+		return errors.Wrap(err, "could not decode "+path)
+	}
+	return nil
+}
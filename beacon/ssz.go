@@ -0,0 +1,378 @@
+package beacon
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"io"
+	nethttp "net/http"
+	"strings"
+
+	"github.com/attestantio/go-eth2-client/spec"
+	"github.com/attestantio/go-eth2-client/spec/altair"
+	"github.com/attestantio/go-eth2-client/spec/bellatrix"
+	"github.com/attestantio/go-eth2-client/spec/capella"
+	"github.com/attestantio/go-eth2-client/spec/phase0"
+	"github.com/pkg/errors"
+
+	"github.com/alrevuelta/eth-pools-metrics/config"
+)
+
+// Returned when the node doesn't serve the state as ssz, json is used instead
+var errSSZUnsupported = errors.New("beacon node does not support ssz states")
+
+// The ssz state could not be decoded, eg a fork that is not supported yet.
+// The state is fetched as json instead
+type decodeError struct {
+	err error
+}
+
+func (e *decodeError) Error() string {
+	return "could not decode the ssz state: " + e.err.Error()
+}
+
+// No timeout, the requests are cancelled with the context
+var sszClient = &nethttp.Client{}
+
+const (
+	validatorSize = 121
+	pubKeySize    = 48
+)
+
+// Field of the beacon state container, in order. Variable size fields only
+// take an offset in the fixed part
+type sszField struct {
+	name     string
+	size     int
+	variable bool
+}
+
+func fixed(name string, size uint64) sszField {
+	return sszField{name: name, size: int(size)}
+}
+
+func variable(name string) sszField {
+	return sszField{name: name, size: 4, variable: true}
+}
+
+// Layout of the state of a fork. The vectors are sized by the preset
+func stateFields(version spec.DataVersion, preset config.Preset) ([]sszField, error) {
+	syncCommitteeSize := (preset.SyncCommitteeSize + 1) * pubKeySize
+	fields := []sszField{
+		fixed("genesis_time", 8),
+		fixed("genesis_validators_root", 32),
+		fixed("slot", 8),
+		fixed("fork", 16),
+		fixed("latest_block_header", 112),
+		fixed("block_roots", preset.SlotsPerHistoricalRoot*32),
+		fixed("state_roots", preset.SlotsPerHistoricalRoot*32),
+		variable("historical_roots"),
+		fixed("eth1_data", 72),
+		variable("eth1_data_votes"),
+		fixed("eth1_deposit_index", 8),
+		variable("validators"),
+		variable("balances"),
+		fixed("randao_mixes", preset.EpochsPerHistoricalVector*32),
+		fixed("slashings", preset.EpochsPerSlashingsVector*8),
+		variable("previous_epoch_participation"),
+		variable("current_epoch_participation"),
+		fixed("justification_bits", 1),
+		fixed("previous_justified_checkpoint", 40),
+		fixed("current_justified_checkpoint", 40),
+		fixed("finalized_checkpoint", 40),
+		variable("inactivity_scores"),
+		fixed("current_sync_committee", syncCommitteeSize),
+		fixed("next_sync_committee", syncCommitteeSize),
+	}
+
+	switch version {
+	case spec.DataVersionAltair:
+		return fields, nil
+	case spec.DataVersionBellatrix:
+		return append(fields,
+			variable("latest_execution_payload_header"),
+		), nil
+	case spec.DataVersionCapella:
+		return append(fields,
+			variable("latest_execution_payload_header"),
+			fixed("next_withdrawal_index", 8),
+			fixed("next_withdrawal_validator_index", 8),
+			variable("historical_summaries"),
+		), nil
+	}
+	return nil, errors.New("unsupported consensus version: " + version.String())
+}
+
+// Only the fields used to calculate the metrics, the rest is skipped
+type trimmedState struct {
+	slot                       phase0.Slot
+	validators                 []*phase0.Validator
+	balances                   []phase0.Gwei
+	previousEpochParticipation []altair.ParticipationFlags
+	inactivityScores           []uint64
+	currentSyncCommittee       *altair.SyncCommittee
+	nextSyncCommittee          *altair.SyncCommittee
+}
+
+// Downloads the state as ssz and decodes it while it is read, so the raw
+// state is never held in memory. If raw is set the state is also copied there
+func fetchStateSSZ(ctx context.Context, address string, stateID string, preset config.Preset, raw io.Writer) (*spec.VersionedBeaconState, error) {
+	url := baseURL(address) + "/eth/v2/debug/beacon/states/" + stateID
+	req, err := nethttp.NewRequestWithContext(ctx, nethttp.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/octet-stream")
+
+	resp, err := sszClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case nethttp.StatusOK:
+	case nethttp.StatusNotFound:
+		return nil, errors.New("404: state not found: " + stateID)
+	case nethttp.StatusNotAcceptable, nethttp.StatusUnsupportedMediaType:
+		return nil, errSSZUnsupported
+	default:
+		return nil, errors.Errorf("unexpected status code %d fetching state %s", resp.StatusCode, stateID)
+	}
+	// Some nodes ignore the accept header and answer with json
+	if !strings.HasPrefix(resp.Header.Get("Content-Type"), "application/octet-stream") {
+		return nil, errSSZUnsupported
+	}
+
+	version, err := parseDataVersion(resp.Header.Get("Eth-Consensus-Version"))
+	if err != nil {
+		return nil, &decodeError{err}
+	}
+	var body io.Reader = resp.Body
+	if raw != nil {
+		body = io.TeeReader(resp.Body, raw)
+	}
+	beaconState, err := DecodeBeaconState(version, preset, bufio.NewReaderSize(body, 1<<20))
+	if err != nil {
+		return nil, &decodeError{err}
+	}
+	return beaconState, nil
+}
+
+// Forks whose states can be processed, by the name used in the spec
+var supportedForks = map[string]spec.DataVersion{
+	"altair":    spec.DataVersionAltair,
+	"bellatrix": spec.DataVersionBellatrix,
+	"capella":   spec.DataVersionCapella,
+}
+
+func parseDataVersion(version string) (spec.DataVersion, error) {
+	dataVersion, supported := supportedForks[strings.ToLower(version)]
+	if !supported {
+		return 0, errors.New("unsupported consensus version: " + version)
+	}
+	return dataVersion, nil
+}
+
+// Slot of a state of a supported fork
+func stateSlot(beaconState *spec.VersionedBeaconState) (uint64, error) {
+	switch {
+	case beaconState.Altair != nil:
+		return uint64(beaconState.Altair.Slot), nil
+	case beaconState.Bellatrix != nil:
+		return uint64(beaconState.Bellatrix.Slot), nil
+	case beaconState.Capella != nil:
+		return uint64(beaconState.Capella.Slot), nil
+	}
+	return 0, errors.New("unsupported consensus version: " + beaconState.Version.String())
+}
+
+// Same address handling as the go-eth2-client
+func baseURL(address string) string {
+	if !strings.HasPrefix(address, "http") {
+		address = "http://" + address
+	}
+	return strings.TrimSuffix(address, "/")
+}
+
+// Decodes a ssz encoded beacon state read from r, only keeping the fields that
+// are used. The fixed part is read first, then the variable size fields are
+// decoded or skipped one after the other
+func DecodeBeaconState(version spec.DataVersion, preset config.Preset, r io.Reader) (*spec.VersionedBeaconState, error) {
+	fields, err := stateFields(version, preset)
+	if err != nil {
+		return nil, err
+	}
+
+	fixedSize := 0
+	for _, field := range fields {
+		fixedSize += field.size
+	}
+	fixedPart := make([]byte, fixedSize)
+	if _, err := io.ReadFull(r, fixedPart); err != nil {
+		return nil, errors.Wrap(err, "could not read the fixed part of the state")
+	}
+
+	state := &trimmedState{}
+	type offset struct {
+		name  string
+		start uint64
+	}
+	offsets := make([]offset, 0)
+	pos := 0
+	for _, field := range fields {
+		data := fixedPart[pos : pos+field.size]
+		pos += field.size
+		if field.variable {
+			offsets = append(offsets, offset{field.name, uint64(binary.LittleEndian.Uint32(data))})
+			continue
+		}
+		switch field.name {
+		case "slot":
+			state.slot = phase0.Slot(binary.LittleEndian.Uint64(data))
+		case "current_sync_committee":
+			state.currentSyncCommittee = decodeSyncCommittee(data)
+		case "next_sync_committee":
+			state.nextSyncCommittee = decodeSyncCommittee(data)
+		}
+	}
+
+	read := uint64(fixedSize)
+	for i, field := range offsets {
+		if field.start != read {
+			return nil, errors.Errorf("invalid offset of %s: %d, expected %d", field.name, field.start, read)
+		}
+		// The last field goes until the end, its size is unknown
+		fieldReader := &countingReader{r: r}
+		size := uint64(0)
+		if i+1 < len(offsets) {
+			if offsets[i+1].start < field.start {
+				return nil, errors.New("invalid offset of " + offsets[i+1].name)
+			}
+			size = offsets[i+1].start - field.start
+			fieldReader.r = io.LimitReader(r, int64(size))
+		}
+
+		var err error
+		switch field.name {
+		case "validators":
+			state.validators = make([]*phase0.Validator, 0, size/validatorSize)
+			err = decodeList(fieldReader, validatorSize, func(data []byte) error {
+				validator := &phase0.Validator{}
+				if err := validator.UnmarshalSSZ(data); err != nil {
+					return err
+				}
+				state.validators = append(state.validators, validator)
+				return nil
+			})
+		case "balances":
+			state.balances = make([]phase0.Gwei, 0, size/8)
+			err = decodeList(fieldReader, 8, func(data []byte) error {
+				state.balances = append(state.balances, phase0.Gwei(binary.LittleEndian.Uint64(data)))
+				return nil
+			})
+		case "previous_epoch_participation":
+			state.previousEpochParticipation = make([]altair.ParticipationFlags, 0, size)
+			err = decodeList(fieldReader, 1, func(data []byte) error {
+				state.previousEpochParticipation = append(state.previousEpochParticipation, altair.ParticipationFlags(data[0]))
+				return nil
+			})
+		case "inactivity_scores":
+			err = decodeList(fieldReader, 8, func(data []byte) error {
+				state.inactivityScores = append(state.inactivityScores, binary.LittleEndian.Uint64(data))
+				return nil
+			})
+		}
+		if err != nil {
+			return nil, errors.Wrap(err, "could not decode "+field.name)
+		}
+		// Skip what wasn't decoded
+		if _, err := io.Copy(io.Discard, fieldReader); err != nil {
+			return nil, errors.Wrap(err, "could not read "+field.name)
+		}
+		if i+1 < len(offsets) && read+fieldReader.n != offsets[i+1].start {
+			return nil, errors.New("unexpected end of the state in " + field.name)
+		}
+		read += fieldReader.n
+	}
+
+	return state.versioned(version), nil
+}
+
+// The pubkeys followed by the aggregate. Not decoded with the go-eth2-client
+// since it expects the mainnet size
+func decodeSyncCommittee(data []byte) *altair.SyncCommittee {
+	committee := &altair.SyncCommittee{}
+	for pos := 0; pos+pubKeySize < len(data); pos += pubKeySize {
+		var pubKey phase0.BLSPubKey
+		copy(pubKey[:], data[pos:pos+pubKeySize])
+		committee.Pubkeys = append(committee.Pubkeys, pubKey)
+	}
+	copy(committee.AggregatePubkey[:], data[len(data)-pubKeySize:])
+	return committee
+}
+
+// Decodes a list of fixed size elements until the reader is exhausted
+func decodeList(r io.Reader, elemSize int, decode func(data []byte) error) error {
+	buf := make([]byte, elemSize)
+	for {
+		_, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := decode(buf); err != nil {
+			return err
+		}
+	}
+}
+
+type countingReader struct {
+	r io.Reader
+	n uint64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += uint64(n)
+	return n, err
+}
+
+func (s *trimmedState) versioned(version spec.DataVersion) *spec.VersionedBeaconState {
+	versioned := &spec.VersionedBeaconState{Version: version}
+	switch version {
+	case spec.DataVersionAltair:
+		versioned.Altair = &altair.BeaconState{
+			Slot:                       s.slot,
+			Validators:                 s.validators,
+			Balances:                   s.balances,
+			PreviousEpochParticipation: s.previousEpochParticipation,
+			InactivityScores:           s.inactivityScores,
+			CurrentSyncCommittee:       s.currentSyncCommittee,
+			NextSyncCommittee:          s.nextSyncCommittee,
+		}
+	case spec.DataVersionBellatrix:
+		versioned.Bellatrix = &bellatrix.BeaconState{
+			Slot:                       s.slot,
+			Validators:                 s.validators,
+			Balances:                   s.balances,
+			PreviousEpochParticipation: s.previousEpochParticipation,
+			InactivityScores:           s.inactivityScores,
+			CurrentSyncCommittee:       s.currentSyncCommittee,
+			NextSyncCommittee:          s.nextSyncCommittee,
+		}
+	case spec.DataVersionCapella:
+		versioned.Capella = &capella.BeaconState{
+			Slot:                       s.slot,
+			Validators:                 s.validators,
+			Balances:                   s.balances,
+			PreviousEpochParticipation: s.previousEpochParticipation,
+			InactivityScores:           s.inactivityScores,
+			CurrentSyncCommittee:       s.currentSyncCommittee,
+			NextSyncCommittee:          s.nextSyncCommittee,
+		}
+	}
+	return versioned
+}
@@ -0,0 +1,119 @@
+package beacon
+
+import (
+	"bytes"
+	"context"
+	nethttp "net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/attestantio/go-eth2-client/spec"
+	"github.com/attestantio/go-eth2-client/spec/altair"
+	"github.com/attestantio/go-eth2-client/spec/phase0"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alrevuelta/eth-pools-metrics/config"
+)
+
+func testAltairState() *altair.BeaconState {
+	syncCommittee := func(b byte) *altair.SyncCommittee {
+		committee := &altair.SyncCommittee{}
+		for i := 0; i < 512; i++ {
+			committee.Pubkeys = append(committee.Pubkeys, phase0.BLSPubKey{b, byte(i)})
+		}
+		committee.AggregatePubkey = phase0.BLSPubKey{b}
+		return committee
+	}
+
+	return &altair.BeaconState{
+		Slot:                        phase0.Slot(3200031),
+		Fork:                        &phase0.Fork{},
+		LatestBlockHeader:           &phase0.BeaconBlockHeader{},
+		BlockRoots:                  make([]phase0.Root, 8192),
+		StateRoots:                  make([]phase0.Root, 8192),
+		HistoricalRoots:             []phase0.Root{{1}, {2}},
+		ETH1Data:                    &phase0.ETH1Data{BlockHash: make([]byte, 32)},
+		ETH1DataVotes:               []*phase0.ETH1Data{{BlockHash: make([]byte, 32)}},
+		RANDAOMixes:                 make([]phase0.Root, 65536),
+		Slashings:                   make([]phase0.Gwei, 8192),
+		JustificationBits:           []byte{0},
+		PreviousJustifiedCheckpoint: &phase0.Checkpoint{},
+		CurrentJustifiedCheckpoint:  &phase0.Checkpoint{},
+		FinalizedCheckpoint:         &phase0.Checkpoint{},
+		Validators: []*phase0.Validator{
+			{PublicKey: phase0.BLSPubKey{1}, WithdrawalCredentials: make([]byte, 32), EffectiveBalance: 32000000000, ActivationEpoch: 10, ExitEpoch: 1 << 62, WithdrawableEpoch: 1 << 62},
+			{PublicKey: phase0.BLSPubKey{2}, WithdrawalCredentials: make([]byte, 32), EffectiveBalance: 31000000000, Slashed: true},
+		},
+		Balances:                   []phase0.Gwei{32001000000, 30999000000},
+		PreviousEpochParticipation: []altair.ParticipationFlags{7, 1},
+		CurrentEpochParticipation:  []altair.ParticipationFlags{3, 0},
+		InactivityScores:           []uint64{0, 12},
+		CurrentSyncCommittee:       syncCommittee(1),
+		NextSyncCommittee:          syncCommittee(2),
+	}
+}
+
+func Test_DecodeBeaconState(t *testing.T) {
+	state := testAltairState()
+	encoded, err := state.MarshalSSZ()
+	require.NoError(t, err)
+
+	decoded, err := DecodeBeaconState(spec.DataVersionAltair, config.MainnetPreset, bytes.NewReader(encoded))
+	require.NoError(t, err)
+	require.Equal(t, spec.DataVersionAltair, decoded.Version)
+	require.Equal(t, state.Slot, decoded.Altair.Slot)
+	require.Equal(t, state.Validators, decoded.Altair.Validators)
+	require.Equal(t, state.Balances, decoded.Altair.Balances)
+	require.Equal(t, state.PreviousEpochParticipation, decoded.Altair.PreviousEpochParticipation)
+	require.Equal(t, state.InactivityScores, decoded.Altair.InactivityScores)
+	require.Equal(t, state.CurrentSyncCommittee, decoded.Altair.CurrentSyncCommittee)
+	require.Equal(t, state.NextSyncCommittee, decoded.Altair.NextSyncCommittee)
+
+	// Not used, not kept
+	require.Nil(t, decoded.Altair.BlockRoots)
+	require.Nil(t, decoded.Altair.CurrentEpochParticipation)
+
+	// Truncated
+	_, err = DecodeBeaconState(spec.DataVersionAltair, config.MainnetPreset, bytes.NewReader(encoded[:len(encoded)-250]))
+	require.Error(t, err)
+}
+
+func Test_FetchStateSSZ(t *testing.T) {
+	encoded, err := testAltairState().MarshalSSZ()
+	require.NoError(t, err)
+
+	ssz := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		require.Equal(t, "/eth/v2/debug/beacon/states/3200031", r.URL.Path)
+		require.Equal(t, "application/octet-stream", r.Header.Get("Accept"))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Eth-Consensus-Version", "altair")
+		w.Write(encoded)
+	}))
+	defer ssz.Close()
+
+	state, err := fetchStateSSZ(context.Background(), ssz.URL, "3200031", config.MainnetPreset, nil)
+	require.NoError(t, err)
+	require.Equal(t, phase0.Slot(3200031), state.Altair.Slot)
+	require.Equal(t, 2, len(state.Altair.Validators))
+
+	json := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte("{}"))
+	}))
+	defer json.Close()
+
+	_, err = fetchStateSSZ(context.Background(), json.URL, "3200031", config.MainnetPreset, nil)
+	require.Equal(t, errSSZUnsupported, err)
+
+	// Falls back to json
+	truncated := httptest.NewServer(nethttp.HandlerFunc(func(w nethttp.ResponseWriter, r *nethttp.Request) {
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Eth-Consensus-Version", "altair")
+		w.Write(encoded[:1000])
+	}))
+	defer truncated.Close()
+
+	_, err = fetchStateSSZ(context.Background(), truncated.URL, "3200031", config.MainnetPreset, nil)
+	var decodeErr *decodeError
+	require.ErrorAs(t, err, &decodeErr)
+}
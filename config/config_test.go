@@ -0,0 +1,37 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_parseWindows(t *testing.T) {
+	windows, err := parseWindows("1h, 1d,7d,30d")
+	require.NoError(t, err)
+	require.Equal(t, []time.Duration{
+		time.Hour,
+		24 * time.Hour,
+		7 * 24 * time.Hour,
+		30 * 24 * time.Hour,
+	}, windows)
+
+	_, err = parseWindows("1x")
+	require.Error(t, err)
+	_, err = parseWindows("-1h")
+	require.Error(t, err)
+}
+
+func Test_parsePoolParents(t *testing.T) {
+	parents, err := parsePoolParents([]string{"kraken=exchanges", "coinbase=exchanges"})
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{"kraken": "exchanges", "coinbase": "exchanges"}, parents)
+
+	_, err = parsePoolParents([]string{"kraken"})
+	require.Error(t, err)
+	_, err = parsePoolParents([]string{"kraken=a", "kraken=b"})
+	require.Error(t, err)
+	_, err = parsePoolParents([]string{"a=b", "b=a"})
+	require.Error(t, err)
+}
@@ -0,0 +1,252 @@
+package config
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+)
+
+// Genesis of the chain, zero until the spec or a network preset is loaded
+var GenesisTime time.Time
+
+// Parameters of the chain that are used, loaded from the beacon node so that
+// any network works without code changes
+type ChainSpec struct {
+	// CONFIG_NAME, eg mainnet or holesky. Empty in some devnets
+	ConfigName                   string
+	SlotsPerEpoch                uint64
+	SecondsPerSlot               uint64
+	EpochsPerSyncCommitteePeriod uint64
+	GenesisTime                  time.Time
+	// Sizes of the beacon state
+	Preset Preset
+	// Scheduled forks sorted by epoch, the genesis one included. Empty if the
+	// spec was not loaded, eg a network preset
+	Forks []Fork
+	// Where the validators deposit, empty or zero if unknown
+	DepositContract string
+	DepositChainId  uint64
+}
+
+// A fork of the spec, from its *_FORK_EPOCH and *_FORK_VERSION
+type Fork struct {
+	// Lowercase, eg capella. The genesis fork is phase0
+	Name    string
+	Epoch   uint64
+	Version string
+}
+
+// Epoch of a fork that is not scheduled
+const farFutureEpoch = ^uint64(0)
+
+// Order of the known forks, to sort the ones scheduled at the same epoch. The
+// unknown ones go last
+var forkOrder = []string{"phase0", "altair", "bellatrix", "capella", "deneb", "electra", "fulu"}
+
+// Sizes of the preset that change the layout of the beacon state
+type Preset struct {
+	SlotsPerHistoricalRoot    uint64
+	EpochsPerHistoricalVector uint64
+	EpochsPerSlashingsVector  uint64
+	SyncCommitteeSize         uint64
+}
+
+// Used by mainnet and most testnets
+var MainnetPreset = Preset{
+	SlotsPerHistoricalRoot:    8192,
+	EpochsPerHistoricalVector: 65536,
+	EpochsPerSlashingsVector:  8192,
+	SyncCommitteeSize:         512,
+}
+
+// Used until the spec is loaded, and offline if it was not saved. Other
+// networks need the spec of the beacon node
+var networkPresets = map[string]ChainSpec{
+	"mainnet": {SlotsPerEpoch: 32, SecondsPerSlot: 12, EpochsPerSyncCommitteePeriod: 256, GenesisTime: time.Unix(1606824023, 0), Preset: MainnetPreset},
+	"gnosis":  {SlotsPerEpoch: 16, SecondsPerSlot: 5, EpochsPerSyncCommitteePeriod: 512, GenesisTime: time.Unix(1638993340, 0), Preset: MainnetPreset},
+	"holesky": {SlotsPerEpoch: 32, SecondsPerSlot: 12, EpochsPerSyncCommitteePeriod: 256, GenesisTime: time.Unix(1695902400, 0), Preset: MainnetPreset},
+	"sepolia": {SlotsPerEpoch: 32, SecondsPerSlot: 12, EpochsPerSyncCommitteePeriod: 256, GenesisTime: time.Unix(1655733600, 0), Preset: MainnetPreset},
+	"hoodi":   {SlotsPerEpoch: 32, SecondsPerSlot: 12, EpochsPerSyncCommitteePeriod: 256, GenesisTime: time.Unix(1742213400, 0), Preset: MainnetPreset},
+}
+
+// Parses the /eth/v1/config/spec data and the genesis_time of /eth/v1/beacon/genesis
+func ParseChainSpec(spec map[string]string, genesisTime string) (*ChainSpec, error) {
+	parseUint := func(key string) (uint64, error) {
+		value, exists := spec[key]
+		if !exists {
+			return 0, errors.New("missing in the spec: " + key)
+		}
+		parsed, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return 0, errors.Wrap(err, "invalid value in the spec: "+key)
+		}
+		return parsed, nil
+	}
+
+	chainSpec := &ChainSpec{
+		ConfigName:      spec["CONFIG_NAME"],
+		DepositContract: strings.ToLower(spec["DEPOSIT_CONTRACT_ADDRESS"]),
+	}
+	fields := []struct {
+		key   string
+		value *uint64
+	}{
+		{"SLOTS_PER_EPOCH", &chainSpec.SlotsPerEpoch},
+		{"SECONDS_PER_SLOT", &chainSpec.SecondsPerSlot},
+		{"EPOCHS_PER_SYNC_COMMITTEE_PERIOD", &chainSpec.EpochsPerSyncCommitteePeriod},
+		{"SLOTS_PER_HISTORICAL_ROOT", &chainSpec.Preset.SlotsPerHistoricalRoot},
+		{"EPOCHS_PER_HISTORICAL_VECTOR", &chainSpec.Preset.EpochsPerHistoricalVector},
+		{"EPOCHS_PER_SLASHINGS_VECTOR", &chainSpec.Preset.EpochsPerSlashingsVector},
+		{"SYNC_COMMITTEE_SIZE", &chainSpec.Preset.SyncCommitteeSize},
+	}
+	for _, field := range fields {
+		value, err := parseUint(field.key)
+		if err != nil {
+			return nil, err
+		}
+		*field.value = value
+	}
+	if chainSpec.SlotsPerEpoch == 0 || chainSpec.SecondsPerSlot == 0 {
+		return nil, errors.New("invalid spec, zero slots per epoch or seconds per slot")
+	}
+	// Not served by all clients
+	if _, exists := spec["DEPOSIT_CHAIN_ID"]; exists {
+		value, err := parseUint("DEPOSIT_CHAIN_ID")
+		if err != nil {
+			return nil, err
+		}
+		chainSpec.DepositChainId = value
+	}
+	forks, err := parseForks(spec, parseUint)
+	if err != nil {
+		return nil, err
+	}
+	chainSpec.Forks = forks
+
+	genesisSeconds, err := strconv.ParseInt(genesisTime, 10, 64)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid genesis time")
+	}
+	// The time of every epoch is derived from it
+	if genesisSeconds <= 0 {
+		return nil, errors.New("invalid genesis time: " + genesisTime)
+	}
+	chainSpec.GenesisTime = time.Unix(genesisSeconds, 0)
+	return chainSpec, nil
+}
+
+// Scheduled forks sorted by epoch. Forks at the far future epoch are not
+// scheduled yet
+func parseForks(spec map[string]string, parseUint func(key string) (uint64, error)) ([]Fork, error) {
+	forks := make([]Fork, 0)
+	if version, exists := spec["GENESIS_FORK_VERSION"]; exists {
+		forks = append(forks, Fork{Name: "phase0", Epoch: 0, Version: version})
+	}
+	for key := range spec {
+		if !strings.HasSuffix(key, "_FORK_EPOCH") {
+			continue
+		}
+		epoch, err := parseUint(key)
+		if err != nil {
+			return nil, err
+		}
+		if epoch == farFutureEpoch {
+			continue
+		}
+		name := strings.TrimSuffix(key, "_FORK_EPOCH")
+		forks = append(forks, Fork{
+			Name:    strings.ToLower(name),
+			Epoch:   epoch,
+			Version: spec[name+"_FORK_VERSION"],
+		})
+	}
+
+	position := func(name string) int {
+		for i, known := range forkOrder {
+			if known == name {
+				return i
+			}
+		}
+		return len(forkOrder)
+	}
+	sort.Slice(forks, func(i, j int) bool {
+		if forks[i].Epoch != forks[j].Epoch {
+			return forks[i].Epoch < forks[j].Epoch
+		}
+		if position(forks[i].Name) != position(forks[j].Name) {
+			return position(forks[i].Name) < position(forks[j].Name)
+		}
+		return forks[i].Name < forks[j].Name
+	})
+	return forks, nil
+}
+
+// Fork of an epoch as scheduled in the spec. False if the forks are unknown,
+// eg a network preset
+func (s *ChainSpec) ForkAt(epoch uint64) (Fork, bool) {
+	var fork Fork
+	found := false
+	for _, scheduled := range s.Forks {
+		if scheduled.Epoch > epoch {
+			break
+		}
+		fork = scheduled
+		found = true
+	}
+	return fork, found
+}
+
+// Parameters of a known network, used before the spec is loaded. False if the
+// network is unknown, eg a devnet
+func NetworkPreset(network string) (*ChainSpec, bool) {
+	preset, exists := networkPresets[network]
+	if !exists {
+		return nil, false
+	}
+	preset.ConfigName = network
+	return &preset, true
+}
+
+// Sets the parameters of a known network before the spec is loaded. False if
+// the network is unknown, eg a devnet
+func ApplyNetworkPreset(network string) bool {
+	preset, exists := networkPresets[network]
+	if !exists {
+		return false
+	}
+	SlotsInEpoch = preset.SlotsPerEpoch
+	SecondsPerSlot = preset.SecondsPerSlot
+	EpochsPerSyncCommitteePeriod = preset.EpochsPerSyncCommitteePeriod
+	GenesisTime = preset.GenesisTime
+	return true
+}
+
+// Sets the parameters of the chain. Must be done once at startup, before
+// starting anything that reads them. The spec itself is passed around
+func ApplySpec(spec *ChainSpec) {
+	if spec.ConfigName != "" && Network != "" && spec.ConfigName != Network {
+		log.Warn("The beacon node is on network ", spec.ConfigName, " but network is set to ", Network)
+	}
+	SlotsInEpoch = spec.SlotsPerEpoch
+	SecondsPerSlot = spec.SecondsPerSlot
+	EpochsPerSyncCommitteePeriod = spec.EpochsPerSyncCommitteePeriod
+	GenesisTime = spec.GenesisTime
+
+	log.WithFields(log.Fields{
+		"ConfigName":                   spec.ConfigName,
+		"SlotsPerEpoch":                spec.SlotsPerEpoch,
+		"SecondsPerSlot":               spec.SecondsPerSlot,
+		"EpochsPerSyncCommitteePeriod": spec.EpochsPerSyncCommitteePeriod,
+		"GenesisTime":                  spec.GenesisTime.UTC(),
+		"SyncCommitteeSize":            spec.Preset.SyncCommitteeSize,
+		"DepositContract":              spec.DepositContract,
+		"DepositChainId":               spec.DepositChainId,
+	}).Info("Chain spec:")
+	for _, fork := range spec.Forks {
+		log.Info("Fork ", fork.Name, " at epoch ", fork.Epoch, ", version ", fork.Version)
+	}
+}
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ParseChainSpec(t *testing.T) {
+	spec := map[string]string{
+		"CONFIG_NAME":                      "holesky",
+		"SLOTS_PER_EPOCH":                  "32",
+		"SECONDS_PER_SLOT":                 "12",
+		"EPOCHS_PER_SYNC_COMMITTEE_PERIOD": "256",
+		"SLOTS_PER_HISTORICAL_ROOT":        "64",
+		"EPOCHS_PER_HISTORICAL_VECTOR":     "64",
+		"EPOCHS_PER_SLASHINGS_VECTOR":      "64",
+		"SYNC_COMMITTEE_SIZE":              "32",
+		"GENESIS_FORK_VERSION":             "0x01017000",
+		"ALTAIR_FORK_EPOCH":                "0",
+		"ALTAIR_FORK_VERSION":              "0x02017000",
+		"BELLATRIX_FORK_EPOCH":             "0",
+		"BELLATRIX_FORK_VERSION":           "0x03017000",
+		"CAPELLA_FORK_EPOCH":               "256",
+		"CAPELLA_FORK_VERSION":             "0x04017000",
+		"DENEB_FORK_EPOCH":                 "18446744073709551615",
+		"DEPOSIT_CONTRACT_ADDRESS":         "0x4242424242424242424242424242424242424242",
+		"DEPOSIT_CHAIN_ID":                 "17000",
+	}
+	chainSpec, err := ParseChainSpec(spec, "1695902400")
+	require.NoError(t, err)
+	require.Equal(t, "holesky", chainSpec.ConfigName)
+	require.Equal(t, uint64(32), chainSpec.SlotsPerEpoch)
+	require.Equal(t, uint64(12), chainSpec.SecondsPerSlot)
+	require.Equal(t, uint64(256), chainSpec.EpochsPerSyncCommitteePeriod)
+	require.Equal(t, time.Unix(1695902400, 0), chainSpec.GenesisTime)
+	require.Equal(t, Preset{
+		SlotsPerHistoricalRoot:    64,
+		EpochsPerHistoricalVector: 64,
+		EpochsPerSlashingsVector:  64,
+		SyncCommitteeSize:         32,
+	}, chainSpec.Preset)
+	require.Equal(t, "0x4242424242424242424242424242424242424242", chainSpec.DepositContract)
+	require.Equal(t, uint64(17000), chainSpec.DepositChainId)
+
+	// Not scheduled forks are skipped, the ones at the same epoch in fork order
+	require.Equal(t, []Fork{
+		{Name: "phase0", Epoch: 0, Version: "0x01017000"},
+		{Name: "altair", Epoch: 0, Version: "0x02017000"},
+		{Name: "bellatrix", Epoch: 0, Version: "0x03017000"},
+		{Name: "capella", Epoch: 256, Version: "0x04017000"},
+	}, chainSpec.Forks)
+	fork, found := chainSpec.ForkAt(255)
+	require.True(t, found)
+	require.Equal(t, "bellatrix", fork.Name)
+	fork, _ = chainSpec.ForkAt(1000)
+	require.Equal(t, "capella", fork.Name)
+	_, found = (&ChainSpec{}).ForkAt(1000)
+	require.False(t, found)
+
+	_, err = ParseChainSpec(spec, "")
+	require.Error(t, err)
+	_, err = ParseChainSpec(spec, "0")
+	require.Error(t, err)
+
+	delete(spec, "SECONDS_PER_SLOT")
+	_, err = ParseChainSpec(spec, "1695902400")
+	require.Error(t, err)
+}
@@ -0,0 +1,33 @@
+package config
+
+import (
+	"time"
+)
+
+// Wall clock time of the start of a slot
+func SlotTime(slot uint64) time.Time {
+	return GenesisTime.Add(time.Duration(slot*SecondsPerSlot) * time.Second)
+}
+
+// Wall clock time of the start of an epoch, used as the timestamp of its metrics
+func EpochTime(epoch uint64) time.Time {
+	return SlotTime(epoch * SlotsInEpoch)
+}
+
+// Slot at a given time, zero before genesis
+func SlotAt(t time.Time) uint64 {
+	if t.Before(GenesisTime) {
+		return 0
+	}
+	return uint64(t.Sub(GenesisTime)/time.Second) / SecondsPerSlot
+}
+
+// Epoch at a given time, zero before genesis
+func EpochAt(t time.Time) uint64 {
+	return SlotAt(t) / SlotsInEpoch
+}
+
+// Number of whole epochs in a duration
+func EpochsIn(d time.Duration) uint64 {
+	return uint64(d/time.Second) / (SlotsInEpoch * SecondsPerSlot)
+}
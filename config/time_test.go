@@ -0,0 +1,26 @@
+package config
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_EpochTime(t *testing.T) {
+	require.True(t, ApplyNetworkPreset("mainnet"))
+	genesis := time.Unix(1606824023, 0)
+	require.Equal(t, genesis, GenesisTime)
+
+	require.Equal(t, genesis, EpochTime(0))
+	require.Equal(t, genesis.Add(12*time.Second), SlotTime(1))
+	require.Equal(t, genesis.Add(150000*32*12*time.Second), EpochTime(150000))
+
+	require.Equal(t, uint64(150000), EpochAt(EpochTime(150000)))
+	require.Equal(t, uint64(150000), EpochAt(EpochTime(150001).Add(-time.Second)))
+	require.Equal(t, uint64(4800031), SlotAt(SlotTime(4800031).Add(11*time.Second)))
+	require.Equal(t, uint64(0), EpochAt(genesis.Add(-time.Hour)))
+
+	require.Equal(t, uint64(225), EpochsIn(24*time.Hour))
+	require.Equal(t, uint64(6750), EpochsIn(30*24*time.Hour))
+}
@@ -0,0 +1,127 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Max time each check can take when serving a request
+var checkTimeout = 5 * time.Second
+
+// Returns why the component is not healthy, nil if it is
+type Check func(ctx context.Context) error
+
+type component struct {
+	name  string
+	check Check
+	// Failing makes the process not alive, so it is restarted. The rest only
+	// make it not ready, eg a database that is down won't be fixed by a restart
+	critical bool
+}
+
+// Status of a component as served in the endpoints
+type ComponentStatus struct {
+	Healthy  bool   `json:"healthy"`
+	Critical bool   `json:"critical"`
+	Message  string `json:"message,omitempty"`
+}
+
+type Status struct {
+	Healthy    bool                       `json:"healthy"`
+	Components map[string]ComponentStatus `json:"components"`
+}
+
+// Health of each component of the exporter. Checks run on every request, they
+// should be cheap
+type Health struct {
+	mutex      sync.RWMutex
+	components []*component
+}
+
+func New() *Health {
+	return &Health{
+		components: make([]*component, 0),
+	}
+}
+
+func (h *Health) Register(name string, critical bool, check Check) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.components = append(h.components, &component{
+		name:     name,
+		check:    check,
+		critical: critical,
+	})
+}
+
+// Runs the checks of all components. Healthy if the critical ones pass, or all
+// of them if not onlyCritical
+func (h *Health) Check(ctx context.Context, onlyCritical bool) Status {
+	h.mutex.RLock()
+	components := h.components
+	h.mutex.RUnlock()
+
+	status := Status{
+		Healthy:    true,
+		Components: make(map[string]ComponentStatus, len(components)),
+	}
+	for _, c := range components {
+		err := runCheck(ctx, c.check)
+
+		componentStatus := ComponentStatus{Healthy: err == nil, Critical: c.critical}
+		if err != nil {
+			componentStatus.Message = err.Error()
+			if c.critical || !onlyCritical {
+				status.Healthy = false
+			}
+		}
+		status.Components[c.name] = componentStatus
+	}
+	return status
+}
+
+// A check that doesn't honour the context, eg blocked on a lock, fails once the
+// timeout expires. It keeps running in the background
+func runCheck(ctx context.Context, check Check) error {
+	ctx, cancel := context.WithTimeout(ctx, checkTimeout)
+	defer cancel()
+
+	result := make(chan error, 1)
+	go func() {
+		result <- check(ctx)
+	}()
+	select {
+	case err := <-result:
+		return err
+	case <-ctx.Done():
+		return errors.Wrap(ctx.Err(), "check did not finish")
+	}
+}
+
+// Routes:
+// /healthz: Alive, only the critical components
+// /readyz: Ready, all components
+func (h *Health) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		h.serve(w, r, true)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		h.serve(w, r, false)
+	})
+	return mux
+}
+
+func (h *Health) serve(w http.ResponseWriter, r *http.Request, onlyCritical bool) {
+	status := h.Check(r.Context(), onlyCritical)
+	w.Header().Set("Content-Type", "application/json")
+	if !status.Healthy {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,69 @@
+package health
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Health(t *testing.T) {
+	h := New()
+	var loopErr, dbErr error
+	h.Register("loop", true, func(ctx context.Context) error { return loopErr })
+	h.Register("database", false, func(ctx context.Context) error { return dbErr })
+
+	server := httptest.NewServer(h.Handler())
+	defer server.Close()
+
+	get := func(path string) (int, Status) {
+		resp, err := http.Get(server.URL + path)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		var status Status
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&status))
+		return resp.StatusCode, status
+	}
+
+	code, _ := get("/healthz")
+	require.Equal(t, http.StatusOK, code)
+	code, _ = get("/readyz")
+	require.Equal(t, http.StatusOK, code)
+
+	// Alive but not ready
+	dbErr = errors.New("connection refused")
+	code, _ = get("/healthz")
+	require.Equal(t, http.StatusOK, code)
+	code, status := get("/readyz")
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.False(t, status.Components["database"].Healthy)
+	require.Equal(t, "connection refused", status.Components["database"].Message)
+	require.True(t, status.Components["loop"].Healthy)
+
+	loopErr = errors.New("loop stopped")
+	code, status = get("/healthz")
+	require.Equal(t, http.StatusServiceUnavailable, code)
+	require.False(t, status.Healthy)
+}
+
+func Test_Health_Timeout(t *testing.T) {
+	defer func(timeout time.Duration) { checkTimeout = timeout }(checkTimeout)
+	checkTimeout = 10 * time.Millisecond
+
+	h := New()
+	blocked := make(chan struct{})
+	defer close(blocked)
+	h.Register("database", false, func(ctx context.Context) error {
+		<-blocked
+		return nil
+	})
+
+	status := h.Check(context.Background(), false)
+	require.False(t, status.Healthy)
+	require.Contains(t, status.Components["database"].Message, "check did not finish")
+}
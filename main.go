@@ -2,17 +2,23 @@ package main
 
 import (
 	"context"
-	"os"
+	"net/http"
 	"os/signal"
 	"syscall"
+	"time"
 
+	"github.com/alrevuelta/eth-pools-metrics/api"
 	"github.com/alrevuelta/eth-pools-metrics/config"
+	"github.com/alrevuelta/eth-pools-metrics/health"
 	"github.com/alrevuelta/eth-pools-metrics/metrics"
 	"github.com/alrevuelta/eth-pools-metrics/price"
 	"github.com/alrevuelta/eth-pools-metrics/prometheus"
 	log "github.com/sirupsen/logrus"
 )
 
+// Max time to wait for the requests in progress when stopping
+const shutdownTimeout = 10 * time.Second
+
 func main() {
 	config, err := config.NewCliConfig()
 	if err != nil {
@@ -25,33 +31,66 @@ func main() {
 	}
 	log.SetLevel(logLevel)
 
-	prometheus.Run(config.PrometheusPort)
+	// Cancelled on the first signal, a second one kills the process
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
 
 	metrics, err := metrics.NewMetrics(
-		context.Background(),
+		ctx,
 		config)
 
 	if err != nil {
 		log.Fatal(err)
 	}
 
+	health := health.New()
+	metrics.RegisterHealth(health)
+	servers := []*http.Server{prometheus.Run(config.PrometheusPort, health.Handler())}
+
 	price, err := price.NewPrice(config.Postgres)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	go price.Run()
-	metrics.Run()
+	priceDone := make(chan struct{})
+	go func() {
+		defer close(priceDone)
+		price.Run(ctx)
+	}()
+	if err := metrics.Run(ctx); err != nil {
+		log.Fatal(err)
+	}
 
-	// Wait for signal.
-	sigCh := make(chan os.Signal, 1)
-	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, os.Interrupt)
-	for {
-		sig := <-sigCh
-		if sig == syscall.SIGINT || sig == syscall.SIGTERM || sig == os.Interrupt || sig == os.Kill {
-			break
-		}
+	if config.ApiPort != 0 {
+		servers = append(servers, api.Run(config.ApiPort, metrics.Store(), metrics, config.RollingWindows))
+	}
+
+	// Wait for signal, or the debug epoch to be calculated
+	select {
+	case <-ctx.Done():
+	case <-metrics.Done():
 	}
+	stop()
 
 	log.Info("Stopping eth-pools-metrics")
+	<-metrics.Done()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	for _, server := range servers {
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			log.Error("Could not stop http server: ", err)
+		}
+	}
+	if err := metrics.Close(); err != nil {
+		log.Error("Could not close metrics: ", err)
+	}
+	<-priceDone
+	if err := price.Close(); err != nil {
+		log.Error("Could not close price: ", err)
+	}
+	if err := metrics.Err(); err != nil {
+		log.Fatal(err)
+	}
+	log.Info("Stopped eth-pools-metrics")
 }
@@ -4,11 +4,10 @@ import (
 	"context"
 	"encoding/hex"
 	"fmt"
+	"math"
 	"math/big"
 	"strconv"
-	"time"
 
-	"github.com/attestantio/go-eth2-client/http"
 	"github.com/attestantio/go-eth2-client/spec"
 	"github.com/attestantio/go-eth2-client/spec/altair"
 	"github.com/attestantio/go-eth2-client/spec/phase0"
@@ -16,73 +15,75 @@ import (
 
 	//"github.com/alrevuelta/eth-pools-metrics/prometheus"
 
+	"github.com/alrevuelta/eth-pools-metrics/beacon"
 	"github.com/alrevuelta/eth-pools-metrics/config"
 	"github.com/alrevuelta/eth-pools-metrics/postgresql"
 	"github.com/alrevuelta/eth-pools-metrics/prometheus"
 	"github.com/alrevuelta/eth-pools-metrics/schemas"
-	"github.com/rs/zerolog"
 
 	log "github.com/sirupsen/logrus"
 )
 
+// Exit epoch of the validators that didn't initiate its exit
+const farFutureEpoch = phase0.Epoch(math.MaxUint64)
+
 type BeaconState struct {
-	httpClient    *http.Service
-	eth1Endpoint  string
-	eth2Endpoint  string
-	pg            *postgresql.Postgresql
-	fromAddresses []string
-	poolNames     []string
-	timeout       int
+	beaconNodes     *beacon.Pool
+	eth1Endpoint    string
+	pg              *postgresql.Postgresql
+	fromAddresses   []string
+	poolNames       []string
+	checkStateRoots bool
+	// Reads the states from disk instead, nil if not offline
+	offline *beacon.Cache
+	spec    *config.ChainSpec
 }
 
 func NewBeaconState(
 	eth1Endpoint string,
-	eth2Endpoint string,
+	beaconNodes *beacon.Pool,
 	pg *postgresql.Postgresql,
 	fromAddresses []string,
 	poolNames []string,
-	timeout int,
+	checkStateRoots bool,
+	offline *beacon.Cache,
+	spec *config.ChainSpec,
 ) (*BeaconState, error) {
 
-	client, err := http.New(context.Background(),
-		http.WithTimeout(60*time.Second),
-		http.WithAddress(eth2Endpoint),
-		http.WithLogLevel(zerolog.WarnLevel),
-	)
-	if err != nil {
-		return nil, err
-	}
-
-	httpClient := client.(*http.Service)
-
 	return &BeaconState{
-		httpClient:    httpClient,
-		eth2Endpoint:  eth2Endpoint,
-		pg:            pg, //TODO: Remove from here
-		fromAddresses: fromAddresses,
-		poolNames:     poolNames,
-		eth1Endpoint:  eth1Endpoint,
-		timeout:       timeout,
+		beaconNodes:     beaconNodes,
+		pg:              pg, //TODO: Remove from here
+		fromAddresses:   fromAddresses,
+		poolNames:       poolNames,
+		eth1Endpoint:    eth1Endpoint,
+		checkStateRoots: checkStateRoots,
+		offline:         offline,
+		spec:            spec,
 	}, nil
 }
 
+// Calculates the metrics of a pool. Only reads the epoch data, so it can run
+// for several pools at once
 func (p *BeaconState) Run(
 	validatorKeys [][]byte,
 	poolName string,
-	currentBeaconState *spec.VersionedBeaconState,
-	prevBeaconState *spec.VersionedBeaconState,
-	valKeyToIndex map[string]uint64) error {
+	parent string,
+	epochData *EpochData,
+	exportPrometheus bool) (*schemas.ValidatorPerformanceMetrics, error) {
+
+	currentBeaconState := epochData.CurrentBeaconState
+	prevBeaconState := epochData.PrevBeaconState
 
 	if currentBeaconState == nil || prevBeaconState == nil {
 		// TODO: Error?
-		return errors.New("TODO:")
+		return nil, errors.New("TODO:")
 	}
 	if len(validatorKeys) == 0 {
 		// TODO: Error?
-		return errors.New("TODO:")
+		return nil, errors.New("TODO:")
 	}
 
-	validatorIndexes := GetIndexesFromKeys(validatorKeys, valKeyToIndex)
+	validatorIndexes := epochData.ValKeyToIndex.GetPool(poolName, validatorKeys)
 	activeValidatorIndexes := GetActiveIndexes(validatorIndexes, currentBeaconState)
 
 	metrics, err := PopulateParticipationAndBalance(
@@ -91,38 +92,48 @@ func (p *BeaconState) Run(
 		prevBeaconState)
 
 	if err != nil {
-		return errors.Wrap(err, "TODO")
+		return nil, errors.Wrap(err, "TODO")
 	}
+	metrics.PoolName = poolName
 
-	syncCommitteeKeys := BLSPubKeyToByte(GetCurrentSyncCommittee(currentBeaconState))
-	syncCommitteeIndexes := GetIndexesFromKeys(syncCommitteeKeys, valKeyToIndex)
-	poolSyncIndexes := GetValidatorsIn(syncCommitteeIndexes, activeValidatorIndexes)
+	poolSyncIndexes := GetValidatorsIn(epochData.SyncCommitteeIndexes, activeValidatorIndexes)
 
 	// Temporal to debug:
 	ParticipationDebug(activeValidatorIndexes, currentBeaconState)
 
-	// TODO: Move network stats out
-	Slashings(currentBeaconState)
-
 	log.Info("The pool:", poolName, " contains ", len(validatorKeys), " keys (may be hardcoded)")
 	log.Info("The pool:", poolName, " contains ", len(validatorIndexes), " validators detected in the beacon state")
 	log.Info("The pool:", poolName, " contains ", len(activeValidatorIndexes), " active validators detected in the beacon state")
-	log.Info("Pool: ", poolName, " sync committee validators ", poolSyncIndexes)
+	if IsBenchmarkPool(poolName) {
+		log.Info("Pool: ", poolName, " contains ", len(poolSyncIndexes), " sync committee validators")
+	} else {
+		log.Info("Pool: ", poolName, " sync committee validators ", poolSyncIndexes)
+	}
 
 	logMetrics(metrics, poolName)
-	setPrometheusMetrics(metrics, poolSyncIndexes, poolName)
-	return nil
+	if exportPrometheus {
+		setPrometheusMetrics(metrics, poolSyncIndexes, poolName, parent)
+	}
+	return &metrics, nil
 }
 
-// TODO: Very naive approach
+// Returns the sync committee indexes that belong to the pool, in committee order.
+// One pass over each list, pools can have thousands of validators
 func GetValidatorsIn(allSyncCommitteeIndexes []uint64, poolValidatorIndexes []uint64) []uint64 {
+	inPool := make(map[uint64]bool, len(allSyncCommitteeIndexes))
+	for _, index := range allSyncCommitteeIndexes {
+		inPool[index] = false
+	}
+	for _, index := range poolValidatorIndexes {
+		if _, inCommittee := inPool[index]; inCommittee {
+			inPool[index] = true
+		}
+	}
+
 	poolCommmitteeIndexes := make([]uint64, 0)
-	for i := range allSyncCommitteeIndexes {
-		for j := range poolValidatorIndexes {
-			if allSyncCommitteeIndexes[i] == poolValidatorIndexes[j] {
-				poolCommmitteeIndexes = append(poolCommmitteeIndexes, allSyncCommitteeIndexes[i])
-				break
-			}
+	for _, index := range allSyncCommitteeIndexes {
+		if inPool[index] {
+			poolCommmitteeIndexes = append(poolCommmitteeIndexes, index)
 		}
 	}
 	return poolCommmitteeIndexes
@@ -139,13 +150,10 @@ func IsValidatorIn(element uint64, set []uint64) bool {
 	return false
 }
 
-func PopulateKeysToIndexesMap(beaconState *spec.VersionedBeaconState) map[string]uint64 {
-	// TODO: Naive approach. Reset the map every time
-	valKeyToIndex := make(map[string]uint64, 0)
-	for index, beaconStateKey := range GetValidators(beaconState) {
-		valKeyToIndex[hex.EncodeToString(beaconStateKey.PublicKey[:])] = uint64(index)
-	}
-	return valKeyToIndex
+// Indexes all validators of the state from scratch. The metrics reuse a KeyIndex
+// across epochs instead
+func PopulateKeysToIndexesMap(beaconState *spec.VersionedBeaconState) *StateIndex {
+	return NewKeyIndex().ForState(beaconState)
 }
 
 // TODO: Move to utils
@@ -202,6 +210,7 @@ func PopulateParticipationAndBalance(
 	metrics.LosedBalance = lostBalance
 
 	metrics.Epoch = GetSlot(beaconState) / config.SlotsInEpoch
+	metrics.Time = config.EpochTime(metrics.Epoch)
 
 	metrics.NOfTotalVotes = uint64(len(activeValidatorIndexes)) * 3
 	metrics.NOfIncorrectSource = nOfIncorrectSource
@@ -230,16 +239,36 @@ func (p *BeaconState) GetBeaconState(epoch uint64) (*spec.VersionedBeaconState,
 	// If epoch=1, slot = epoch*32 = 32, which is the first slot of epoch 1
 	// but we want to run the metrics on the last slot, so -1
 	// goes to the last slot of the previous epoch
-	slotStr := strconv.FormatUint(epoch*config.SlotsInEpoch-1, 10)
+	slot := epoch*config.SlotsInEpoch - 1
+	slotStr := strconv.FormatUint(slot, 10)
 
-	ctxTimeout, cancel := context.WithTimeout(context.Background(), time.Second*time.Duration(p.timeout))
-	defer cancel()
-	beaconState, err := p.httpClient.BeaconState(
-		ctxTimeout,
+	if p.offline != nil {
+		beaconState, err := p.offline.LoadState(slot, "", p.spec.Preset)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not load saved beacon state at slot "+slotStr)
+		}
+		if err := CheckBeaconState(beaconState); err != nil {
+			return nil, err
+		}
+		return beaconState, nil
+	}
+
+	// Nodes that disagree with the others are not used to fetch the state
+	if p.checkStateRoots {
+		if err := p.beaconNodes.CheckStateRoot(context.Background(), slotStr); err != nil {
+			return nil, err
+		}
+	}
+
+	beaconState, err := p.beaconNodes.BeaconState(
+		context.Background(),
 		slotStr)
 	if err != nil {
 		return nil, err
 	}
+	if err := CheckBeaconState(beaconState); err != nil {
+		return nil, err
+	}
 	log.Info("Got beacon state for epoch:", GetSlot(beaconState)/config.SlotsInEpoch)
 	return beaconState, nil
 }
@@ -259,7 +288,7 @@ func GetTotalBalanceAndEffective(
 			log.Warn("validator index goes beyond the beacon state indexes")
 			continue
 		}
-		valBalance := big.NewInt(0).SetUint64(balances[valIdx])
+		valBalance := big.NewInt(0).SetUint64(uint64(balances[valIdx]))
 		//log.Info(valIdx, ":", valBalance)
 		valEffBalance := big.NewInt(0).SetUint64(uint64(validators[valIdx].EffectiveBalance))
 		totalBalances.Add(totalBalances, valBalance)
@@ -272,13 +301,13 @@ func GetTotalBalanceAndEffective(
 // may belong to active, inactive or even slashed keys.
 func GetIndexesFromKeys(
 	validatorKeys [][]byte,
-	valKeyToIndex map[string]uint64) []uint64 {
+	valKeyToIndex *StateIndex) []uint64 {
 
 	indexes := make([]uint64, 0)
 
 	// Use global prepopulated map
 	for _, key := range validatorKeys {
-		if valIndex, ok := valKeyToIndex[hex.EncodeToString(key)]; ok {
+		if valIndex, ok := valKeyToIndex.Get(key); ok {
 			indexes = append(indexes, valIndex)
 		} else {
 			log.Warn("Index for key: ", hex.EncodeToString(key), " not found in beacon state")
@@ -327,6 +356,7 @@ func GetValidatorsWithLessBalance(
 	indexesWithLessBalance := make([]uint64, 0)
 	earnedBalance := big.NewInt(0)
 	lostBalance := big.NewInt(0)
+	validators := GetValidators(currentBeaconState)
 
 	for _, valIdx := range activeValidatorIndexes {
 		// handle if there was a new validator index not register in the prev state
@@ -335,8 +365,15 @@ func GetValidatorsWithLessBalance(
 			continue
 		}
 
-		prevEpochValBalance := big.NewInt(0).SetUint64(prevBalances[valIdx])
-		currentEpochValBalance := big.NewInt(0).SetUint64(currBalances[valIdx])
+		// Withdrawals are not rewards nor penalties. The rewards of the epoch
+		// are lost, but they can't be told apart without the withdrawn amount
+		if valIdx < uint64(len(validators)) &&
+			IsWithdrawn(uint64(prevBalances[valIdx]), uint64(currBalances[valIdx]), uint64(validators[valIdx].EffectiveBalance)) {
+			continue
+		}
+
+		prevEpochValBalance := big.NewInt(0).SetUint64(uint64(prevBalances[valIdx]))
+		currentEpochValBalance := big.NewInt(0).SetUint64(uint64(currBalances[valIdx]))
 		delta := big.NewInt(0).Sub(currentEpochValBalance, prevEpochValBalance)
 
 		if delta.Cmp(big.NewInt(0)) == -1 {
@@ -350,6 +387,15 @@ func GetValidatorsWithLessBalance(
 	return indexesWithLessBalance, earnedBalance, lostBalance, nil
 }
 
+// Partial withdrawals leave the balance at the effective balance and full
+// ones at zero, which doesn't happen with penalties
+func IsWithdrawn(prevBalance uint64, currBalance uint64, effectiveBalance uint64) bool {
+	if currBalance >= prevBalance {
+		return false
+	}
+	return currBalance == 0 || currBalance == effectiveBalance
+}
+
 func ParticipationDebug(
 	activeValidatorIndexes []uint64,
 	beaconState *spec.VersionedBeaconState) {
@@ -413,6 +459,36 @@ func Slashings(beaconState *spec.VersionedBeaconState) {
 	}).Info("Network stats:")
 }
 
+// Returns the validators that were slashed or initiated its exit between both states
+func GetNewSlashingsAndExits(
+	validatorIndexes []uint64,
+	currentBeaconState *spec.VersionedBeaconState,
+	prevBeaconState *spec.VersionedBeaconState) ([]uint64, []uint64) {
+
+	slashed := make([]uint64, 0)
+	exited := make([]uint64, 0)
+	if currentBeaconState == nil || prevBeaconState == nil {
+		return slashed, exited
+	}
+
+	currValidators := GetValidators(currentBeaconState)
+	prevValidators := GetValidators(prevBeaconState)
+	for _, valIdx := range validatorIndexes {
+		// New validators can't be slashed or exited yet
+		if valIdx >= uint64(len(prevValidators)) || valIdx >= uint64(len(currValidators)) {
+			continue
+		}
+		if currValidators[valIdx].Slashed && !prevValidators[valIdx].Slashed {
+			slashed = append(slashed, valIdx)
+		}
+		if currValidators[valIdx].ExitEpoch != farFutureEpoch &&
+			prevValidators[valIdx].ExitEpoch == farFutureEpoch {
+			exited = append(exited, valIdx)
+		}
+	}
+	return slashed, exited
+}
+
 // See spec: from LSB to MSB: source, target, head.
 // https://github.com/ethereum/consensus-specs/blob/master/specs/altair/beacon-chain.md#participation-flag-indices
 func GetParticipation(
@@ -477,7 +553,7 @@ func logMetrics(
 	poolName string) {
 	balanceDecreasedPercent := (float64(len(metrics.IndexesLessBalance)) / float64(metrics.NOfValidatingKeys)) * 100
 
-	log.WithFields(log.Fields{
+	fields := log.Fields{
 		"PoolName":                    poolName,
 		"Epoch":                       metrics.Epoch,
 		"nOfTotalVotes":               metrics.NOfTotalVotes,
@@ -495,46 +571,52 @@ func logMetrics(
 		"totalBalance":                metrics.TotalBalance,
 		"effectiveBalance":            metrics.EffectiveBalance,
 		"totalRewards":                metrics.TotalRewards,
-		"ValidadorKeyMissedAtt":       metrics.IndexesMissedAtt,
-		"ValidadorKeyLessBalance":     metrics.IndexesLessBalance,
+		"nOfValsWithMissedAtt":        len(metrics.IndexesMissedAtt),
 		"DeltaEpochBalance":           metrics.DeltaEpochBalance,
-	}).Info(poolName + " Stats:")
+	}
+	// Benchmark pools have most of the network, only counts are logged
+	if !IsBenchmarkPool(poolName) {
+		fields["ValidadorKeyMissedAtt"] = metrics.IndexesMissedAtt
+		fields["ValidadorKeyLessBalance"] = metrics.IndexesLessBalance
+	}
+	log.WithFields(fields).Info(poolName + " Stats:")
 }
 
 func setPrometheusMetrics(
 	metrics schemas.ValidatorPerformanceMetrics,
 	numSyncValidators []uint64,
-	poolName string) {
+	poolName string,
+	parent string) {
 
 	prometheus.TotalBalanceMetrics.WithLabelValues(
-		poolName).Set(float64(metrics.TotalBalance.Int64()))
+		poolName, parent).Set(float64(metrics.TotalBalance.Int64()))
 
 	prometheus.ActiveValidatorsMetrics.WithLabelValues(
-		poolName).Set(float64(metrics.NOfValidatingKeys))
+		poolName, parent).Set(float64(metrics.NOfValidatingKeys))
 
 	prometheus.IncorrectSourceMetrics.WithLabelValues(
-		poolName).Set(float64(metrics.NOfIncorrectSource))
+		poolName, parent).Set(float64(metrics.NOfIncorrectSource))
 
 	prometheus.IncorrectTargetMetrics.WithLabelValues(
-		poolName).Set(float64(metrics.NOfIncorrectTarget))
+		poolName, parent).Set(float64(metrics.NOfIncorrectTarget))
 
 	prometheus.IncorrectHeadMetrics.WithLabelValues(
-		poolName).Set(float64(metrics.NOfIncorrectHead))
+		poolName, parent).Set(float64(metrics.NOfIncorrectHead))
 
 	prometheus.EpochEarnedAmountMetrics.WithLabelValues(
-		poolName).Set(float64(metrics.EarnedBalance.Int64()))
+		poolName, parent).Set(float64(metrics.EarnedBalance.Int64()))
 
 	prometheus.EpochLostAmountMetrics.WithLabelValues(
-		poolName).Set(float64(metrics.LosedBalance.Int64()))
+		poolName, parent).Set(float64(metrics.LosedBalance.Int64()))
 
 	prometheus.DeltaEpochBalanceMetrics.WithLabelValues(
-		poolName).Set(float64(metrics.DeltaEpochBalance.Int64()))
+		poolName, parent).Set(float64(metrics.DeltaEpochBalance.Int64()))
 
 	prometheus.CumulativeConsensusRewards.WithLabelValues(
-		poolName).Set(float64(metrics.TotalRewards.Int64()))
+		poolName, parent).Set(float64(metrics.TotalRewards.Int64()))
 
 	prometheus.NumOfSyncCommitteeValidators.WithLabelValues(
-		poolName).Set(float64(len(numSyncValidators)))
+		poolName, parent).Set(float64(len(numSyncValidators)))
 
 	// TODO: Add the indexes of the sync committees
 	// TODO: Add if the sync committees are fulfilling their duties or not
@@ -564,11 +646,24 @@ func setPrometheusMetrics(
 	}*/
 }
 
+// Fails if the state is not of a supported fork, the getters below return
+// empty fields for them
+func CheckBeaconState(beaconState *spec.VersionedBeaconState) error {
+	if beaconState == nil {
+		return errors.New("beacon state was empty")
+	}
+	if beaconState.Altair == nil && beaconState.Bellatrix == nil && beaconState.Capella == nil {
+		return errors.New("beacon state of unsupported fork: " + beaconState.Version.String())
+	}
+	return nil
+}
+
 // Wrappers on top of the beacon state to fetch some fields regardless of Altair or Bellatrix
 // Note that this is needed because both block types do not implement the same interface, since
 // the state differs accross versions.
 // Note also that this functions only make sense for the beacon state fields that are common
 // to all the versioned beacon states.
+// States are checked with CheckBeaconState when fetched.
 func GetValidators(beaconState *spec.VersionedBeaconState) []*phase0.Validator {
 	var validators []*phase0.Validator
 	if beaconState.Altair != nil {
@@ -577,27 +672,20 @@ func GetValidators(beaconState *spec.VersionedBeaconState) []*phase0.Validator {
 		validators = beaconState.Bellatrix.Validators
 	} else if beaconState.Capella != nil {
 		validators = beaconState.Capella.Validators
-	} else {
-		log.Fatal("Beacon state was empty")
 	}
 	return validators
 }
 
-func GetBalances(beaconState *spec.VersionedBeaconState) []uint64 {
-	var tmpBalances []phase0.Gwei
+// Shared with the state, not copied since every pool reads them. Must not be
+// modified
+func GetBalances(beaconState *spec.VersionedBeaconState) []phase0.Gwei {
+	var balances []phase0.Gwei
 	if beaconState.Altair != nil {
-		tmpBalances = beaconState.Altair.Balances
+		balances = beaconState.Altair.Balances
 	} else if beaconState.Bellatrix != nil {
-		tmpBalances = beaconState.Bellatrix.Balances
+		balances = beaconState.Bellatrix.Balances
 	} else if beaconState.Capella != nil {
-		tmpBalances = beaconState.Capella.Balances
-	} else {
-		log.Fatal("Beacon state was empty")
-	}
-
-	balances := make([]uint64, len(tmpBalances))
-	for i := range tmpBalances {
-		balances[i] = uint64(tmpBalances[i])
+		balances = beaconState.Capella.Balances
 	}
 	return balances
 }
@@ -610,8 +698,6 @@ func GetPreviousEpochParticipation(beaconState *spec.VersionedBeaconState) []alt
 		previousEpochParticipation = beaconState.Bellatrix.PreviousEpochParticipation
 	} else if beaconState.Capella != nil {
 		previousEpochParticipation = beaconState.Capella.PreviousEpochParticipation
-	} else {
-		log.Fatal("Beacon state was empty")
 	}
 	return previousEpochParticipation
 }
@@ -624,8 +710,6 @@ func GetSlot(beaconState *spec.VersionedBeaconState) uint64 {
 		slot = uint64(beaconState.Bellatrix.Slot)
 	} else if beaconState.Capella != nil {
 		slot = uint64(beaconState.Capella.Slot)
-	} else {
-		log.Fatal("Beacon state was empty")
 	}
 	return slot
 }
@@ -638,8 +722,18 @@ func GetCurrentSyncCommittee(beaconState *spec.VersionedBeaconState) []phase0.BL
 		pubKeys = beaconState.Bellatrix.CurrentSyncCommittee.Pubkeys
 	} else if beaconState.Capella != nil {
 		pubKeys = beaconState.Capella.CurrentSyncCommittee.Pubkeys
-	} else {
-		log.Fatal("Beacon state was empty")
+	}
+	return pubKeys
+}
+
+func GetNextSyncCommittee(beaconState *spec.VersionedBeaconState) []phase0.BLSPubKey {
+	var pubKeys []phase0.BLSPubKey
+	if beaconState.Altair != nil {
+		pubKeys = beaconState.Altair.NextSyncCommittee.Pubkeys
+	} else if beaconState.Bellatrix != nil {
+		pubKeys = beaconState.Bellatrix.NextSyncCommittee.Pubkeys
+	} else if beaconState.Capella != nil {
+		pubKeys = beaconState.Capella.NextSyncCommittee.Pubkeys
 	}
 	return pubKeys
 }
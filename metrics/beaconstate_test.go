@@ -1,7 +1,6 @@
 package metrics
 
 import (
-	"encoding/hex"
 	"math/big"
 	"testing"
 
@@ -61,24 +60,32 @@ func Test_GetValidatorsWithLessBalance(t *testing.T) {
 				9000,
 				2000,
 				1,
+				32000500000,
 			},
 		},
 	}
 
+	validators := make([]*phase0.Validator, 0)
+	for i := 0; i < 5; i++ {
+		validators = append(validators, &phase0.Validator{EffectiveBalance: 32000000000})
+	}
 	currentBeaconState := &spec.VersionedBeaconState{
 		Altair: &altair.BeaconState{
-			Slot: 35 * 32,
+			Slot:       35 * 32,
+			Validators: validators,
 			Balances: []phase0.Gwei{
 				900,
 				9500,
 				1000,
 				2,
+				// Withdrawn, not lost
+				32000000000,
 			},
 		},
 	}
 
 	indexLessBalance, earnedBalance, lostBalance, err := GetValidatorsWithLessBalance(
-		[]uint64{0, 1, 2, 3},
+		[]uint64{0, 1, 2, 3, 4},
 		prevBeaconState,
 		currentBeaconState)
 
@@ -170,10 +177,18 @@ func Test_PopulateKeysToIndexesMap(t *testing.T) {
 		},
 	}
 	valKeyToIndex := PopulateKeysToIndexesMap(beaconState)
-	require.Equal(t, uint64(0), valKeyToIndex[hex.EncodeToString(validator_0[:])])
-	require.Equal(t, uint64(1), valKeyToIndex[hex.EncodeToString(validator_1[:])])
-	require.Equal(t, uint64(2), valKeyToIndex[hex.EncodeToString(validator_2[:])])
-	require.Equal(t, uint64(3), valKeyToIndex[hex.EncodeToString(validator_3[:])])
+	index, found := valKeyToIndex.Get(validator_0[:])
+	require.True(t, found)
+	require.Equal(t, uint64(0), index)
+	index, found = valKeyToIndex.Get(validator_1[:])
+	require.True(t, found)
+	require.Equal(t, uint64(1), index)
+	index, found = valKeyToIndex.Get(validator_2[:])
+	require.True(t, found)
+	require.Equal(t, uint64(2), index)
+	index, found = valKeyToIndex.Get(validator_3[:])
+	require.True(t, found)
+	require.Equal(t, uint64(3), index)
 }
 
 // TODO: Should be in utils
@@ -0,0 +1,127 @@
+package metrics
+
+import (
+	"github.com/attestantio/go-eth2-client/spec"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/alrevuelta/eth-pools-metrics/config"
+	"github.com/alrevuelta/eth-pools-metrics/prometheus"
+	"github.com/alrevuelta/eth-pools-metrics/schemas"
+)
+
+// Pools used to benchmark the configured pools against
+const (
+	// All validators in the beacon state
+	NetworkPool = "network"
+	// Validators that don't belong to any configured pool
+	UnattributedPool = "unattributed"
+)
+
+// Calculates the metrics of the whole network and of the unattributed validators,
+// exporting the ratio of each pool against the network
+func (a *Metrics) RunBenchmark(
+	poolNames []string,
+	poolKeys map[string][][]byte,
+	epochData *EpochData,
+	provisional bool) {
+
+	networkKeys := GetNetworkKeys(epochData.CurrentBeaconState)
+	unattributedKeys := GetUnattributedKeys(networkKeys, poolKeys)
+
+	a.runPools([]poolJob{
+		{pool: NetworkPool, keys: networkKeys},
+		{pool: UnattributedPool, keys: unattributedKeys},
+	}, epochData, provisional)
+
+	if !epochData.ExportPrometheus {
+		return
+	}
+
+	// Windows ending at the epoch, as the rolling metrics
+	epochTime := config.EpochTime(GetSlot(epochData.CurrentBeaconState) / config.SlotsInEpoch)
+	networkAggregates, err := a.Store().GetPoolAggregates(NetworkPool, a.config.RollingWindows, epochTime)
+	if err != nil {
+		log.Warn("Could not get rolling aggregates of the network: ", err)
+		return
+	}
+
+	benchmarked := append(append([]string{}, poolNames...), UnattributedPool)
+	for _, poolName := range benchmarked {
+		poolAggregates, err := a.Store().GetPoolAggregates(poolName, a.config.RollingWindows, epochTime)
+		if err != nil {
+			log.Warn("Could not get rolling aggregates of pool: ", poolName, ": ", err)
+			continue
+		}
+		setPrometheusNetworkRatios(poolAggregates, networkAggregates, poolName)
+	}
+}
+
+// Benchmark pools contain too many validators to store validator level data
+func IsBenchmarkPool(poolName string) bool {
+	return poolName == NetworkPool || poolName == UnattributedPool
+}
+
+// Returns the keys of all validators in the beacon state. Inactive ones are
+// filtered out when calculating the metrics
+func GetNetworkKeys(beaconState *spec.VersionedBeaconState) [][]byte {
+	validators := GetValidators(beaconState)
+	keys := make([][]byte, 0, len(validators))
+	for _, validator := range validators {
+		keys = append(keys, validator.PublicKey[:])
+	}
+	return keys
+}
+
+// Returns the network keys that don't belong to any pool
+func GetUnattributedKeys(networkKeys [][]byte, poolKeys map[string][][]byte) [][]byte {
+	// Raw keys, hex encoding a million keys is not free
+	attributed := make(map[string]bool, 0)
+	for _, keys := range poolKeys {
+		for _, key := range keys {
+			attributed[string(key)] = true
+		}
+	}
+
+	unattributed := make([][]byte, 0)
+	for _, key := range networkKeys {
+		if !attributed[string(key)] {
+			unattributed = append(unattributed, key)
+		}
+	}
+	return unattributed
+}
+
+// Ratio of the metrics of a pool over the network ones, in each window
+func GetNetworkRatios(poolAggregate schemas.PoolAggregate, networkAggregate schemas.PoolAggregate) map[string]float64 {
+	ratios := make(map[string]float64, 0)
+	addRatio := func(metric string, pool float64, network float64) {
+		if network != 0 {
+			ratios[metric] = pool / network
+		}
+	}
+	addRatio("participation_rate", poolAggregate.ParticipationRate, networkAggregate.ParticipationRate)
+	addRatio("consensus_apr", poolAggregate.ConsensusApr, networkAggregate.ConsensusApr)
+	addRatio("attestation_effectiveness", poolAggregate.AttestationEffectiveness, networkAggregate.AttestationEffectiveness)
+	if poolAggregate.NOfScheduledBlocks != 0 {
+		addRatio("proposal_success_rate", poolAggregate.ProposalSuccessRate, networkAggregate.ProposalSuccessRate)
+	}
+	return ratios
+}
+
+func setPrometheusNetworkRatios(
+	poolAggregates []schemas.PoolAggregate,
+	networkAggregates []schemas.PoolAggregate,
+	poolName string) {
+
+	// Both are calculated with the same windows, in the same order
+	for i := range poolAggregates {
+		if i >= len(networkAggregates) {
+			break
+		}
+		ratios := GetNetworkRatios(poolAggregates[i], networkAggregates[i])
+		for metric, ratio := range ratios {
+			prometheus.NetworkRatio.WithLabelValues(
+				poolName, poolAggregates[i].Window, metric).Set(ratio)
+		}
+	}
+}
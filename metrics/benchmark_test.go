@@ -0,0 +1,39 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/alrevuelta/eth-pools-metrics/schemas"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_GetUnattributedKeys(t *testing.T) {
+	networkKeys := [][]byte{{0x01}, {0x02}, {0x03}, {0x04}}
+	poolKeys := map[string][][]byte{
+		"pool1": {{0x01}},
+		"pool2": {{0x03}, {0x01}},
+	}
+	require.Equal(t, [][]byte{{0x02}, {0x04}}, GetUnattributedKeys(networkKeys, poolKeys))
+}
+
+func Test_GetNetworkRatios(t *testing.T) {
+	pool := schemas.PoolAggregate{
+		ParticipationRate:        0.99,
+		ConsensusApr:             0.045,
+		AttestationEffectiveness: 0.98,
+	}
+	network := schemas.PoolAggregate{
+		ParticipationRate:        0.90,
+		ConsensusApr:             0.04,
+		AttestationEffectiveness: 0,
+		NOfScheduledBlocks:       10,
+		ProposalSuccessRate:      0.99,
+	}
+
+	ratios := GetNetworkRatios(pool, network)
+	require.InDelta(t, 1.1, ratios["participation_rate"], 1e-9)
+	require.InDelta(t, 1.125, ratios["consensus_apr"], 1e-9)
+	// Can't divide by zero and the pool had no proposals
+	require.NotContains(t, ratios, "attestation_effectiveness")
+	require.NotContains(t, ratios, "proposal_success_rate")
+}
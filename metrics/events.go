@@ -0,0 +1,138 @@
+package metrics
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	api "github.com/attestantio/go-eth2-client/api/v1"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/alrevuelta/eth-pools-metrics/config"
+)
+
+// Topics of the beacon node events that are followed
+var eventTopics = []string{"head", "finalized_checkpoint", "chain_reorg", "block"}
+
+// Max already processed epochs that are recomputed after a reorg
+const maxReorgEpochs = uint64(4)
+
+// Follows the beacon node events. Epoch transitions and checkpoints trigger the
+// processing of a new epoch, and reorgs are recorded to recompute the epochs
+// that were already processed with blocks that are no longer canonical
+type ChainEvents struct {
+	trigger chan struct{}
+
+	mutex          sync.Mutex
+	finalizedEpoch uint64
+	// First slot that was reorged and not recomputed yet
+	reorged   bool
+	reorgSlot uint64
+}
+
+func NewChainEvents() *ChainEvents {
+	events := &ChainEvents{
+		trigger: make(chan struct{}, 1),
+	}
+	// Don't wait for any event to process the first epoch
+	events.Trigger()
+	return events
+}
+
+// Requests to process the latest epoch. Triggers are not queued, if there is
+// one pending the new one is dropped
+func (c *ChainEvents) Trigger() {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (c *ChainEvents) Triggered() <-chan struct{} {
+	return c.trigger
+}
+
+func (c *ChainEvents) Handle(event *api.Event) {
+	switch data := event.Data.(type) {
+	case *api.HeadEvent:
+		// New epoch, the previous one can be justified
+		if data.EpochTransition {
+			c.Trigger()
+		}
+	case *api.FinalizedCheckpointEvent:
+		c.mutex.Lock()
+		c.finalizedEpoch = uint64(data.Epoch)
+		c.mutex.Unlock()
+		log.Info("New finalized checkpoint at epoch: ", data.Epoch)
+		c.Trigger()
+	case *api.ChainReorgEvent:
+		log.WithFields(log.Fields{
+			"Slot":  data.Slot,
+			"Depth": data.Depth,
+			"Epoch": data.Epoch,
+		}).Warn("Chain reorg:")
+		c.AddReorg(uint64(data.Slot), data.Depth)
+		c.Trigger()
+	case *api.BlockEvent:
+		// Only logged, the head event is the one that matters
+		log.Debug("New block at slot: ", data.Slot)
+	}
+}
+
+// Records a reorg of depth slots that ended at the given slot
+func (c *ChainEvents) AddReorg(slot uint64, depth uint64) {
+	firstSlot := uint64(0)
+	if depth <= slot {
+		firstSlot = slot - depth + 1
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.reorged || firstSlot < c.reorgSlot {
+		c.reorgSlot = firstSlot
+	}
+	c.reorged = true
+}
+
+// Returns the processed epochs affected by the reorgs since the last call, oldest
+// first. An epoch is affected if its proposals or the state used to calculate
+// its metrics contain reorged slots. Only the last maxReorgEpochs are returned
+func (c *ChainEvents) ReorgedEpochs(lastProcessed uint64) []uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	epochs := make([]uint64, 0)
+	if !c.reorged || lastProcessed == 0 {
+		return epochs
+	}
+	c.reorged = false
+
+	from := c.reorgSlot / config.SlotsInEpoch
+	if lastProcessed >= maxReorgEpochs && from <= lastProcessed-maxReorgEpochs {
+		from = lastProcessed - maxReorgEpochs + 1
+	}
+	for epoch := from; epoch <= lastProcessed; epoch++ {
+		epochs = append(epochs, epoch)
+	}
+	return epochs
+}
+
+func (c *ChainEvents) FinalizedEpoch() uint64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.finalizedEpoch
+}
+
+// Subscribes to the beacon node events. Returns how long to wait for an event
+// before checking the head anyway: an epoch as a safety net if subscribed, or
+// the old polling interval if the beacon node doesn't support events. The
+// subscription is closed when the context is cancelled
+func (a *Metrics) subscribeEvents(ctx context.Context, events *ChainEvents) time.Duration {
+	err := a.beaconNodes.Events(ctx, eventTopics, events.Handle)
+	if err != nil {
+		log.Warn("Could not subscribe to beacon node events, polling instead: ", err)
+		return 5 * time.Second
+	}
+	log.Info("Subscribed to beacon node events: ", eventTopics)
+	return time.Duration(config.SlotsInEpoch*config.SecondsPerSlot) * time.Second
+}
@@ -0,0 +1,45 @@
+package metrics
+
+import (
+	"testing"
+
+	api "github.com/attestantio/go-eth2-client/api/v1"
+	"github.com/attestantio/go-eth2-client/spec/phase0"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_ChainEvents_ReorgedEpochs(t *testing.T) {
+	events := NewChainEvents()
+	require.Equal(t, []uint64{}, events.ReorgedEpochs(100))
+
+	// Slots 3199 and 3200 reorged, epochs 99 and 100
+	events.AddReorg(3200, 2)
+	events.AddReorg(3201, 1)
+	require.Equal(t, []uint64{99, 100}, events.ReorgedEpochs(100))
+	require.Equal(t, []uint64{}, events.ReorgedEpochs(100))
+
+	// Deep reorgs only recompute the last epochs
+	events.AddReorg(3200, 1000)
+	require.Equal(t, []uint64{97, 98, 99, 100}, events.ReorgedEpochs(100))
+
+	// Nothing processed yet
+	events.AddReorg(3200, 1)
+	require.Equal(t, []uint64{}, events.ReorgedEpochs(0))
+}
+
+func Test_ChainEvents_Handle(t *testing.T) {
+	events := NewChainEvents()
+	// First epoch is processed without waiting
+	<-events.Triggered()
+
+	events.Handle(&api.Event{Topic: "head", Data: &api.HeadEvent{Slot: phase0.Slot(10)}})
+	require.Equal(t, 0, len(events.Triggered()))
+
+	events.Handle(&api.Event{Topic: "head", Data: &api.HeadEvent{Slot: phase0.Slot(32), EpochTransition: true}})
+	events.Handle(&api.Event{Topic: "finalized_checkpoint", Data: &api.FinalizedCheckpointEvent{Epoch: phase0.Epoch(3)}})
+	require.Equal(t, 1, len(events.Triggered()))
+	require.Equal(t, uint64(3), events.FinalizedEpoch())
+
+	events.Handle(&api.Event{Topic: "chain_reorg", Data: &api.ChainReorgEvent{Slot: phase0.Slot(160), Depth: 1}})
+	require.Equal(t, []uint64{5}, events.ReorgedEpochs(5))
+}
@@ -0,0 +1,148 @@
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+
+	"github.com/alrevuelta/eth-pools-metrics/config"
+	"github.com/alrevuelta/eth-pools-metrics/health"
+	"github.com/alrevuelta/eth-pools-metrics/prometheus"
+)
+
+// Epochs without processing one until not ready
+const maxEpochsBehind = 3
+
+// Epochs without a loop iteration until not alive. An iteration can take long
+// if the beacon state is big or the nodes are slow
+const maxEpochsStuck = 10
+
+// Keys published by a fetcher are refreshed every hour
+const maxKeysAge = 3 * time.Hour
+
+// Progress of the loop, for the health checks
+type loopStatus struct {
+	mutex         sync.Mutex
+	started       time.Time
+	lastIteration time.Time
+	lastEpoch     uint64
+	lastProcessed time.Time
+	done          bool
+	loopErr       error
+}
+
+func newLoopStatus() *loopStatus {
+	return &loopStatus{
+		started: time.Now(),
+	}
+}
+
+func (s *loopStatus) iteration() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lastIteration = time.Now()
+}
+
+func (s *loopStatus) processed(epoch uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.lastEpoch = epoch
+	s.lastProcessed = time.Now()
+	s.lastIteration = s.lastProcessed
+
+	prometheus.LastProcessedEpoch.Set(float64(epoch))
+	prometheus.LastProcessedEpochTimestamp.Set(float64(s.lastProcessed.Unix()))
+}
+
+func observeStage(stage string, start time.Time) {
+	prometheus.StageDuration.WithLabelValues(stage).Observe(time.Since(start).Seconds())
+}
+
+func (s *loopStatus) stopped(err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.done = true
+	s.loopErr = err
+}
+
+func (s *loopStatus) err() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.loopErr
+}
+
+func epochDuration() time.Duration {
+	return time.Duration(config.SlotsInEpoch*config.SecondsPerSlot) * time.Second
+}
+
+// Alive while the loop runs and is not stuck. Waiting for the first keys of
+// a pool is not being stuck, the first fetch can take long
+func (s *loopStatus) checkLoop(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.done {
+		if s.loopErr != nil {
+			return errors.Wrap(s.loopErr, "loop stopped")
+		}
+		return errors.New("loop stopped")
+	}
+	if s.lastIteration.IsZero() {
+		return nil
+	}
+	if since := time.Since(s.lastIteration); since > maxEpochsStuck*epochDuration() {
+		return errors.New(fmt.Sprintf("loop stuck for %s", since.Round(time.Second)))
+	}
+	return nil
+}
+
+// Ready once an epoch was processed, and while new ones are
+func (s *loopStatus) checkEpochs(ctx context.Context) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.lastProcessed.IsZero() {
+		return errors.New(fmt.Sprintf("no epoch processed since start %s ago", time.Since(s.started).Round(time.Second)))
+	}
+	if since := time.Since(s.lastProcessed); since > maxEpochsBehind*epochDuration() {
+		return errors.New(fmt.Sprintf("last processed epoch %d was %s ago", s.lastEpoch, since.Round(time.Second)))
+	}
+	return nil
+}
+
+// Registers the health checks of the loop and its dependencies. Only the loop
+// is critical, restarting won't fix a beacon node or database that is down
+func (a *Metrics) RegisterHealth(h *health.Health) {
+	h.Register("loop", true, a.status.checkLoop)
+	h.Register("epochs", false, a.status.checkEpochs)
+	if a.beaconNodes != nil {
+		h.Register("beacon", false, func(ctx context.Context) error {
+			return a.beaconNodes.Status()
+		})
+	}
+	if a.postgresql != nil {
+		h.Register("database", false, func(ctx context.Context) error {
+			return a.postgresql.Ping(ctx)
+		})
+	}
+	h.Register("keys", false, a.checkKeys)
+}
+
+// Keys of the pools with a fetcher must be refreshed periodically. The ones
+// from files or deposits are read every epoch
+func (a *Metrics) checkKeys(ctx context.Context) error {
+	for _, poolName := range a.PoolNames {
+		if poolName != "rocketpool" && !a.isLidoRegistry(poolName) {
+			continue
+		}
+		snapshot, exists := a.keyRegistry.Snapshot(poolName)
+		if !exists {
+			return errors.New("keys not available yet for pool: " + poolName)
+		}
+		if since := time.Since(snapshot.Updated); since > maxKeysAge {
+			return errors.New(fmt.Sprintf("keys of pool %s not refreshed for %s", poolName, since.Round(time.Second)))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,35 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_LoopStatus(t *testing.T) {
+	status := newLoopStatus()
+	ctx := context.Background()
+
+	// Waiting for the first epoch
+	require.NoError(t, status.checkLoop(ctx))
+	require.Error(t, status.checkEpochs(ctx))
+
+	status.processed(150000)
+	require.NoError(t, status.checkLoop(ctx))
+	require.NoError(t, status.checkEpochs(ctx))
+
+	// Nothing processed for a while but the loop is running
+	status.lastProcessed = time.Now().Add(-(maxEpochsBehind + 1) * epochDuration())
+	status.iteration()
+	require.NoError(t, status.checkLoop(ctx))
+	require.Error(t, status.checkEpochs(ctx))
+
+	status.lastIteration = time.Now().Add(-(maxEpochsStuck + 1) * epochDuration())
+	require.Error(t, status.checkLoop(ctx))
+
+	status.stopped(errors.New("could not load state"))
+	require.EqualError(t, status.checkLoop(ctx), "loop stopped: could not load state")
+}
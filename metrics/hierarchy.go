@@ -0,0 +1,74 @@
+package metrics
+
+import (
+	"encoding/hex"
+	"sort"
+)
+
+// Returns the keys of each parent pool as the union of its own keys and the
+// keys of all its descendants. Keys present in more than one child are only
+// counted once.
+func GetParentPoolKeys(
+	poolKeys map[string][][]byte,
+	parents map[string]string) map[string][][]byte {
+
+	parentKeys := make(map[string][][]byte, 0)
+	seen := make(map[string]map[string]bool, 0)
+
+	addKeys := func(pool string, keys [][]byte) {
+		if _, exists := seen[pool]; !exists {
+			seen[pool] = make(map[string]bool, 0)
+			parentKeys[pool] = make([][]byte, 0)
+		}
+		for _, key := range keys {
+			keyStr := hex.EncodeToString(key)
+			if !seen[pool][keyStr] {
+				seen[pool][keyStr] = true
+				parentKeys[pool] = append(parentKeys[pool], key)
+			}
+		}
+	}
+
+	// Sorted to get a deterministic order of the keys
+	pools := make([]string, 0, len(poolKeys))
+	for pool := range poolKeys {
+		pools = append(pools, pool)
+	}
+	sort.Strings(pools)
+
+	for _, pool := range pools {
+		// Parents that are pools on their own keep their keys
+		if IsParent(pool, parents) {
+			addKeys(pool, poolKeys[pool])
+		}
+		for _, ancestor := range GetAncestors(pool, parents) {
+			addKeys(ancestor, poolKeys[pool])
+		}
+	}
+
+	return parentKeys
+}
+
+// Returns the parent, grandparent, etc of a pool. Cycles are cut.
+func GetAncestors(pool string, parents map[string]string) []string {
+	ancestors := make([]string, 0)
+	visited := map[string]bool{pool: true}
+	for {
+		parent, exists := parents[pool]
+		if !exists || visited[parent] {
+			return ancestors
+		}
+		ancestors = append(ancestors, parent)
+		visited[parent] = true
+		pool = parent
+	}
+}
+
+func IsParent(pool string, parents map[string]string) bool {
+	for _, parent := range parents {
+		if parent == pool {
+			return true
+		}
+	}
+	return false
+}
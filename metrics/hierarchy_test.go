@@ -0,0 +1,44 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_GetParentPoolKeys(t *testing.T) {
+	poolKeys := map[string][][]byte{
+		"kraken":    {{0x01}, {0x02}},
+		"coinbase":  {{0x02}, {0x03}},
+		"exchanges": {{0x04}},
+		"other":     {{0x05}},
+	}
+	parents := map[string]string{
+		"kraken":    "cex",
+		"coinbase":  "cex",
+		"cex":       "exchanges",
+		"exchanges": "all",
+	}
+
+	parentKeys := GetParentPoolKeys(poolKeys, parents)
+
+	require.Equal(t, 3, len(parentKeys))
+	require.Equal(t, [][]byte{{0x02}, {0x03}, {0x01}}, parentKeys["cex"])
+	require.Equal(t, [][]byte{{0x02}, {0x03}, {0x04}, {0x01}}, parentKeys["exchanges"])
+	require.Equal(t, [][]byte{{0x02}, {0x03}, {0x04}, {0x01}}, parentKeys["all"])
+	require.NotContains(t, parentKeys, "other")
+}
+
+func Test_GetAncestors(t *testing.T) {
+	parents := map[string]string{
+		"a": "b",
+		"b": "c",
+		"x": "y",
+		"y": "x",
+	}
+	require.Equal(t, []string{"b", "c"}, GetAncestors("a", parents))
+	require.Equal(t, []string{}, GetAncestors("c", parents))
+	require.Equal(t, []string{"y"}, GetAncestors("x", parents))
+	require.True(t, IsParent("c", parents))
+	require.False(t, IsParent("a", parents))
+}
@@ -0,0 +1,199 @@
+package metrics
+
+import (
+	"encoding/hex"
+	"sync"
+
+	"github.com/attestantio/go-eth2-client/spec"
+	"github.com/attestantio/go-eth2-client/spec/phase0"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/alrevuelta/eth-pools-metrics/pools"
+)
+
+// Maps the validator keys to its index across epochs. Indexes never change, so
+// only the validators added since the last state are indexed. The indexes of
+// each pool are cached until its keys change or new validators are indexed.
+// Lookups only take the read lock, pools are resolved under it and swapped in
+type KeyIndex struct {
+	mutex      sync.RWMutex
+	indexes    map[phase0.BLSPubKey]uint64
+	validators uint64
+	// Times all validators were indexed again, see ForState
+	resets uint64
+	pools  map[string]*poolIndexes
+}
+
+type poolIndexes struct {
+	// Of the pool keys, to know when they change
+	fingerprint uint64
+	// Validators indexed when resolved. Unknown keys can be found later
+	validators uint64
+	missing    [][]byte
+	indexes    []uint64
+	maxIndex   uint64
+}
+
+// Lookups in a given state, validators that are not in the state are not found
+type StateIndex struct {
+	keyIndex   *KeyIndex
+	validators uint64
+}
+
+func NewKeyIndex() *KeyIndex {
+	return &KeyIndex{
+		indexes: make(map[phase0.BLSPubKey]uint64, 0),
+		pools:   make(map[string]*poolIndexes, 0),
+	}
+}
+
+// Indexes the new validators of the state. States can be older than the last
+// one, eg when recomputing an epoch
+func (k *KeyIndex) ForState(beaconState *spec.VersionedBeaconState) *StateIndex {
+	validators := GetValidators(beaconState)
+	nValidators := uint64(len(validators))
+
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+
+	// A different key at a known index means the deposits were reorged
+	known := k.validators
+	if nValidators < known {
+		known = nValidators
+	}
+	if known > 0 {
+		index, exists := k.indexes[validators[known-1].PublicKey]
+		if !exists || index != known-1 {
+			log.Warn("Validator indexes changed, indexing all validators again")
+			k.indexes = make(map[phase0.BLSPubKey]uint64, len(validators))
+			k.pools = make(map[string]*poolIndexes, 0)
+			k.validators = 0
+			k.resets++
+		}
+	}
+
+	if nValidators > k.validators {
+		log.Debug("Indexing ", nValidators-k.validators, " new validators")
+		for index := k.validators; index < nValidators; index++ {
+			k.indexes[validators[index].PublicKey] = index
+		}
+		k.validators = nValidators
+	}
+
+	return &StateIndex{
+		keyIndex:   k,
+		validators: nValidators,
+	}
+}
+
+// Index of a validator key, false if not in the state
+func (s *StateIndex) Get(key []byte) (uint64, bool) {
+	s.keyIndex.mutex.RLock()
+	defer s.keyIndex.mutex.RUnlock()
+	return s.get(key)
+}
+
+func (s *StateIndex) get(key []byte) (uint64, bool) {
+	var pubKey phase0.BLSPubKey
+	if len(key) != len(pubKey) {
+		return 0, false
+	}
+	copy(pubKey[:], key)
+	index, exists := s.keyIndex.indexes[pubKey]
+	if !exists || index >= s.validators {
+		return 0, false
+	}
+	return index, true
+}
+
+// Indexes of the keys of a pool, cached across epochs. The returned slice is
+// shared and must not be modified
+func (s *StateIndex) GetPool(poolName string, keys [][]byte) []uint64 {
+	fingerprint := pools.KeysFingerprint(keys)
+	k := s.keyIndex
+
+	k.mutex.RLock()
+	cached, exists := k.pools[poolName]
+	var resolved *poolIndexes
+	if !exists || cached.fingerprint != fingerprint {
+		resolved = s.resolvePool(keys, fingerprint)
+	} else if len(cached.missing) > 0 && cached.validators != k.validators {
+		resolved = s.resolveMissing(cached)
+	}
+	resets := k.resets
+	k.mutex.RUnlock()
+
+	if resolved != nil {
+		// Not cached if validators were indexed meanwhile, resolved again next time
+		k.mutex.Lock()
+		if k.resets == resets && k.validators == resolved.validators {
+			k.pools[poolName] = resolved
+		}
+		k.mutex.Unlock()
+		cached = resolved
+	}
+
+	// Older state than the indexed one, without some validators
+	if cached.maxIndex < s.validators || len(cached.indexes) == 0 {
+		return cached.indexes
+	}
+	indexes := make([]uint64, 0, len(cached.indexes))
+	for _, index := range cached.indexes {
+		if index < s.validators {
+			indexes = append(indexes, index)
+		}
+	}
+	return indexes
+}
+
+// Must be called with the lock held. Resolved against all indexed validators,
+// not only the ones in the state
+func (s *StateIndex) resolvePool(keys [][]byte, fingerprint uint64) *poolIndexes {
+	resolved := &poolIndexes{
+		fingerprint: fingerprint,
+		validators:  s.keyIndex.validators,
+		indexes:     make([]uint64, 0, len(keys)),
+	}
+	s.resolve(resolved, keys)
+	for _, key := range resolved.missing {
+		log.Warn("Index for key: ", hex.EncodeToString(key), " not found in beacon state")
+	}
+	return resolved
+}
+
+// Must be called with the lock held. Only the keys that were not found, once
+// there are new validators. A copy, the indexes may be in use
+func (s *StateIndex) resolveMissing(cached *poolIndexes) *poolIndexes {
+	resolved := &poolIndexes{
+		fingerprint: cached.fingerprint,
+		validators:  s.keyIndex.validators,
+		indexes:     make([]uint64, len(cached.indexes), len(cached.indexes)+len(cached.missing)),
+		maxIndex:    cached.maxIndex,
+	}
+	copy(resolved.indexes, cached.indexes)
+	s.resolve(resolved, cached.missing)
+	log.Debug("Found ", len(cached.missing)-len(resolved.missing), " of ", len(cached.missing), " missing keys")
+	return resolved
+}
+
+func (s *StateIndex) resolve(resolved *poolIndexes, keys [][]byte) {
+	all := &StateIndex{keyIndex: s.keyIndex, validators: s.keyIndex.validators}
+	for _, key := range keys {
+		index, found := all.get(key)
+		if !found {
+			resolved.missing = append(resolved.missing, key)
+			continue
+		}
+		resolved.indexes = append(resolved.indexes, index)
+		if index > resolved.maxIndex {
+			resolved.maxIndex = index
+		}
+	}
+}
+
+// Forgets the indexes of a pool that was removed
+func (k *KeyIndex) Remove(poolName string) {
+	k.mutex.Lock()
+	defer k.mutex.Unlock()
+	delete(k.pools, poolName)
+}
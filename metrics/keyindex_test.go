@@ -0,0 +1,96 @@
+package metrics
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/attestantio/go-eth2-client/spec"
+	"github.com/attestantio/go-eth2-client/spec/altair"
+	"github.com/attestantio/go-eth2-client/spec/phase0"
+	"github.com/stretchr/testify/require"
+)
+
+func stateWithKeys(keys ...phase0.BLSPubKey) *spec.VersionedBeaconState {
+	validators := make([]*phase0.Validator, 0)
+	for _, key := range keys {
+		validators = append(validators, &phase0.Validator{PublicKey: key})
+	}
+	return &spec.VersionedBeaconState{
+		Altair: &altair.BeaconState{Validators: validators},
+	}
+}
+
+func Test_KeyIndex_Incremental(t *testing.T) {
+	keyIndex := NewKeyIndex()
+	poolKeys := [][]byte{validator_2[:], validator_0[:]}
+
+	// validator_2 not deposited yet
+	stateIndex := keyIndex.ForState(stateWithKeys(validator_0, validator_1))
+	require.Equal(t, []uint64{0}, stateIndex.GetPool("pool", poolKeys))
+
+	// Found once in the state, only the missing key is resolved again
+	stateIndex = keyIndex.ForState(stateWithKeys(validator_0, validator_1, validator_2))
+	require.Equal(t, uint64(3), keyIndex.validators)
+	require.Equal(t, []uint64{0, 2}, stateIndex.GetPool("pool", poolKeys))
+	require.Empty(t, keyIndex.pools["pool"].missing)
+
+	// Recomputing an older epoch
+	oldIndex := keyIndex.ForState(stateWithKeys(validator_0, validator_1))
+	require.Equal(t, uint64(3), keyIndex.validators)
+	require.Equal(t, []uint64{0}, oldIndex.GetPool("pool", poolKeys))
+	_, found := oldIndex.Get(validator_2[:])
+	require.False(t, found)
+
+	// The pool keys changed
+	require.Equal(t, []uint64{1}, stateIndex.GetPool("pool", [][]byte{validator_1[:]}))
+
+	keyIndex.Remove("pool")
+	require.Empty(t, keyIndex.pools)
+}
+
+func Test_KeyIndex_CachesPools(t *testing.T) {
+	keyIndex := NewKeyIndex()
+	stateIndex := keyIndex.ForState(stateWithKeys(validator_0, validator_1))
+	poolKeys := [][]byte{validator_1[:]}
+
+	indexes := stateIndex.GetPool("pool", poolKeys)
+	require.Equal(t, []uint64{1}, indexes)
+
+	// New validators don't matter if all keys were found
+	stateIndex = keyIndex.ForState(stateWithKeys(validator_0, validator_1, validator_2))
+	require.Same(t, &indexes[0], &stateIndex.GetPool("pool", poolKeys)[0])
+}
+
+func Test_KeyIndex_Reorg(t *testing.T) {
+	keyIndex := NewKeyIndex()
+	stateIndex := keyIndex.ForState(stateWithKeys(validator_0, validator_1, validator_2))
+	require.Equal(t, []uint64{2}, stateIndex.GetPool("pool", [][]byte{validator_2[:]}))
+
+	// Other deposit was processed at index 2
+	stateIndex = keyIndex.ForState(stateWithKeys(validator_0, validator_1, validator_3, validator_2))
+	require.Equal(t, []uint64{3}, stateIndex.GetPool("pool", [][]byte{validator_2[:]}))
+	index, found := stateIndex.Get(validator_3[:])
+	require.True(t, found)
+	require.Equal(t, uint64(2), index)
+}
+
+func Test_KeyIndex_Concurrent(t *testing.T) {
+	keyIndex := NewKeyIndex()
+	stateIndex := keyIndex.ForState(stateWithKeys(validator_0, validator_1))
+	poolKeys := [][]byte{validator_1[:], validator_2[:]}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			require.Equal(t, []uint64{1}, stateIndex.GetPool("pool", poolKeys))
+		}()
+	}
+	newIndex := keyIndex.ForState(stateWithKeys(validator_0, validator_1, validator_2))
+	wg.Wait()
+
+	// Whatever was cached meanwhile, the new validator is found
+	require.Equal(t, []uint64{1, 2}, newIndex.GetPool("pool", poolKeys))
+	require.Empty(t, keyIndex.pools["pool"].missing)
+}
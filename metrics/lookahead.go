@@ -0,0 +1,186 @@
+package metrics
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	api "github.com/attestantio/go-eth2-client/api/v1"
+	"github.com/attestantio/go-eth2-client/spec"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/alrevuelta/eth-pools-metrics/config"
+	"github.com/alrevuelta/eth-pools-metrics/prometheus"
+	"github.com/alrevuelta/eth-pools-metrics/schemas"
+)
+
+// Upcoming duties of each pool, recalculated every epoch
+type Lookahead struct {
+	mutex sync.RWMutex
+	pools map[string]*schemas.PoolLookahead
+}
+
+func NewLookahead() *Lookahead {
+	return &Lookahead{
+		pools: make(map[string]*schemas.PoolLookahead, 0),
+	}
+}
+
+func (l *Lookahead) Set(lookahead *schemas.PoolLookahead) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.pools[lookahead.Pool] = lookahead
+}
+
+func (l *Lookahead) Get(poolName string) (*schemas.PoolLookahead, bool) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+	lookahead, exists := l.pools[poolName]
+	return lookahead, exists
+}
+
+func (l *Lookahead) Remove(poolName string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	delete(l.pools, poolName)
+}
+
+// Returns the time of the next proposal of each pool, only for pools
+// with a proposal after now
+func (l *Lookahead) GetNextProposals(now time.Time) map[string]time.Time {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	nextProposals := make(map[string]time.Time, 0)
+	for poolName, lookahead := range l.pools {
+		// Proposals are sorted by slot
+		for _, proposal := range lookahead.Proposals {
+			if proposal.Time.After(now) {
+				nextProposals[poolName] = proposal.Time
+				break
+			}
+		}
+	}
+	return nextProposals
+}
+
+// Calculates the proposals of the current and next epoch that are still pending
+// and the sync committees the validators of each pool belong to, so that
+// maintenance can be planned around them
+func (a *Metrics) RunLookahead(
+	headSlot uint64,
+	poolNames []string,
+	poolKeys map[string][][]byte,
+	beaconState *spec.VersionedBeaconState,
+	valKeyToIndex *StateIndex) {
+
+	headEpoch := headSlot / config.SlotsInEpoch
+	duties := make([]*api.ProposerDuty, 0)
+	for _, epoch := range []uint64{headEpoch, headEpoch + 1} {
+		epochDuties, err := a.proposalDuties.GetProposalDuties(epoch)
+		if err != nil {
+			log.Error("Could not get upcoming proposal duties: ", err)
+			return
+		}
+		duties = append(duties, epochDuties...)
+	}
+
+	currentSyncCommittee, nextSyncCommittee, nextSyncCommitteeEpoch := GetSyncCommittees(
+		headEpoch, beaconState, valKeyToIndex)
+
+	// Both pools and its sub pools
+	lookaheadKeys := make(map[string][][]byte, 0)
+	for _, poolName := range poolNames {
+		lookaheadKeys[poolName] = poolKeys[poolName]
+		for _, subPool := range a.GetSubPools(poolName) {
+			lookaheadKeys[subPool.Pool] = subPool.Keys
+		}
+	}
+
+	for poolName, pubKeys := range lookaheadKeys {
+		indexes := valKeyToIndex.GetPool(poolName, pubKeys)
+		lookahead := &schemas.PoolLookahead{
+			Pool:                   poolName,
+			Epoch:                  headEpoch,
+			Proposals:              GetUpcomingProposals(indexes, duties, headSlot),
+			CurrentSyncCommittee:   GetSyncCommitteeMembers(indexes, currentSyncCommittee),
+			NextSyncCommittee:      GetSyncCommitteeMembers(indexes, nextSyncCommittee),
+			NextSyncCommitteeEpoch: nextSyncCommitteeEpoch,
+			NextSyncCommitteeTime:  config.EpochTime(nextSyncCommitteeEpoch),
+		}
+		a.lookahead.Set(lookahead)
+		setPrometheusLookahead(lookahead)
+	}
+}
+
+// Returns the proposals of the given validators after the head slot, sorted by slot
+func GetUpcomingProposals(
+	indexes []uint64,
+	duties []*api.ProposerDuty,
+	headSlot uint64) []schemas.UpcomingProposal {
+
+	proposals := make([]schemas.UpcomingProposal, 0)
+	for _, duty := range duties {
+		slot := uint64(duty.Slot)
+		if slot <= headSlot || !IsValidatorIn(uint64(duty.ValidatorIndex), indexes) {
+			continue
+		}
+		proposals = append(proposals, schemas.UpcomingProposal{
+			ValIndex: uint64(duty.ValidatorIndex),
+			Slot:     slot,
+			Time:     config.SlotTime(slot),
+		})
+	}
+	sort.Slice(proposals, func(i, j int) bool { return proposals[i].Slot < proposals[j].Slot })
+	return proposals
+}
+
+// Returns the indexes of the current and next sync committee at the head epoch
+// and the epoch when the next one starts. The state is a few epochs behind the
+// head, so if a period started in between its next committee is the current one
+// and the next one is not known yet
+func GetSyncCommittees(
+	headEpoch uint64,
+	beaconState *spec.VersionedBeaconState,
+	valKeyToIndex *StateIndex) ([]uint64, []uint64, uint64) {
+
+	stateEpoch := GetSlot(beaconState) / config.SlotsInEpoch
+	statePeriod := stateEpoch / config.EpochsPerSyncCommitteePeriod
+	headPeriod := headEpoch / config.EpochsPerSyncCommitteePeriod
+	nextPeriodEpoch := (headPeriod + 1) * config.EpochsPerSyncCommitteePeriod
+
+	current := GetIndexesFromKeys(BLSPubKeyToByte(GetCurrentSyncCommittee(beaconState)), valKeyToIndex)
+	next := GetIndexesFromKeys(BLSPubKeyToByte(GetNextSyncCommittee(beaconState)), valKeyToIndex)
+	if headPeriod > statePeriod {
+		return next, make([]uint64, 0), nextPeriodEpoch
+	}
+	return current, next, nextPeriodEpoch
+}
+
+// Returns the given validators that belong to the sync committee, without duplicates
+func GetSyncCommitteeMembers(indexes []uint64, committee []uint64) []uint64 {
+	inCommittee := make(map[uint64]bool, len(committee))
+	for _, valIndex := range committee {
+		inCommittee[valIndex] = true
+	}
+
+	members := make([]uint64, 0)
+	for _, valIndex := range indexes {
+		if inCommittee[valIndex] {
+			members = append(members, valIndex)
+			// Only once even if the pool has repeated keys
+			inCommittee[valIndex] = false
+		}
+	}
+	sort.Slice(members, func(i, j int) bool { return members[i] < members[j] })
+	return members
+}
+
+func setPrometheusLookahead(lookahead *schemas.PoolLookahead) {
+	prometheus.UpcomingProposals.WithLabelValues(
+		lookahead.Pool).Set(float64(len(lookahead.Proposals)))
+	prometheus.SyncCommitteeValidators.WithLabelValues(
+		lookahead.Pool, "current").Set(float64(len(lookahead.CurrentSyncCommittee)))
+	prometheus.SyncCommitteeValidators.WithLabelValues(
+		lookahead.Pool, "next").Set(float64(len(lookahead.NextSyncCommittee)))
+}
@@ -0,0 +1,58 @@
+package metrics
+
+import (
+	"testing"
+	"time"
+
+	api "github.com/attestantio/go-eth2-client/api/v1"
+	"github.com/attestantio/go-eth2-client/spec/phase0"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alrevuelta/eth-pools-metrics/config"
+	"github.com/alrevuelta/eth-pools-metrics/schemas"
+)
+
+func Test_GetUpcomingProposals(t *testing.T) {
+	require.True(t, config.ApplyNetworkPreset("mainnet"))
+	genesis := time.Unix(1606824023, 0)
+	duties := []*api.ProposerDuty{
+		{Slot: phase0.Slot(101), ValidatorIndex: phase0.ValidatorIndex(7)},
+		{Slot: phase0.Slot(99), ValidatorIndex: phase0.ValidatorIndex(5)},
+		{Slot: phase0.Slot(100), ValidatorIndex: phase0.ValidatorIndex(5)},
+		{Slot: phase0.Slot(130), ValidatorIndex: phase0.ValidatorIndex(5)},
+	}
+
+	// Slot 99 and 100 were already proposed or missed, 101 is from other validator
+	proposals := GetUpcomingProposals([]uint64{5, 6}, duties, 100)
+	require.Equal(t, []schemas.UpcomingProposal{
+		{ValIndex: 5, Slot: 130, Time: genesis.Add(130 * 12 * time.Second)},
+	}, proposals)
+}
+
+func Test_GetSyncCommitteeMembers(t *testing.T) {
+	committee := []uint64{9, 3, 1, 3}
+	require.Equal(t, []uint64{1, 3}, GetSyncCommitteeMembers([]uint64{3, 2, 1, 3}, committee))
+	require.Equal(t, []uint64{}, GetSyncCommitteeMembers([]uint64{2}, committee))
+}
+
+func Test_Lookahead_GetNextProposals(t *testing.T) {
+	now := time.Unix(1000, 0)
+	lookahead := NewLookahead()
+	lookahead.Set(&schemas.PoolLookahead{
+		Pool: "pool1",
+		Proposals: []schemas.UpcomingProposal{
+			{ValIndex: 1, Slot: 10, Time: now.Add(-time.Second)},
+			{ValIndex: 2, Slot: 12, Time: now.Add(24 * time.Second)},
+		},
+	})
+	lookahead.Set(&schemas.PoolLookahead{Pool: "pool2"})
+
+	require.Equal(t, map[string]time.Time{
+		"pool1": now.Add(24 * time.Second),
+	}, lookahead.GetNextProposals(now))
+
+	_, exists := lookahead.Get("pool2")
+	require.True(t, exists)
+	_, exists = lookahead.Get("pool3")
+	require.False(t, exists)
+}
@@ -2,19 +2,24 @@ package metrics
 
 import (
 	"context"
-	"os"
+	"fmt"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/attestantio/go-eth2-client/http"
 	"github.com/attestantio/go-eth2-client/spec"
-	"github.com/rs/zerolog"
 
+	"github.com/alrevuelta/eth-pools-metrics/alerts"
+	"github.com/alrevuelta/eth-pools-metrics/beacon"
 	"github.com/alrevuelta/eth-pools-metrics/config"
 	"github.com/alrevuelta/eth-pools-metrics/pools"
 	"github.com/alrevuelta/eth-pools-metrics/postgresql"
+	"github.com/alrevuelta/eth-pools-metrics/prometheus"
+	"github.com/alrevuelta/eth-pools-metrics/schemas"
+	"github.com/alrevuelta/eth-pools-metrics/store"
 	"github.com/alrevuelta/eth-pools-metrics/thegraph"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
@@ -22,28 +27,43 @@ import (
 )
 
 type Metrics struct {
-	genesisSeconds uint64
-	slotsInEpoch   uint64
-
 	depositedKeys  [][]byte
 	validatingKeys [][]byte
 	withCredList   []string
 	fromAddrList   []string
 	eth1Address    string
-	eth2Address    string
 	theGraph       *thegraph.Thegraph // TODO: Remove
 	postgresql     *postgresql.Postgresql
+	memory         *store.Memory
 
-	httpClient *http.Service
+	beaconNodes *beacon.Pool
+	// Saved files used instead of the beacon nodes, nil if not offline
+	offline *beacon.Cache
 
 	beaconState    *BeaconState
 	proposalDuties *ProposalDuties
+	keyRegistry    *pools.KeyRegistry
+	alerts         *alerts.Engine
+	streaks        *StreakTracker
+	lookahead      *Lookahead
+	keyIndex       *KeyIndex
+	// Loaded once at startup, never modified
+	spec *config.ChainSpec
 
 	// Slot and epoch and its raw data
 	// TODO: Remove, each metric task has its pace
 	Epoch uint64
 	Slot  uint64
 
+	// Closed once the loop stopped
+	done   chan struct{}
+	status *loopStatus
+	// Key fetchers running in the background, they may write to the store
+	fetchers sync.WaitGroup
+
+	// Epochs that failed or were skipped
+	retries *RetryQueue
+
 	PoolNames  []string
 	epochDebug string
 	config     *config.Config // TODO: Remove repeated parameters
@@ -53,18 +73,6 @@ func NewMetrics(
 	ctx context.Context,
 	config *config.Config) (*Metrics, error) {
 
-	/* TODO: Get from a http endpoint instead of prysm gRPC
-	genesis, err := nodeClient.GetGenesis(ctx, &emptypb.Empty{})
-	if err != nil {
-		return nil, errors.Wrap(err, "error getting genesis info")
-	}*/
-
-	/* TODO: Get from a http endpoint instead of prysm gRPC
-	slotsInEpoch, err := GetSlotsInEpoch(ctx, beaconClient)
-	if err != nil {
-		return nil, errors.Wrap(err, "error getting slots in epoch from config")
-	}*/
-
 	var pg *postgresql.Postgresql
 	var err error
 	if config.Postgres != "" {
@@ -78,193 +86,863 @@ func NewMetrics(
 		}
 	}
 
+	var alertsEngine *alerts.Engine
+	if config.AlertsConfig != "" {
+		alertsConfig, err := alerts.LoadConfig(config.AlertsConfig)
+		if err != nil {
+			return nil, err
+		}
+		alertsEngine, err = alerts.NewEngine(alertsConfig)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not create alerts")
+		}
+	}
+
 	for _, poolName := range config.PoolNames {
 		if strings.HasSuffix(poolName, ".txt") {
 			pubKeysDeposited, err := pools.ReadCustomValidatorsFile(poolName)
 			if err != nil {
-				log.Fatal(err)
+				return nil, err
 			}
 			log.Info("File: ", poolName, " contains ", len(pubKeysDeposited), " keys")
 
 		}
 	}
 
-	client, err := http.New(context.Background(),
-		http.WithTimeout(60*time.Second),
-		http.WithAddress(config.Eth2Address),
-		http.WithLogLevel(zerolog.WarnLevel),
-	)
+	// Offline no beacon node is used, the epoch is replayed from saved files
+	var offline *beacon.Cache
+	var beaconNodes *beacon.Pool
+	if config.OfflineDir != "" {
+		offline, err = beacon.NewCache(config.OfflineDir, 0)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		var cache *beacon.Cache
+		if config.StateCache != "" {
+			cache, err = beacon.NewCache(config.StateCache, config.StateCacheKeep)
+			if err != nil {
+				return nil, err
+			}
+		}
+		beaconNodes, err = beacon.NewPool(
+			config.Eth2Addresses,
+			config.MaxSyncLag,
+			time.Duration(config.StateTimeout)*time.Second,
+			cache)
+		if err != nil {
+			return nil, err
+		}
+	}
+	// Nothing runs in the background until the spec is loaded
+	spec, err := loadChainSpec(ctx, beaconNodes, offline, config.Network)
 	if err != nil {
 		return nil, err
 	}
+	for _, poolName := range config.PoolNames {
+		if err := pools.CheckDepositContract(poolName, spec.DepositContract, spec.DepositChainId); err != nil {
+			return nil, err
+		}
+	}
+	if beaconNodes != nil {
+		beaconNodes.Start(ctx, spec)
+	}
 
-	httpClient := client.(*http.Service)
+	var failedEpochStore FailedEpochStore
+	if pg != nil {
+		if err := pg.CreateFailedEpochsTable(); err != nil {
+			return nil, errors.Wrap(err, "error creating failed epochs table")
+		}
+		failedEpochStore = pg
+	} else if config.FailedEpochsFile != "" {
+		failedEpochStore = NewFileFailedEpochStore(config.FailedEpochsFile)
+	}
+	retries, err := NewRetryQueue(failedEpochStore, config.MaxEpochRetries)
+	if err != nil {
+		return nil, err
+	}
+
+	var streakStore StreakStore
+	if pg != nil {
+		if err := pg.CreateValidatorStreaksTable(); err != nil {
+			return nil, errors.Wrap(err, "error creating validator streaks table")
+		}
+		streakStore = pg
+	} else if config.StreaksFile != "" {
+		streakStore = NewFileStreakStore(config.StreaksFile)
+	}
+	streaks, err := NewStreakTracker(streakStore)
+	if err != nil {
+		return nil, err
+	}
 
 	return &Metrics{
 		withCredList: config.WithdrawalCredentials,
 		fromAddrList: config.FromAddress,
-		//genesisSeconds:    uint64(genesis.GenesisTime.Seconds),
-		//slotsInEpoch:      uint64(slotsInEpoch),
-		eth1Address: config.Eth1Address,
-		eth2Address: config.Eth2Address,
-		postgresql:  pg,
-		PoolNames:   config.PoolNames,
-		httpClient:  httpClient,
-		epochDebug:  config.EpochDebug,
-		config:      config,
+		eth1Address:  config.Eth1Address,
+		postgresql:   pg,
+		memory:       store.NewMemory(memoryEpochs(config)),
+		PoolNames:    config.PoolNames,
+		beaconNodes:  beaconNodes,
+		offline:      offline,
+		spec:         spec,
+		epochDebug:   config.EpochDebug,
+		config:       config,
+		keyRegistry:  pools.NewKeyRegistry(),
+		alerts:       alertsEngine,
+		streaks:      streaks,
+		lookahead:    NewLookahead(),
+		keyIndex:     NewKeyIndex(),
+		retries:      retries,
+		done:         make(chan struct{}),
+		status:       newLoopStatus(),
 	}, nil
 }
 
-func (a *Metrics) Run() {
+// Epochs kept in memory, by default enough for the longest rolling window.
+// Must be called after loading the chain spec
+func memoryEpochs(cfg *config.Config) int {
+	if cfg.MemoryEpochs > 0 {
+		return cfg.MemoryEpochs
+	}
+	longest := time.Duration(0)
+	for _, window := range cfg.RollingWindows {
+		if window > longest {
+			longest = window
+		}
+	}
+	// At least the last epoch for the api
+	return int(config.EpochsIn(longest)) + 1
+}
+
+// From the beacon nodes, or the saved files offline. Files saved before the
+// spec was cached only work with known networks
+func loadChainSpec(
+	ctx context.Context,
+	beaconNodes *beacon.Pool,
+	offline *beacon.Cache,
+	network string) (*config.ChainSpec, error) {
+
+	if offline == nil {
+		spec, err := beaconNodes.ChainSpec(ctx)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not load the chain spec")
+		}
+		config.ApplySpec(spec)
+		return spec, nil
+	}
+
+	spec, err := offline.LoadSpec()
+	if err == beacon.ErrNotCached {
+		preset, known := config.NetworkPreset(network)
+		if !known {
+			return nil, errors.New("no saved spec for network " + network)
+		}
+		log.Warn("No saved spec, using the parameters of ", network)
+		spec = preset
+	} else if err != nil {
+		return nil, errors.Wrap(err, "could not load the saved spec")
+	}
+	config.ApplySpec(spec)
+	return spec, nil
+}
+
+// Starts the key fetchers and the loop in the background. Everything stops when
+// the context is cancelled, see Done
+func (a *Metrics) Run(ctx context.Context) error {
+	if a.epochDebug != "" {
+		if _, err := strconv.ParseUint(a.epochDebug, 10, 64); err != nil {
+			return errors.Wrap(err, "invalid debug epoch")
+		}
+	}
+
 	bc, err := NewBeaconState(
 		a.eth1Address,
-		a.eth2Address,
+		a.beaconNodes,
 		a.postgresql,
 		a.fromAddrList,
 		a.PoolNames,
-		a.config.StateTimeout,
+		a.config.CheckStateRoots,
+		a.offline,
+		a.spec,
 	)
 	if err != nil {
-		log.Fatal(err)
-		// TODO: Add return here.
+		return err
 	}
 	a.beaconState = bc
 
 	pd, err := NewProposalDuties(
 		a.eth1Address,
-		a.eth2Address,
+		a.beaconNodes,
 		a.fromAddrList,
-		a.PoolNames)
+		a.PoolNames,
+		a.offline)
 
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	a.proposalDuties = pd
 
+	go a.logKeyChanges(a.keyRegistry.Subscribe())
+	prometheus.RegisterNextProposals(a.lookahead.GetNextProposals)
+	prometheus.RegisterKeysAge(a.keyRegistry.LastUpdated)
+
 	for _, poolName := range a.PoolNames {
 		if poolName == "rocketpool" {
-			go pools.RocketPoolFetcher(a.eth1Address)
-			break
+			cache, err := a.getMinipoolCache()
+			if err != nil {
+				return err
+			}
+			a.fetchers.Add(1)
+			go func() {
+				defer a.fetchers.Done()
+				pools.RocketPoolFetcher(ctx, a.eth1Address, cache, a.keyRegistry)
+			}()
+			continue
+		}
+
+		if a.isLidoRegistry(poolName) {
+			a.fetchers.Add(1)
+			go func() {
+				defer a.fetchers.Done()
+				pools.LidoFetcher(ctx, a.eth1Address, a.keyRegistry)
+			}()
+			continue
 		}
 
 		// Check that the validator keys are correct
 		_, _, err := a.GetValidatorKeys(poolName)
 		if err != nil {
-			log.Fatal(err)
+			return err
 		}
 
 	}
-	go a.Loop()
+	go func() {
+		defer close(a.done)
+		err := a.Loop(ctx)
+		if err != nil {
+			log.Error("Metrics loop stopped: ", err)
+		}
+		a.status.stopped(err)
+	}()
+	return nil
+}
+
+// Closed once the loop stopped, after finishing the epoch in progress. Also
+// when the debug epoch was calculated, see Err
+func (a *Metrics) Done() <-chan struct{} {
+	return a.done
+}
+
+// Why the loop stopped, nil if it was stopped or finished ok
+func (a *Metrics) Err() error {
+	return a.status.err()
+}
+
+// Closes the connections, once the loop stopped. Waits for the key fetchers,
+// which stop with the context
+func (a *Metrics) Close() error {
+	a.fetchers.Wait()
+	if a.postgresql != nil {
+		return a.postgresql.Close()
+	}
+	return nil
 }
 
-func (a *Metrics) Loop() {
+// Processes the new epochs until the context is cancelled. Epochs in progress
+// are not interrupted. Only fails in offline mode, otherwise failed epochs
+// are retried
+func (a *Metrics) Loop(ctx context.Context) error {
 	var prevEpoch uint64 = uint64(0)
 	var prevBeaconState *spec.VersionedBeaconState = nil
-	// TODO: Refactor and hoist some stuff out to a function
+
+	// Only used if epochs are calculated once finalized
+	var prevFinalEpoch uint64 = uint64(0)
+	var prevFinalBeaconState *spec.VersionedBeaconState = nil
+
+	// Don't calculate metrics on an empty set of keys
+	for _, poolName := range a.PoolNames {
+		if poolName == "rocketpool" {
+			log.Info("Waiting for rocketpool keys to be available")
+		} else if a.isLidoRegistry(poolName) {
+			log.Info("Waiting for lido keys to be available")
+		} else {
+			continue
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-a.keyRegistry.Ready(poolName):
+		}
+	}
+
+	// Nothing to follow, just the debug epoch
+	if a.offline != nil {
+		return a.replayOffline()
+	}
+
+	events := NewChainEvents()
+	fallback := a.subscribeEvents(ctx, events)
+
+	// Wait for the next event unless the last attempt failed, backing off on
+	// consecutive failures
+	wait := fallback
+	failures := uint64(0)
+	// Last epoch at the head that failed, to queue it once
+	failedEpoch := uint64(0)
 	for {
+		select {
+		case <-ctx.Done():
+			log.Info("Stopping the metrics loop")
+			return nil
+		case <-events.Triggered():
+		case <-time.After(wait):
+		}
+		wait = backoff(failures, maxLoopBackoff)
+		failures++
+		a.status.iteration()
+
 		// Before doing anything, check if we are in the next epoch
-		headSlot, err := a.httpClient.NodeSyncing(context.Background())
+		headSlot, err := a.beaconNodes.NodeSyncing(ctx)
 		if err != nil {
 			log.Error("Could not get node sync status:", err)
-			time.Sleep(5 * time.Second)
 			continue
 		}
 
 		if headSlot.IsSyncing {
 			log.Error("Node is not in sync")
-			time.Sleep(5 * time.Second)
 			continue
 		}
 
-		currentEpoch := uint64(headSlot.HeadSlot)/uint64(config.SlotsInEpoch) - 2
+		// Final results are calculated once the epoch is finalized
+		if a.config.FinalityMode != config.HeadMode && a.epochDebug == "" {
+			err := a.processFinalized(ctx, events, &prevFinalEpoch, &prevFinalBeaconState, uint64(headSlot.HeadSlot))
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+			if a.config.FinalityMode == config.FinalizedMode {
+				a.retryFailedEpochs(ctx, prevFinalEpoch)
+				wait = fallback
+				failures = 0
+				continue
+			}
+			// Stopped between finalized epochs
+			if ctx.Err() != nil {
+				continue
+			}
+		}
+
+		// Provisional results at head-1 are corrected once finalized
+		provisional := a.config.FinalityMode == config.ProvisionalMode
+		var currentEpoch uint64
+		if provisional {
+			currentEpoch = uint64(headSlot.HeadSlot)/uint64(config.SlotsInEpoch) - 1
+		} else if a.epochDebug == "" {
+			// Stays at the same epoch while justification lags
+			currentEpoch, err = a.justifiedTarget(ctx)
+			if err != nil {
+				log.Error(err)
+				continue
+			}
+		}
 
 		// If a debug epoch is set, overwrite the slot. Will compute just metrics for that epoch
 		if a.epochDebug != "" {
-			epochDebugUint64, err := strconv.ParseUint(a.epochDebug, 10, 64)
-			if err != nil {
-				log.Fatal(err)
-			}
+			// Already validated
+			epochDebugUint64, _ := strconv.ParseUint(a.epochDebug, 10, 64)
 			log.Warn("Debugging mode, calculating metrics for epoch: ", a.epochDebug)
 			currentEpoch = epochDebugUint64
 		}
 
+		// Recompute the epochs that were processed with reorged blocks
+		for _, epoch := range events.ReorgedEpochs(prevEpoch) {
+			if ctx.Err() != nil {
+				break
+			}
+			// Already final
+			if provisional && epoch <= prevFinalEpoch {
+				continue
+			}
+			log.Warn("Recomputing epoch affected by a reorg: ", epoch)
+			// Only the latest epoch is exported
+			if _, _, err := a.ProcessEpoch(epoch, nil, 0, provisional, epoch == prevEpoch); err != nil {
+				log.Error("Could not recompute epoch: ", epoch, ": ", err)
+				if !provisional {
+					a.retries.Failed(epoch, err)
+				}
+			}
+			// The latest state may have changed too
+			if epoch == prevEpoch {
+				prevBeaconState = nil
+			}
+		}
+
+		// Stopped while recomputing
+		if ctx.Err() != nil {
+			continue
+		}
+
 		if prevEpoch >= currentEpoch {
 			// do nothing
-			time.Sleep(5 * time.Second)
+			a.retryFailedEpochs(ctx, prevEpoch)
+			wait = fallback
+			failures = 0
 			continue
 		}
 
-		// Fetch proposal duties, meaning who shall propose each block within this epoch
-		duties, err := a.proposalDuties.GetProposalDuties(currentEpoch)
-		if err != nil {
-			log.Error(err)
-			continue
+		// Lagging behind the head, provisional epochs are calculated once final anyway
+		if !provisional && prevEpoch != 0 && currentEpoch > prevEpoch+1 {
+			log.Warn("Skipping epochs from ", prevEpoch+1, " to ", currentEpoch-1, ", retried later")
+			prometheus.SkippedEpochs.Add(float64(currentEpoch - prevEpoch - 1))
+			for epoch := prevEpoch + 1; epoch < currentEpoch; epoch++ {
+				a.retries.Skipped(epoch)
+			}
 		}
 
-		// Fetch who actually proposed the blocks in this epoch
-		proposed, err := a.proposalDuties.GetProposedBlocks(currentEpoch)
+		currentBeaconState, results, err := a.ProcessEpoch(currentEpoch, prevBeaconState, uint64(headSlot.HeadSlot), provisional, true)
 		if err != nil {
+			prevBeaconState = nil
 			log.Error(err)
+			// Retried in the next iterations too, but the head may move on.
+			// Queued once, not on every iteration
+			if !provisional && a.epochDebug == "" && currentEpoch != failedEpoch {
+				a.retries.Failed(currentEpoch, err)
+				failedEpoch = currentEpoch
+			}
 			continue
 		}
+		a.retries.Done(currentEpoch)
 
-		// Summarize duties + proposed in a struct
-		proposalMetrics, err := a.proposalDuties.GetProposalMetrics(duties, proposed)
-		if err != nil {
-			log.Error(err)
+		// Alerts are only evaluated with final results
+		if a.alerts != nil && !provisional {
+			a.alerts.Run(results)
+		}
+
+		prevBeaconState = currentBeaconState
+		prevEpoch = currentEpoch
+		wait = fallback
+		failures = 0
+		a.status.processed(currentEpoch)
+
+		if a.epochDebug != "" {
+			log.Warn("Running in debug mode, exiting ok.")
+			return nil
+		}
+		a.retryFailedEpochs(ctx, currentEpoch)
+	}
+}
+
+// Calculates some of the failed epochs that are due, so the new ones are not
+// delayed too much. Only called once the latest epoch was processed, and only
+// the epochs before it. Alerts are not evaluated, they expect consecutive epochs
+func (a *Metrics) retryFailedEpochs(ctx context.Context, processed uint64) {
+	if processed == 0 {
+		return
+	}
+	due := a.retries.Due(time.Now(), processed)
+	if len(due) > maxRetriesInLoop {
+		due = due[:maxRetriesInLoop]
+	}
+	for _, epoch := range due {
+		if ctx.Err() != nil {
+			return
+		}
+		log.Info("Retrying failed epoch: ", epoch)
+		if _, _, err := a.ProcessEpoch(epoch, nil, 0, false, false); err != nil {
+			a.retries.Failed(epoch, err)
 			continue
 		}
+		a.retries.Done(epoch)
+	}
+}
 
-		currentBeaconState, err := a.beaconState.GetBeaconState(currentEpoch)
+// Calculates the debug epoch from the saved files and exits. Deterministic, the
+// same files always give the same results
+func (a *Metrics) replayOffline() error {
+	epoch, err := strconv.ParseUint(a.epochDebug, 10, 64)
+	if err != nil {
+		return errors.Wrap(err, "invalid debug epoch")
+	}
+	log.Warn("Offline mode, calculating metrics for epoch: ", epoch)
+	if _, _, err := a.ProcessEpoch(epoch, nil, 0, false, true); err != nil {
+		return errors.Wrap(err, fmt.Sprintf("could not calculate epoch %d", epoch))
+	}
+	log.Warn("Running in offline mode, exiting ok.")
+	return nil
+}
+
+// Epoch to calculate in head mode, the one before the justified checkpoint so
+// that its attestations are in justified blocks. Usually head-2, but it doesn't
+// move on while justification lags
+func (a *Metrics) justifiedTarget(ctx context.Context) (uint64, error) {
+	finality, err := a.beaconNodes.Finality(ctx, "head")
+	if err != nil {
+		return 0, errors.Wrap(err, "could not get finality checkpoints")
+	}
+	justified := uint64(finality.Justified.Epoch)
+	if justified == 0 {
+		return 0, errors.New("no justified checkpoint yet")
+	}
+	return justified - 1, nil
+}
+
+// Calculates the final results of the epochs finalized since the last call. An
+// epoch is final once all its slots are before the finalized checkpoint. Only
+// the last one is calculated on the first call
+func (a *Metrics) processFinalized(
+	ctx context.Context,
+	events *ChainEvents,
+	prevFinalEpoch *uint64,
+	prevFinalBeaconState **spec.VersionedBeaconState,
+	headSlot uint64) error {
+
+	finalized := events.FinalizedEpoch()
+	if finalized == 0 {
+		finality, err := a.beaconNodes.Finality(ctx, "head")
 		if err != nil {
+			return errors.Wrap(err, "could not get finality checkpoints")
+		}
+		finalized = uint64(finality.Finalized.Epoch)
+	}
+	if finalized == 0 {
+		return nil
+	}
+	lastFinal := finalized - 1
+
+	from := *prevFinalEpoch + 1
+	if *prevFinalEpoch == 0 {
+		from = lastFinal
+	}
+
+	for epoch := from; epoch <= lastFinal && ctx.Err() == nil; epoch++ {
+		// The lookahead is only calculated here if there is no provisional pass
+		lookaheadSlot := uint64(0)
+		if a.config.FinalityMode == config.FinalizedMode && epoch == lastFinal {
+			lookaheadSlot = headSlot
+		}
+
+		prevBeaconState := *prevFinalBeaconState
+		if epoch != *prevFinalEpoch+1 {
 			prevBeaconState = nil
-			log.Error("Error fetching beacon state:", err)
-			continue
 		}
+		beaconState, results, err := a.ProcessEpoch(epoch, prevBeaconState, lookaheadSlot, false, true)
+		if err != nil {
+			// Moves on, so a failing epoch doesn't block the next ones
+			*prevFinalBeaconState = nil
+			*prevFinalEpoch = epoch
+			a.retries.Failed(epoch, err)
+			return errors.Wrap(err, fmt.Sprintf("could not calculate finalized epoch %d", epoch))
+		}
+		if a.alerts != nil {
+			a.alerts.Run(results)
+		}
+		*prevFinalEpoch = epoch
+		a.status.processed(epoch)
 
-		// if no prev beacon state is known, fetch it
-		if prevBeaconState == nil {
-			prevBeaconState, err = a.beaconState.GetBeaconState(currentEpoch - 1)
-			if err != nil {
-				log.Error(err)
-				continue
-			}
+		// Kept for the next finalized epoch, even if the provisional pass
+		// holds another one, to avoid downloading it again
+		*prevFinalBeaconState = beaconState
+	}
+	return nil
+}
+
+// Calculates the metrics of all pools in an epoch. The state of the previous
+// epoch is fetched if not known. Returns the state of the epoch, to be reused
+// as the previous one of the next epoch, and the results of each pool.
+// The lookahead from the head slot is skipped if zero, eg when recomputing.
+// Old epochs, eg retried ones, are not exported to prometheus
+func (a *Metrics) ProcessEpoch(
+	currentEpoch uint64,
+	prevBeaconState *spec.VersionedBeaconState,
+	headSlot uint64,
+	provisional bool,
+	export bool) (*spec.VersionedBeaconState, []alerts.PoolResult, error) {
+
+	defer observeStage("epoch", time.Now())
+
+	// Fetch proposal duties, meaning who shall propose each block within this epoch
+	dutiesStart := time.Now()
+	duties, err := a.proposalDuties.GetProposalDuties(currentEpoch)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Fetch who actually proposed the blocks in this epoch
+	proposed, err := a.proposalDuties.GetProposedBlocks(currentEpoch)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Summarize duties + proposed in a struct
+	proposalMetrics, err := a.proposalDuties.GetProposalMetrics(duties, proposed)
+	if err != nil {
+		return nil, nil, err
+	}
+	observeStage("duties", dutiesStart)
+
+	stateStart := time.Now()
+	currentBeaconState, err := a.beaconState.GetBeaconState(currentEpoch)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "error fetching beacon state")
+	}
+	observeStage("state_fetch", stateStart)
+
+	// if no prev beacon state is known, fetch it
+	if prevBeaconState == nil {
+		stateStart := time.Now()
+		prevBeaconState, err = a.beaconState.GetBeaconState(currentEpoch - 1)
+		if err != nil {
+			return nil, nil, errors.Wrap(err, "error fetching previous beacon state")
 		}
+		observeStage("state_fetch", stateStart)
+	}
 
-		// Map to quickly convert public keys to index
-		valKeyToIndex := PopulateKeysToIndexesMap(currentBeaconState)
+	// Only the validators added since the last state are indexed
+	valKeyToIndex := a.keyIndex.ForState(currentBeaconState)
 
-		// Iterate all pools and calculate metrics using the fetched data
-		for _, poolName := range a.PoolNames {
-			poolName, pubKeys, err := a.GetValidatorKeys(poolName)
-			if err != nil {
-				log.Error("TODO", err)
-				continue
-			}
+	// Shared by all pools, calculated once
+	epochData := &EpochData{
+		CurrentBeaconState:   currentBeaconState,
+		PrevBeaconState:      prevBeaconState,
+		ValKeyToIndex:        valKeyToIndex,
+		ProposalMetrics:      &proposalMetrics,
+		SyncCommitteeIndexes: GetIndexesFromKeys(BLSPubKeyToByte(GetCurrentSyncCommittee(currentBeaconState)), valKeyToIndex),
+		ExportPrometheus:     export && a.exportPrometheus(provisional),
+	}
+	Slashings(currentBeaconState)
+
+	// Get the keys of all pools, aggregating the children into its parents
+	poolNames, poolKeys := a.GetAllPoolKeys()
+
+	// Some pools are further split into sub pools, eg rocketpool node operators
+	jobs := make([]poolJob, 0, len(poolNames))
+	for _, poolName := range poolNames {
+		jobs = append(jobs, poolJob{
+			pool:   poolName,
+			parent: a.config.PoolParents[poolName],
+			keys:   poolKeys[poolName],
+		})
+		for _, subPool := range a.GetSubPools(poolName) {
+			jobs = append(jobs, poolJob{
+				pool:   subPool.Pool,
+				parent: subPool.Parent,
+				keys:   subPool.Keys,
+			})
+		}
+	}
+
+	// Calculate the metrics of all pools using the fetched data
+	results := a.runPools(jobs, epochData, provisional)
+	if !provisional {
+		a.streaks.Save()
+	}
+
+	// Compared against the metrics of all pools
+	if a.config.NetworkBenchmark {
+		a.RunBenchmark(
+			poolNames,
+			poolKeys,
+			epochData,
+			provisional)
+	}
+
+	if headSlot != 0 && a.epochDebug == "" {
+		a.RunLookahead(headSlot, poolNames, poolKeys, currentBeaconState, valKeyToIndex)
+	}
+	return currentBeaconState, results, nil
+}
+
+// Calculates, exports and stores the metrics of a single pool
+func (a *Metrics) RunPool(
+	poolName string,
+	parent string,
+	pubKeys [][]byte,
+	epochData *EpochData,
+	provisional bool) alerts.PoolResult {
+
+	defer observeStage("pool", time.Now())
+
+	validatorIndexes := epochData.ValKeyToIndex.GetPool(poolName, pubKeys)
+
+	// TODO Rename this
+	exportPrometheus := epochData.ExportPrometheus
+	performance, err := a.beaconState.Run(pubKeys, poolName, parent, epochData, exportPrometheus)
+	if err != nil {
+		log.Warn("Could not calculate metrics for pool: ", poolName, ": ", err)
+	}
+
+	proposals, err := a.proposalDuties.RunProposalMetrics(validatorIndexes, poolName, parent, epochData.ProposalMetrics, exportPrometheus)
+	if err != nil {
+		log.Warn("Could not calculate proposal metrics for pool: ", poolName, ": ", err)
+	}
+
+	if performance != nil {
+		performance.Provisional = provisional
+	}
+
+	// Benchmark pools are too big to track each validator. Streaks only
+	// follow the final results, as the alerts
+	offline := make([]uint64, 0)
+	if performance != nil && !IsBenchmarkPool(poolName) && !provisional {
+		a.streaks.Update(poolName, performance.Epoch, performance.IndexesMissedAtt)
+		a.streaks.setPrometheus(poolName, a.config.OfflineEpochs)
+		offline = a.streaks.GetOffline(poolName, a.config.OfflineEpochs)
+	}
+
+	if performance != nil && IsBenchmarkPool(poolName) {
+		performance.IndexesMissedAtt = nil
+		performance.IndexesLessBalance = nil
+	}
+
+	// The memory is only used without postgres, see Store
+	if a.postgresql != nil {
+		a.storePool(poolName, parent, performance, proposals)
+	} else {
+		a.storeMemory(poolName, performance, proposals)
+	}
+
+	if performance != nil {
+		a.RunRollingMetrics(poolName, performance.Epoch, performance.Time, exportPrometheus)
+	}
 
-			validatorIndexes := GetIndexesFromKeys(pubKeys, valKeyToIndex)
+	slashed, exited := GetNewSlashingsAndExits(validatorIndexes, epochData.CurrentBeaconState, epochData.PrevBeaconState)
+	return alerts.PoolResult{
+		Pool:        poolName,
+		Epoch:       GetSlot(epochData.CurrentBeaconState) / config.SlotsInEpoch,
+		Performance: performance,
+		Proposals:   proposals,
+		Slashed:     slashed,
+		Exited:      exited,
+		Offline:     offline,
+	}
+}
 
-			// TODO Rename this
-			a.beaconState.Run(pubKeys, poolName, currentBeaconState, prevBeaconState, valKeyToIndex)
+func (a *Metrics) storeMemory(
+	poolName string,
+	performance *schemas.ValidatorPerformanceMetrics,
+	proposals *schemas.ProposalDutiesMetrics) {
 
-			err = a.proposalDuties.RunProposalMetrics(validatorIndexes, poolName, &proposalMetrics)
-			_ = err
+	if performance != nil {
+		// There can be thousands of sub pools and its validators are already
+		// kept with its parent, so its indexes are not needed
+		memoryPerformance := *performance
+		if a.isSubPool(poolName) {
+			memoryPerformance.IndexesMissedAtt = nil
+			memoryPerformance.IndexesLessBalance = nil
 		}
+		a.memory.StoreValidatorPerformance(memoryPerformance)
+	}
+	if proposals != nil {
+		a.memory.StoreProposalDuties(poolName, *proposals)
+	}
+}
 
-		prevBeaconState = currentBeaconState
-		prevEpoch = currentEpoch
+func (a *Metrics) storePool(
+	poolName string,
+	parent string,
+	performance *schemas.ValidatorPerformanceMetrics,
+	proposals *schemas.ProposalDutiesMetrics) {
 
-		if a.epochDebug != "" {
-			log.Warn("Running in debug mode, exiting ok.")
-			os.Exit(0)
+	if parent != "" {
+		if err := a.postgresql.StorePoolParent(poolName, parent); err != nil {
+			log.Error("Could not store parent of pool: ", poolName, ": ", err)
+		}
+	}
+
+	if performance != nil {
+		if err := a.postgresql.StoreValidatorPerformance(*performance); err != nil {
+			log.Error("Could not store metrics of pool: ", poolName, ": ", err)
+		}
+		if err := a.postgresql.StoreValidatorEvents(*performance); err != nil {
+			log.Error("Could not store validator events of pool: ", poolName, ": ", err)
+		}
+	}
+
+	if proposals != nil {
+		err := a.postgresql.StoreProposalDuties(
+			proposals.Epoch,
+			poolName,
+			proposals.Time,
+			uint64(len(proposals.Scheduled)),
+			uint64(len(proposals.Proposed)))
+		if err != nil {
+			log.Error("Could not store proposal metrics of pool: ", poolName, ": ", err)
+		}
+		err = a.postgresql.StorePoolProposals(store.ToPoolProposals(poolName, *proposals))
+		if err != nil {
+			log.Error("Could not store proposals of pool: ", poolName, ": ", err)
+		}
+	}
+}
+
+// In provisional mode only one of the passes is exported, so the gauges don't
+// go back and forth between the provisional and final results of different
+// epochs. The provisional ones unless only the final ones are wanted
+func (a *Metrics) exportPrometheus(provisional bool) bool {
+	if a.config.FinalityMode != config.ProvisionalMode {
+		return true
+	}
+	return provisional != a.config.PrometheusFinalOnly
+}
+
+// Missed attestation streaks and upcoming duties are only kept in memory
+func (a *Metrics) GetTopStreaks(poolName string, limit int) []schemas.ValidatorStreak {
+	return a.streaks.GetTopStreaks(poolName, limit)
+}
+
+func (a *Metrics) GetLookahead(poolName string) (*schemas.PoolLookahead, bool) {
+	return a.lookahead.Get(poolName)
+}
+
+// Returns where the metrics are stored, to be queried by the api and to
+// calculate the rolling aggregates
+func (a *Metrics) Store() store.Store {
+	if a.postgresql != nil {
+		return a.postgresql
+	}
+	return a.memory
+}
+
+// Returns the names of all pools in order and its keys. Parent pools contain
+// the keys of all its children without duplicates. Parents that are not
+// configured as pools are appended at the end.
+func (a *Metrics) GetAllPoolKeys() ([]string, map[string][][]byte) {
+	poolNames := make([]string, 0)
+	poolKeys := make(map[string][][]byte, 0)
+	for _, poolName := range a.PoolNames {
+		poolName, pubKeys, err := a.GetValidatorKeys(poolName)
+		if err != nil {
+			log.Error("Could not get keys of pool: ", poolName, ": ", err)
+			continue
 		}
+		poolNames = append(poolNames, poolName)
+		poolKeys[poolName] = pubKeys
+	}
+
+	parentKeys := GetParentPoolKeys(poolKeys, a.config.PoolParents)
+	parentNames := make([]string, 0, len(parentKeys))
+	for parent := range parentKeys {
+		parentNames = append(parentNames, parent)
 	}
+	sort.Strings(parentNames)
+
+	for _, parent := range parentNames {
+		if _, configured := poolKeys[parent]; !configured {
+			poolNames = append(poolNames, parent)
+		}
+		poolKeys[parent] = parentKeys[parent]
+	}
+	return poolNames, poolKeys
 }
 
 // Get the validator keys from different sources:
 // - pool.txt: Opens the file and read the keys from it
 // - rocketpool: Special case, see pools
+// - lido: Special case if an execution endpoint is available, see pools
 // - poolname: Gets the keys from the address used for the deposit
+// Keys read from files or deposits are published in the registry, and the
+// latest snapshot of the registry is returned
 func (a *Metrics) GetValidatorKeys(poolName string) (string, [][]byte, error) {
 	var pubKeysDeposited [][]byte
 	var err error
@@ -272,7 +950,7 @@ func (a *Metrics) GetValidatorKeys(poolName string) (string, [][]byte, error) {
 		// Vanila file, one key per line
 		pubKeysDeposited, err = pools.ReadCustomValidatorsFile(poolName)
 		if err != nil {
-			log.Fatal(err)
+			return "", nil, err
 		}
 		// trim the file path and extension
 		poolName = filepath.Base(poolName)
@@ -281,15 +959,19 @@ func (a *Metrics) GetValidatorKeys(poolName string) (string, [][]byte, error) {
 		// ethsta.com format
 		pubKeysDeposited, err = pools.ReadEthstaValidatorsFile(poolName)
 		if err != nil {
-			log.Fatal(err)
+			return "", nil, err
 		}
 		// trim the file path and extension
 		poolName = filepath.Base(poolName)
 		poolName = strings.TrimSuffix(poolName, filepath.Ext(poolName))
 		// TODO: Remove, only allow keys from file
-	} else if poolName == "rocketpool" {
-		pubKeysDeposited = pools.RocketPoolKeys
-		// TODO: Remove, only allow keys from file
+	} else if poolName == "rocketpool" || a.isLidoRegistry(poolName) {
+		// Published by its own fetcher
+		snapshot, exists := a.keyRegistry.Snapshot(poolName)
+		if !exists {
+			return "", nil, errors.New("keys not available yet for pool: " + poolName)
+		}
+		return poolName, snapshot.Keys, nil
 	} else {
 		poolAddressList := pools.PoolsAddresses[poolName]
 		pubKeysDeposited, err = a.postgresql.GetKeysByFromAddresses(poolAddressList)
@@ -297,5 +979,87 @@ func (a *Metrics) GetValidatorKeys(poolName string) (string, [][]byte, error) {
 			return "", nil, err
 		}
 	}
-	return poolName, pubKeysDeposited, nil
+
+	a.keyRegistry.Publish(poolName, pubKeysDeposited)
+	snapshot, _ := a.keyRegistry.Snapshot(poolName)
+	return poolName, snapshot.Keys, nil
+}
+
+// Minipools are persisted in postgres if available, otherwise in a file if configured
+func (a *Metrics) getMinipoolCache() (pools.MinipoolCache, error) {
+	if a.postgresql != nil {
+		err := a.postgresql.CreateRocketPoolTable()
+		if err != nil {
+			return nil, errors.Wrap(err, "error creating rocketpool table")
+		}
+		return a.postgresql, nil
+	}
+	if a.config.RocketPoolCache != "" {
+		return pools.NewFileMinipoolCache(a.config.RocketPoolCache), nil
+	}
+	return nil, nil
+}
+
+// Get the latest snapshot of the sub pools of a given pool. Returns an
+// empty list if the pool has no sub pools or they are not enabled.
+func (a *Metrics) GetSubPools(poolName string) []*pools.KeySnapshot {
+	if (poolName == "rocketpool" && a.config.RocketPoolNodePools) ||
+		(a.isLidoRegistry(poolName) && a.config.LidoNodePools) {
+		return a.keyRegistry.SubPools(poolName)
+	}
+	return make([]*pools.KeySnapshot, 0)
+}
+
+// Sub pools are published by its parent, eg rocketpool node operators
+func (a *Metrics) isSubPool(poolName string) bool {
+	snapshot, exists := a.keyRegistry.Snapshot(poolName)
+	return exists && snapshot.Parent != ""
+}
+
+// Logs and counts the keys that are added or removed from each pool
+func (a *Metrics) logKeyChanges(changes <-chan pools.KeyChange) {
+	for change := range changes {
+		if change.Deleted {
+			a.deletePool(change.Pool, change.Parent)
+			log.WithFields(log.Fields{
+				"Pool":    change.Pool,
+				"Version": change.Version,
+			}).Debug("Pool removed:")
+			continue
+		}
+		prometheus.PoolKeysVersion.WithLabelValues(change.Pool).Set(float64(change.Version))
+		prometheus.PoolKeysAdded.WithLabelValues(change.Pool).Add(float64(len(change.Added)))
+		prometheus.PoolKeysRemoved.WithLabelValues(change.Pool).Add(float64(len(change.Removed)))
+
+		logger := log.WithFields(log.Fields{
+			"Pool":    change.Pool,
+			"Version": change.Version,
+			"Added":   len(change.Added),
+			"Removed": len(change.Removed),
+		})
+		// Avoid flooding the logs, there can be thousands of sub pools
+		if change.Parent != "" {
+			logger.Debug("Keys changed:")
+		} else {
+			logger.Info("Keys changed:")
+		}
+	}
+}
+
+// Stops exporting anything of a sub pool that was removed by its parent
+func (a *Metrics) deletePool(poolName string, parent string) {
+	windows := make([]string, 0, len(a.config.RollingWindows))
+	for _, window := range a.config.RollingWindows {
+		windows = append(windows, store.WindowLabel(window))
+	}
+	prometheus.DeletePool(poolName, parent, windows)
+	a.streaks.Remove(poolName)
+	a.lookahead.Remove(poolName)
+	a.keyIndex.Remove(poolName)
+}
+
+// Lido keys are read from its node operators registry if enabled, otherwise
+// they are detected by the addresses used for the deposit
+func (a *Metrics) isLidoRegistry(poolName string) bool {
+	return poolName == "lido" && a.config.LidoRegistry
 }
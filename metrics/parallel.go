@@ -0,0 +1,65 @@
+package metrics
+
+import (
+	"sync"
+
+	"github.com/attestantio/go-eth2-client/spec"
+
+	"github.com/alrevuelta/eth-pools-metrics/alerts"
+	"github.com/alrevuelta/eth-pools-metrics/schemas"
+)
+
+// Data of an epoch shared by all pools. Never modified once fetched, so the
+// pools can be calculated concurrently
+type EpochData struct {
+	CurrentBeaconState *spec.VersionedBeaconState
+	PrevBeaconState    *spec.VersionedBeaconState
+	ValKeyToIndex      *StateIndex
+	ProposalMetrics    *schemas.ProposalDutiesMetrics
+	// Indexes of the current sync committee, resolved once for all pools
+	SyncCommitteeIndexes []uint64
+	// False for old epochs, so the gauges stay at the latest one
+	ExportPrometheus bool
+}
+
+type poolJob struct {
+	pool   string
+	parent string
+	keys   [][]byte
+}
+
+// Calculates the pools with a bounded number of workers. The results are in
+// the same order as the jobs
+func (a *Metrics) runPools(jobs []poolJob, epochData *EpochData, provisional bool) []alerts.PoolResult {
+	workers := a.config.PoolWorkers
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > len(jobs) {
+		workers = len(jobs)
+	}
+
+	results := make([]alerts.PoolResult, len(jobs))
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for job := range next {
+				results[job] = a.RunPool(
+					jobs[job].pool,
+					jobs[job].parent,
+					jobs[job].keys,
+					epochData,
+					provisional)
+			}
+		}()
+	}
+	for job := range jobs {
+		next <- job
+	}
+	close(next)
+	wg.Wait()
+	return results
+}
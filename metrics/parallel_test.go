@@ -0,0 +1,81 @@
+package metrics
+
+import (
+	"testing"
+
+	"github.com/attestantio/go-eth2-client/spec"
+	"github.com/attestantio/go-eth2-client/spec/altair"
+	"github.com/attestantio/go-eth2-client/spec/phase0"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alrevuelta/eth-pools-metrics/config"
+	"github.com/alrevuelta/eth-pools-metrics/pools"
+	"github.com/alrevuelta/eth-pools-metrics/schemas"
+	"github.com/alrevuelta/eth-pools-metrics/store"
+)
+
+func testEpochState(slot uint64, keys []phase0.BLSPubKey, balance phase0.Gwei) *spec.VersionedBeaconState {
+	validators := make([]*phase0.Validator, 0)
+	balances := make([]phase0.Gwei, 0)
+	participation := make([]altair.ParticipationFlags, 0)
+	for i, key := range keys {
+		validators = append(validators, &phase0.Validator{
+			PublicKey:        key,
+			EffectiveBalance: 32000000000,
+			ExitEpoch:        farFutureEpoch,
+		})
+		balances = append(balances, balance)
+		// Odd validators miss the head vote
+		participation = append(participation, altair.ParticipationFlags(7-4*(i%2)))
+	}
+	return &spec.VersionedBeaconState{
+		Altair: &altair.BeaconState{
+			Slot:                       phase0.Slot(slot),
+			Validators:                 validators,
+			Balances:                   balances,
+			PreviousEpochParticipation: participation,
+		},
+	}
+}
+
+func Test_RunPools(t *testing.T) {
+	keys := []phase0.BLSPubKey{validator_0, validator_1, validator_2, validator_3}
+	currentState := testEpochState(34*32, keys, 32000100000)
+	prevState := testEpochState(33*32, keys, 32000000000)
+
+	streaks, err := NewStreakTracker(nil)
+	require.NoError(t, err)
+	a := &Metrics{
+		config:         &config.Config{PoolWorkers: 2},
+		beaconState:    &BeaconState{},
+		proposalDuties: &ProposalDuties{},
+		memory:         store.NewMemory(10),
+		streaks:        streaks,
+		keyIndex:       NewKeyIndex(),
+		keyRegistry:    pools.NewKeyRegistry(),
+	}
+	epochData := &EpochData{
+		CurrentBeaconState: currentState,
+		PrevBeaconState:    prevState,
+		ValKeyToIndex:      a.keyIndex.ForState(currentState),
+		ProposalMetrics:    &schemas.ProposalDutiesMetrics{},
+	}
+
+	jobs := []poolJob{
+		{pool: "pool1", keys: [][]byte{validator_0[:]}},
+		{pool: "pool2", keys: [][]byte{validator_1[:], validator_2[:]}},
+		{pool: "pool3", keys: [][]byte{validator_3[:]}},
+		{pool: "pool4", keys: [][]byte{validator_0[:], validator_1[:], validator_2[:], validator_3[:]}},
+		{pool: "pool5", keys: [][]byte{validator_2[:]}},
+	}
+	results := a.runPools(jobs, epochData, false)
+
+	require.Equal(t, len(jobs), len(results))
+	for i, job := range jobs {
+		require.Equal(t, job.pool, results[i].Pool)
+		require.Equal(t, uint64(34), results[i].Epoch)
+		require.Equal(t, uint64(len(job.keys)), results[i].Performance.NOfValidatingKeys)
+	}
+	require.Equal(t, uint64(1), results[1].Performance.NOfIncorrectHead)
+	require.Equal(t, uint64(2), results[3].Performance.NOfIncorrectHead)
+}
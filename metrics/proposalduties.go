@@ -4,57 +4,48 @@ import (
 	"context"
 	"strconv"
 	"strings"
-	"time"
 
+	"github.com/alrevuelta/eth-pools-metrics/beacon"
 	"github.com/alrevuelta/eth-pools-metrics/prometheus"
     "github.com/alrevuelta/eth-pools-metrics/config"
 	"github.com/alrevuelta/eth-pools-metrics/schemas"
 	api "github.com/attestantio/go-eth2-client/api/v1"
-	"github.com/attestantio/go-eth2-client/http"
 	"github.com/attestantio/go-eth2-client/spec/phase0"
 	"github.com/pkg/errors"
-	"github.com/rs/zerolog"
 	log "github.com/sirupsen/logrus"
 )
 
 type ProposalDuties struct {
-	httpClient    *http.Service
+	beaconNodes   *beacon.Pool
 	eth1Endpoint  string
-	eth2Endpoint  string
 	fromAddresses []string
 	poolNames     []string
+	// Reads the duties and blocks from disk instead, nil if not offline
+	offline *beacon.Cache
 }
 
 func NewProposalDuties(
 	eth1Endpoint string,
-	eth2Endpoint string,
+	beaconNodes *beacon.Pool,
 	fromAddresses []string,
-	poolNames []string) (*ProposalDuties, error) {
-
-	client, err := http.New(context.Background(),
-		http.WithTimeout(60*time.Second),
-		http.WithAddress(eth2Endpoint),
-		http.WithLogLevel(zerolog.WarnLevel),
-	)
-	if err != nil {
-		return nil, err
-	}
-
-	httpClient := client.(*http.Service)
+	poolNames []string,
+	offline *beacon.Cache) (*ProposalDuties, error) {
 
 	return &ProposalDuties{
-		httpClient:    httpClient,
-		eth2Endpoint:  eth2Endpoint,
+		beaconNodes:   beaconNodes,
 		fromAddresses: fromAddresses,
 		poolNames:     poolNames,
 		eth1Endpoint:  eth1Endpoint,
+		offline:       offline,
 	}, nil
 }
 
 func (p *ProposalDuties) RunProposalMetrics(
 	activeKeys []uint64,
 	poolName string,
-	metrics *schemas.ProposalDutiesMetrics) error {
+	parent string,
+	metrics *schemas.ProposalDutiesMetrics,
+	exportPrometheus bool) (*schemas.ProposalDutiesMetrics, error) {
 
 	poolProposals := getPoolProposalDuties(
 		metrics,
@@ -62,18 +53,28 @@ func (p *ProposalDuties) RunProposalMetrics(
 		activeKeys)
 
 	logProposalDuties(poolProposals, poolName)
-	setPrometheusProposalDuties(poolProposals, poolName)
-	return nil
+	if exportPrometheus {
+		setPrometheusProposalDuties(poolProposals, poolName, parent)
+	}
+	return poolProposals, nil
 
 }
 
 func (p *ProposalDuties) GetProposalDuties(epoch uint64) ([]*api.ProposerDuty, error) {
 	log.Info("Fetching proposal duties for epoch: ", epoch)
 
+	if p.offline != nil {
+		duties, err := p.offline.LoadDuties(epoch)
+		if err != nil {
+			return make([]*api.ProposerDuty, 0), errors.Wrap(err, "could not load saved proposal duties")
+		}
+		return duties, nil
+	}
+
 	// Empty indexes to force fetching all duties
 	indexes := make([]phase0.ValidatorIndex, 0)
 
-	duties, err := p.httpClient.ProposerDuties(
+	duties, err := p.beaconNodes.ProposerDuties(
 		context.Background(),
 		phase0.Epoch(epoch),
 		indexes)
@@ -96,7 +97,7 @@ func (p *ProposalDuties) GetProposedBlocks(epoch uint64) ([]*api.BeaconBlockHead
 		slotStr := strconv.FormatUint(slot, 10)
 		log.Debug("Fetching block for slot:" + slotStr)
 
-		blockHeader, err := p.httpClient.BeaconBlockHeader(context.Background(), slotStr)
+		blockHeader, err := p.getBlockHeader(slot)
 		if err != nil {
 			// This error is expected in skipped or orphaned blocks
 			if !strings.Contains(err.Error(), "Could not find requested block") {
@@ -111,6 +112,17 @@ func (p *ProposalDuties) GetProposedBlocks(epoch uint64) ([]*api.BeaconBlockHead
 	return epochBlockHeaders, nil
 }
 
+func (p *ProposalDuties) getBlockHeader(slot uint64) (*api.BeaconBlockHeader, error) {
+	if p.offline != nil {
+		blockHeader, err := p.offline.LoadBlockHeader(slot)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not load saved block header")
+		}
+		return blockHeader, nil
+	}
+	return p.beaconNodes.BeaconBlockHeader(context.Background(), strconv.FormatUint(slot, 10))
+}
+
 func (p *ProposalDuties) GetProposalMetrics(
 	proposalDuties []*api.ProposerDuty,
 	proposedBlocks []*api.BeaconBlockHeader) (schemas.ProposalDutiesMetrics, error) {
@@ -137,6 +149,7 @@ func (p *ProposalDuties) GetProposalMetrics(
 	}*/
 
 	proposalMetrics.Epoch = uint64(proposalDuties[0].Slot) / config.SlotsInEpoch
+	proposalMetrics.Time = config.EpochTime(proposalMetrics.Epoch)
 
 	for _, duty := range proposalDuties {
 		proposalMetrics.Scheduled = append(
@@ -193,6 +206,7 @@ func getPoolProposalDuties(
 
 	poolDuties := schemas.ProposalDutiesMetrics{
 		Epoch:     metrics.Epoch,
+		Time:      metrics.Time,
 		Scheduled: make([]schemas.Duty, 0),
 		Proposed:  make([]schemas.Duty, 0),
 		Missed:    make([]schemas.Duty, 0),
@@ -221,6 +235,18 @@ func logProposalDuties(
 	poolDuties *schemas.ProposalDutiesMetrics,
 	poolName string) {
 
+	// Benchmark pools have most of the network, only counts are logged
+	if IsBenchmarkPool(poolName) {
+		log.WithFields(log.Fields{
+			"PoolName":       poolName,
+			"Epoch":          poolDuties.Epoch,
+			"TotalScheduled": len(poolDuties.Scheduled),
+			"TotalProposed":  len(poolDuties.Proposed),
+			"TotalMissed":    len(poolDuties.Missed),
+		}).Info("Proposal Duties")
+		return
+	}
+
 	for _, d := range poolDuties.Scheduled {
 		log.WithFields(log.Fields{
 			"PoolName":       poolName,
@@ -255,13 +281,14 @@ func logProposalDuties(
 
 func setPrometheusProposalDuties(
 	metrics *schemas.ProposalDutiesMetrics,
-	poolName string) {
+	poolName string,
+	parent string) {
 
 	prometheus.NOfProposedBlocks.WithLabelValues(
-		poolName).Set(float64(len(metrics.Proposed)))
+		poolName, parent).Set(float64(len(metrics.Proposed)))
 
 	prometheus.NOfMissedBlocks.WithLabelValues(
-		poolName).Set(float64(len(metrics.Missed)))
+		poolName, parent).Set(float64(len(metrics.Missed)))
 
 	for _, d := range metrics.Proposed {
 		_ = d
@@ -0,0 +1,194 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/alrevuelta/eth-pools-metrics/prometheus"
+	"github.com/alrevuelta/eth-pools-metrics/schemas"
+)
+
+// Wait after the first failure of the loop or an epoch, doubled on each
+// consecutive one
+const (
+	minBackoff       = 5 * time.Second
+	maxLoopBackoff   = 5 * time.Minute
+	maxRetryBackoff  = 1 * time.Hour
+	maxRetriesInLoop = 4
+)
+
+// Persistent storage of the failed epochs, so they are retried after a restart
+type FailedEpochStore interface {
+	LoadFailedEpochs() ([]schemas.FailedEpoch, error)
+	StoreFailedEpochs(epochs []schemas.FailedEpoch) error
+}
+
+// Epochs that failed or were skipped, retried with exponential backoff until
+// they succeed or run out of retries
+type RetryQueue struct {
+	mutex      sync.Mutex
+	epochs     map[uint64]*schemas.FailedEpoch
+	store      FailedEpochStore
+	maxRetries uint64
+}
+
+// Store is optional, nil if no persistence is wanted
+func NewRetryQueue(store FailedEpochStore, maxRetries uint64) (*RetryQueue, error) {
+	queue := &RetryQueue{
+		epochs:     make(map[uint64]*schemas.FailedEpoch, 0),
+		store:      store,
+		maxRetries: maxRetries,
+	}
+	if store == nil {
+		return queue, nil
+	}
+	epochs, err := store.LoadFailedEpochs()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not load failed epochs")
+	}
+	for i := range epochs {
+		queue.epochs[epochs[i].Epoch] = &epochs[i]
+	}
+	if len(epochs) != 0 {
+		log.Info("Loaded ", len(epochs), " failed epochs to retry")
+	}
+	prometheus.QueuedEpochs.Set(float64(len(queue.epochs)))
+	return queue, nil
+}
+
+// Doubles the wait on each failure
+func backoff(failures uint64, max time.Duration) time.Duration {
+	wait := minBackoff
+	for i := uint64(0); i < failures && wait < max; i++ {
+		wait *= 2
+	}
+	if wait > max {
+		return max
+	}
+	return wait
+}
+
+// Queues an epoch that failed. Once out of retries it is given up on
+func (q *RetryQueue) Failed(epoch uint64, err error) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	failed, exists := q.epochs[epoch]
+	if !exists {
+		failed = &schemas.FailedEpoch{Epoch: epoch}
+		q.epochs[epoch] = failed
+	}
+	failed.Attempts++
+	failed.LastError = err.Error()
+
+	if failed.Attempts > q.maxRetries {
+		log.Error("Giving up on epoch ", epoch, " after ", failed.Attempts, " attempts: ", err)
+		prometheus.FailedEpochs.Inc()
+		delete(q.epochs, epoch)
+	} else {
+		failed.NextRetry = time.Now().Add(backoff(failed.Attempts-1, maxRetryBackoff))
+		log.Warn("Epoch ", epoch, " failed, retrying at ", failed.NextRetry.Format(time.RFC3339), ": ", err)
+	}
+	q.persist()
+}
+
+// Queues an epoch that was never attempted, retried right away
+func (q *RetryQueue) Skipped(epoch uint64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if _, exists := q.epochs[epoch]; exists {
+		return
+	}
+	q.epochs[epoch] = &schemas.FailedEpoch{Epoch: epoch, LastError: "skipped"}
+	q.persist()
+}
+
+// Removes an epoch once calculated
+func (q *RetryQueue) Done(epoch uint64) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if _, exists := q.epochs[epoch]; !exists {
+		return
+	}
+	delete(q.epochs, epoch)
+	q.persist()
+}
+
+// Epochs up to the given one to retry now, oldest first
+func (q *RetryQueue) Due(now time.Time, upTo uint64) []uint64 {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	due := make([]uint64, 0)
+	for epoch, failed := range q.epochs {
+		if epoch <= upTo && !now.Before(failed.NextRetry) {
+			due = append(due, epoch)
+		}
+	}
+	sort.Slice(due, func(i, j int) bool { return due[i] < due[j] })
+	return due
+}
+
+// Must be called with the lock held. Failing to persist is not critical, the
+// epochs are still retried until a restart
+func (q *RetryQueue) persist() {
+	prometheus.QueuedEpochs.Set(float64(len(q.epochs)))
+	if q.store == nil {
+		return
+	}
+	epochs := make([]schemas.FailedEpoch, 0, len(q.epochs))
+	for _, failed := range q.epochs {
+		epochs = append(epochs, *failed)
+	}
+	sort.Slice(epochs, func(i, j int) bool { return epochs[i].Epoch < epochs[j].Epoch })
+	if err := q.store.StoreFailedEpochs(epochs); err != nil {
+		log.Error("Could not store failed epochs: ", err)
+	}
+}
+
+type FileFailedEpochStore struct {
+	path string
+}
+
+func NewFileFailedEpochStore(path string) *FileFailedEpochStore {
+	return &FileFailedEpochStore{
+		path: path,
+	}
+}
+
+func (s *FileFailedEpochStore) LoadFailedEpochs() ([]schemas.FailedEpoch, error) {
+	epochs := make([]schemas.FailedEpoch, 0)
+	content, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return epochs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &epochs); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("could not decode failed epochs: %s", s.path))
+	}
+	return epochs, nil
+}
+
+func (s *FileFailedEpochStore) StoreFailedEpochs(epochs []schemas.FailedEpoch) error {
+	content, err := json.Marshal(epochs)
+	if err != nil {
+		return err
+	}
+	// Write to a temporal file first so that a crash does not leave a corrupted file
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
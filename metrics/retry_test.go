@@ -0,0 +1,52 @@
+package metrics
+
+import (
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_Backoff(t *testing.T) {
+	require.Equal(t, 5*time.Second, backoff(0, time.Minute))
+	require.Equal(t, 10*time.Second, backoff(1, time.Minute))
+	require.Equal(t, 40*time.Second, backoff(3, time.Minute))
+	require.Equal(t, time.Minute, backoff(4, time.Minute))
+	require.Equal(t, time.Minute, backoff(1000, time.Minute))
+}
+
+func Test_RetryQueue(t *testing.T) {
+	store := NewFileFailedEpochStore(filepath.Join(t.TempDir(), "failed.json"))
+	queue, err := NewRetryQueue(store, 2)
+	require.NoError(t, err)
+
+	queue.Skipped(100)
+	queue.Failed(101, errors.New("state not found"))
+	now := time.Now()
+
+	// The failed one waits
+	require.Equal(t, []uint64{100}, queue.Due(now, 1000))
+	require.Equal(t, []uint64{100, 101}, queue.Due(now.Add(minBackoff), 1000))
+	// Not before the latest processed epoch
+	require.Equal(t, []uint64{100}, queue.Due(now.Add(minBackoff), 100))
+
+	// Still there after a restart
+	queue, err = NewRetryQueue(store, 2)
+	require.NoError(t, err)
+	require.Equal(t, []uint64{100, 101}, queue.Due(now.Add(minBackoff), 1000))
+
+	queue.Done(100)
+	queue.Failed(101, errors.New("state not found"))
+	require.Equal(t, 0, len(queue.Due(now.Add(minBackoff), 1000)))
+	require.Equal(t, []uint64{101}, queue.Due(now.Add(3*minBackoff), 1000))
+
+	// Out of retries
+	queue.Failed(101, errors.New("state not found"))
+	require.Equal(t, 0, len(queue.Due(now.Add(maxRetryBackoff), 1000)))
+
+	epochs, err := store.LoadFailedEpochs()
+	require.NoError(t, err)
+	require.Equal(t, 0, len(epochs))
+}
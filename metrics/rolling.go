@@ -0,0 +1,50 @@
+package metrics
+
+import (
+	"time"
+
+	"github.com/alrevuelta/eth-pools-metrics/prometheus"
+	"github.com/alrevuelta/eth-pools-metrics/schemas"
+	log "github.com/sirupsen/logrus"
+)
+
+// Calculates the metrics of a pool over each rolling window ending at the
+// epoch, using the epochs stored in postgres or kept in memory. Windows longer
+// than the kept epochs are only partial
+func (a *Metrics) RunRollingMetrics(poolName string, epoch uint64, epochTime time.Time, exportPrometheus bool) {
+	aggregates, err := a.Store().GetPoolAggregates(poolName, a.config.RollingWindows, epochTime)
+	if err != nil {
+		log.Warn("Could not get rolling aggregates of pool: ", poolName, ": ", err)
+		return
+	}
+
+	if exportPrometheus {
+		setPrometheusRollingMetrics(aggregates, poolName)
+	}
+
+	if a.postgresql != nil {
+		err := a.postgresql.StoreRollingMetrics(epoch, epochTime, aggregates)
+		if err != nil {
+			log.Error("Could not store rolling metrics of pool: ", poolName, ": ", err)
+		}
+	}
+}
+
+func setPrometheusRollingMetrics(aggregates []schemas.PoolAggregate, poolName string) {
+	for _, aggregate := range aggregates {
+		prometheus.RollingParticipationRate.WithLabelValues(
+			poolName, aggregate.Window).Set(aggregate.ParticipationRate)
+		prometheus.RollingRewards.WithLabelValues(
+			poolName, aggregate.Window).Set(float64(aggregate.Rewards))
+		prometheus.RollingConsensusApr.WithLabelValues(
+			poolName, aggregate.Window).Set(aggregate.ConsensusApr)
+		prometheus.RollingAttestationEffectiveness.WithLabelValues(
+			poolName, aggregate.Window).Set(aggregate.AttestationEffectiveness)
+
+		// Not meaningful if there were no proposals in the window
+		if aggregate.NOfScheduledBlocks != 0 {
+			prometheus.RollingProposalSuccessRate.WithLabelValues(
+				poolName, aggregate.Window).Set(aggregate.ProposalSuccessRate)
+		}
+	}
+}
@@ -0,0 +1,296 @@
+package metrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/alrevuelta/eth-pools-metrics/prometheus"
+	"github.com/alrevuelta/eth-pools-metrics/schemas"
+)
+
+// Upper bounds of the streak histogram buckets, in epochs
+var streakBuckets = []uint64{1, 2, 4, 8, 16, 32, 64, 128, 256}
+
+// Validators with the longest streaks exported to prometheus per pool
+const topStreaksExported = 10
+
+type poolStreaks struct {
+	lastEpoch uint64
+	// Only validators that missed the attestation in the last epoch
+	streaks map[uint64]*schemas.ValidatorStreak
+	// Validator indexes exported to prometheus, to remove them when they recover
+	exported []uint64
+}
+
+// Persistent storage of the streaks, so they continue after a restart
+type StreakStore interface {
+	LoadStreaks() ([]schemas.ValidatorStreak, error)
+	StoreStreaks(streaks []schemas.ValidatorStreak) error
+}
+
+// Tracks how many consecutive epochs each validator has been missing its attestations
+type StreakTracker struct {
+	mutex sync.RWMutex
+	pools map[string]*poolStreaks
+	store StreakStore
+}
+
+// Store is optional, nil if no persistence is wanted
+func NewStreakTracker(store StreakStore) (*StreakTracker, error) {
+	tracker := &StreakTracker{
+		pools: make(map[string]*poolStreaks, 0),
+		store: store,
+	}
+	if store == nil {
+		return tracker, nil
+	}
+	streaks, err := store.LoadStreaks()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not load streaks")
+	}
+	for i := range streaks {
+		streak := &streaks[i]
+		pool, exists := tracker.pools[streak.Pool]
+		if !exists {
+			pool = &poolStreaks{
+				streaks: make(map[uint64]*schemas.ValidatorStreak, 0),
+			}
+			tracker.pools[streak.Pool] = pool
+		}
+		pool.streaks[streak.ValIndex] = streak
+		if streak.LastEpoch > pool.lastEpoch {
+			pool.lastEpoch = streak.LastEpoch
+		}
+	}
+	if len(streaks) != 0 {
+		log.Info("Loaded ", len(streaks), " missed attestation streaks")
+	}
+	return tracker, nil
+}
+
+// Updates the streaks of a pool with the validators that missed the attestation
+// in an epoch. Skipped epochs are unknown, so streaks continue over them
+func (s *StreakTracker) Update(poolName string, epoch uint64, indexesMissedAtt []uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	pool, exists := s.pools[poolName]
+	if !exists {
+		pool = &poolStreaks{
+			streaks: make(map[uint64]*schemas.ValidatorStreak, 0),
+		}
+		s.pools[poolName] = pool
+	}
+
+	// Already processed, or an older epoch recomputed after a reorg
+	if exists && epoch <= pool.lastEpoch {
+		return
+	}
+
+	streaks := make(map[uint64]*schemas.ValidatorStreak, len(indexesMissedAtt))
+	for _, valIndex := range indexesMissedAtt {
+		if prev, found := pool.streaks[valIndex]; found {
+			streaks[valIndex] = &schemas.ValidatorStreak{
+				Pool:      poolName,
+				ValIndex:  valIndex,
+				Epochs:    prev.Epochs + 1,
+				Since:     prev.Since,
+				LastEpoch: epoch,
+			}
+			continue
+		}
+		streaks[valIndex] = &schemas.ValidatorStreak{
+			Pool:      poolName,
+			ValIndex:  valIndex,
+			Epochs:    1,
+			Since:     epoch,
+			LastEpoch: epoch,
+		}
+	}
+	pool.streaks = streaks
+	pool.lastEpoch = epoch
+}
+
+// Returns the validators with the longest streaks, longest first
+func (s *StreakTracker) GetTopStreaks(poolName string, limit int) []schemas.ValidatorStreak {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	top := make([]schemas.ValidatorStreak, 0)
+	pool, exists := s.pools[poolName]
+	if !exists {
+		return top
+	}
+	for _, streak := range pool.streaks {
+		top = append(top, *streak)
+	}
+	sort.Slice(top, func(i, j int) bool {
+		if top[i].Epochs != top[j].Epochs {
+			return top[i].Epochs > top[j].Epochs
+		}
+		return top[i].ValIndex < top[j].ValIndex
+	})
+	if limit > 0 && len(top) > limit {
+		top = top[:limit]
+	}
+	return top
+}
+
+// Returns the validators that have been missing its attestations for at least n epochs
+func (s *StreakTracker) GetOffline(poolName string, minEpochs uint64) []uint64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	offline := make([]uint64, 0)
+	pool, exists := s.pools[poolName]
+	if !exists {
+		return offline
+	}
+	for valIndex, streak := range pool.streaks {
+		if streak.Epochs >= minEpochs {
+			offline = append(offline, valIndex)
+		}
+	}
+	sort.Slice(offline, func(i, j int) bool { return offline[i] < offline[j] })
+	return offline
+}
+
+// Returns the number of validators with a streak lower or equal than each
+// bucket. The last element is the total, the +Inf bucket
+func (s *StreakTracker) GetHistogram(poolName string) []uint64 {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	histogram := make([]uint64, len(streakBuckets)+1)
+	pool, exists := s.pools[poolName]
+	if !exists {
+		return histogram
+	}
+	for _, streak := range pool.streaks {
+		for i, bucket := range streakBuckets {
+			if streak.Epochs <= bucket {
+				histogram[i]++
+			}
+		}
+		histogram[len(streakBuckets)]++
+	}
+	return histogram
+}
+
+func (s *StreakTracker) setPrometheus(poolName string, offlineEpochs uint64) {
+	histogram := s.GetHistogram(poolName)
+	for i, bucket := range streakBuckets {
+		prometheus.MissedAttestationStreaks.WithLabelValues(
+			poolName, UToStr(bucket)).Set(float64(histogram[i]))
+	}
+	prometheus.MissedAttestationStreaks.WithLabelValues(
+		poolName, "+Inf").Set(float64(histogram[len(streakBuckets)]))
+
+	prometheus.OfflineValidators.WithLabelValues(
+		poolName).Set(float64(len(s.GetOffline(poolName, offlineEpochs))))
+
+	top := s.GetTopStreaks(poolName, topStreaksExported)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	pool := s.pools[poolName]
+	if pool == nil {
+		return
+	}
+	for _, valIndex := range pool.exported {
+		prometheus.MissedAttestationStreak.DeleteLabelValues(poolName, UToStr(valIndex))
+	}
+	pool.exported = make([]uint64, 0, len(top))
+	for _, streak := range top {
+		prometheus.MissedAttestationStreak.WithLabelValues(
+			poolName, UToStr(streak.ValIndex)).Set(float64(streak.Epochs))
+		pool.exported = append(pool.exported, streak.ValIndex)
+	}
+}
+
+// Forgets the streaks of a pool that doesn't exist anymore and deletes its series
+func (s *StreakTracker) Remove(poolName string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	pool, exists := s.pools[poolName]
+	if !exists {
+		return
+	}
+	for _, valIndex := range pool.exported {
+		prometheus.MissedAttestationStreak.DeleteLabelValues(poolName, UToStr(valIndex))
+	}
+	for _, bucket := range streakBuckets {
+		prometheus.MissedAttestationStreaks.DeleteLabelValues(poolName, UToStr(bucket))
+	}
+	prometheus.MissedAttestationStreaks.DeleteLabelValues(poolName, "+Inf")
+	delete(s.pools, poolName)
+}
+
+// Persists the streaks of all pools, if there is a store
+func (s *StreakTracker) Save() {
+	if s.store == nil {
+		return
+	}
+	s.mutex.RLock()
+	streaks := make([]schemas.ValidatorStreak, 0)
+	for _, pool := range s.pools {
+		for _, streak := range pool.streaks {
+			streaks = append(streaks, *streak)
+		}
+	}
+	s.mutex.RUnlock()
+
+	sort.Slice(streaks, func(i, j int) bool {
+		if streaks[i].Pool != streaks[j].Pool {
+			return streaks[i].Pool < streaks[j].Pool
+		}
+		return streaks[i].ValIndex < streaks[j].ValIndex
+	})
+	if err := s.store.StoreStreaks(streaks); err != nil {
+		log.Error("Could not store streaks: ", err)
+	}
+}
+
+type FileStreakStore struct {
+	path string
+}
+
+func NewFileStreakStore(path string) *FileStreakStore {
+	return &FileStreakStore{
+		path: path,
+	}
+}
+
+func (s *FileStreakStore) LoadStreaks() ([]schemas.ValidatorStreak, error) {
+	streaks := make([]schemas.ValidatorStreak, 0)
+	content, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return streaks, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &streaks); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("could not decode streaks: %s", s.path))
+	}
+	return streaks, nil
+}
+
+func (s *FileStreakStore) StoreStreaks(streaks []schemas.ValidatorStreak) error {
+	content, err := json.Marshal(streaks)
+	if err != nil {
+		return err
+	}
+	// Write to a temporal file first so that a crash does not leave a corrupted file
+	tmpPath := s.path + ".tmp"
+	if err := os.WriteFile(tmpPath, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path)
+}
@@ -0,0 +1,61 @@
+package metrics
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/alrevuelta/eth-pools-metrics/schemas"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_StreakTracker(t *testing.T) {
+	tracker, err := NewStreakTracker(nil)
+	require.NoError(t, err)
+	tracker.Update("pool1", 10, []uint64{1, 2, 3})
+	tracker.Update("pool1", 11, []uint64{1, 2})
+	tracker.Update("pool1", 12, []uint64{1, 4})
+	// Processing the same or an older epoch again doesn't change anything
+	tracker.Update("pool1", 12, []uint64{1, 4})
+	tracker.Update("pool1", 11, []uint64{5})
+
+	require.Equal(t, []schemas.ValidatorStreak{
+		{Pool: "pool1", ValIndex: 1, Epochs: 3, Since: 10, LastEpoch: 12},
+		{Pool: "pool1", ValIndex: 4, Epochs: 1, Since: 12, LastEpoch: 12},
+	}, tracker.GetTopStreaks("pool1", 0))
+	require.Equal(t, 1, len(tracker.GetTopStreaks("pool1", 1)))
+
+	require.Equal(t, []uint64{1}, tracker.GetOffline("pool1", 3))
+	require.Equal(t, []uint64{1, 4}, tracker.GetOffline("pool1", 1))
+	require.Equal(t, []uint64{}, tracker.GetOffline("unknown", 1))
+
+	// le 1, 2, 4, ... and +Inf
+	histogram := tracker.GetHistogram("pool1")
+	require.Equal(t, uint64(1), histogram[0])
+	require.Equal(t, uint64(1), histogram[1])
+	require.Equal(t, uint64(2), histogram[2])
+	require.Equal(t, uint64(2), histogram[len(streakBuckets)])
+
+	// A skipped epoch is unknown, the streaks continue
+	tracker.Update("pool1", 14, []uint64{1})
+	require.Equal(t, []schemas.ValidatorStreak{
+		{Pool: "pool1", ValIndex: 1, Epochs: 4, Since: 10, LastEpoch: 14},
+	}, tracker.GetTopStreaks("pool1", 0))
+}
+
+func Test_StreakTracker_Persisted(t *testing.T) {
+	store := NewFileStreakStore(filepath.Join(t.TempDir(), "streaks.json"))
+	tracker, err := NewStreakTracker(store)
+	require.NoError(t, err)
+	tracker.Update("pool1", 10, []uint64{1, 2})
+	tracker.Update("pool1", 11, []uint64{1})
+	tracker.Save()
+
+	// Continues after a restart
+	tracker, err = NewStreakTracker(store)
+	require.NoError(t, err)
+	tracker.Update("pool1", 11, []uint64{2})
+	tracker.Update("pool1", 12, []uint64{1})
+	require.Equal(t, []schemas.ValidatorStreak{
+		{Pool: "pool1", ValIndex: 1, Epochs: 3, Since: 10, LastEpoch: 12},
+	}, tracker.GetTopStreaks("pool1", 0))
+}
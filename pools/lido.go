@@ -0,0 +1,280 @@
+package pools
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ethereum/go-ethereum/accounts/abi"
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/ethereum/go-ethereum/ethclient"
+	"github.com/pkg/errors"
+	log "github.com/sirupsen/logrus"
+
+	"github.com/alrevuelta/eth-pools-metrics/prometheus"
+)
+
+// Mainnet lido staking modules that implement the NodeOperatorsRegistry interface
+var LidoStakingModules = []string{
+	// Curated module
+	"0x55032650b14df07b85bF18A3a3eC8E0Af2e028d5",
+	// Simple DVT module
+	"0xaE7B191A31f627b4eB1d4DaC64eab9976995b433",
+}
+
+// Prefix used to name the sub pool of each node operator
+const LidoNodePrefix = "lido-"
+
+// Max amount of signing keys requested in a single call
+const lidoKeysBatch = uint64(100)
+
+// Subset of the NodeOperatorsRegistry abi that is needed to get the keys
+var nodeOperatorsRegistryAbi = `[
+{"name":"getNodeOperatorsCount","type":"function","stateMutability":"view",
+ "inputs":[],
+ "outputs":[{"name":"","type":"uint256"}]},
+{"name":"getNodeOperator","type":"function","stateMutability":"view",
+ "inputs":[{"name":"_nodeOperatorId","type":"uint256"},{"name":"_fullInfo","type":"bool"}],
+ "outputs":[{"name":"active","type":"bool"},{"name":"name","type":"string"},{"name":"rewardAddress","type":"address"},
+            {"name":"totalVettedValidators","type":"uint64"},{"name":"totalExitedValidators","type":"uint64"},
+            {"name":"totalAddedValidators","type":"uint64"},{"name":"totalDepositedValidators","type":"uint64"}]},
+{"name":"getSigningKeys","type":"function","stateMutability":"view",
+ "inputs":[{"name":"_nodeOperatorId","type":"uint256"},{"name":"_offset","type":"uint256"},{"name":"_limit","type":"uint256"}],
+ "outputs":[{"name":"pubkeys","type":"bytes"},{"name":"signatures","type":"bytes"},{"name":"used","type":"bool[]"}]}
+]`
+
+type LidoNodeOperator struct {
+	Module        string
+	Id            uint64
+	Name          string
+	Active        bool
+	RewardAddress []byte
+	// Keys of the deposited validators, in the same order as in the registry
+	Keys [][]byte
+}
+
+// Node operators indexed by module address and id. Since deposited keys
+// can't change, they are kept across fetches and only new ones are requested.
+// Owned by a single fetcher, the keys are published in the registry
+type lidoOperatorSet struct {
+	mutex     sync.Mutex
+	operators map[string]*LidoNodeOperator
+}
+
+func newLidoOperatorSet() *lidoOperatorSet {
+	return &lidoOperatorSet{
+		operators: make(map[string]*LidoNodeOperator, 0),
+	}
+}
+
+// Subset of bind.BoundContract, so that the registry can be faked in tests
+type contractCaller interface {
+	Call(opts *bind.CallOpts, results *[]interface{}, method string, params ...interface{}) error
+}
+
+// Publishes the lido keys and its node operators as sub pools in the registry.
+// Stops when the context is cancelled
+func LidoFetcher(ctx context.Context, eth1Address string, registry *KeyRegistry) {
+	known := newLidoOperatorSet()
+	todoSetAsFlag := 60 * time.Minute
+	failures := 0
+	for ok := true; ok; ok = sleep(ctx, fetchWait(failures, todoSetAsFlag)) {
+		keys, err := getLidoKeys(ctx, eth1Address, known)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			failures++
+			log.Error("could not get lido keys, retrying in ", fetchWait(failures, todoSetAsFlag), ": ", err)
+			continue
+		}
+		failures = 0
+		registry.Publish("lido", keys)
+		registry.PublishSubPools("lido", known.nodeKeys())
+	}
+}
+
+// The calls are cancelled with the context
+func getLidoKeys(ctx context.Context, eth1Address string, known *lidoOperatorSet) ([][]byte, error) {
+	log.Info("Fetching lido keys")
+	t0 := time.Now()
+
+	client, err := ethclient.DialContext(ctx, eth1Address)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not connect to the execution endpoint")
+	}
+	defer client.Close()
+
+	registryAbi, err := abi.JSON(strings.NewReader(nodeOperatorsRegistryAbi))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not parse node operators registry abi")
+	}
+
+	statsNew := 0
+	for _, module := range LidoStakingModules {
+		registry := bind.NewBoundContract(common.HexToAddress(module), registryAbi, client, nil, nil)
+		newKeys, err := fetchLidoModule(ctx, registry, module, known)
+		if err != nil {
+			return nil, errors.Wrap(err, fmt.Sprintf("could not get keys from lido module: %s", module))
+		}
+		statsNew += newKeys
+	}
+
+	keys := known.keys()
+	nodeKeys := known.nodeKeys()
+
+	log.WithFields(log.Fields{
+		"NewDetectedKeys": statsNew,
+		"TotalKeys":       len(keys),
+		"NodeOperators":   len(nodeKeys),
+		"Duration":        time.Since(t0),
+	}).Info("Lido Keys:")
+
+	setPrometheusLido(nodeKeys)
+
+	return keys, nil
+}
+
+// Updates the node operators of a staking module, returning the amount of new
+// keys. Operators are fetched concurrently
+func fetchLidoModule(ctx context.Context, registry contractCaller, module string, known *lidoOperatorSet) (int, error) {
+	opts := &bind.CallOpts{Context: ctx}
+	var out []interface{}
+	err := registry.Call(opts, &out, "getNodeOperatorsCount")
+	if err != nil {
+		return 0, errors.Wrap(err, "could not get node operators count")
+	}
+	count := *abi.ConvertType(out[0], new(big.Int)).(*big.Int)
+
+	var newKeys int64
+	err = forEachIndex(ctx, count.Uint64(), eth1Workers, func(id uint64) error {
+		var out []interface{}
+		err := registry.Call(opts, &out, "getNodeOperator", new(big.Int).SetUint64(id), true)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("could not get node operator: %d", id))
+		}
+
+		// Each worker updates a different operator
+		operator := known.get(module, id)
+		operator.Active = out[0].(bool)
+		operator.Name = out[1].(string)
+		operator.RewardAddress = out[2].(common.Address).Bytes()
+		totalDeposited := out[6].(uint64)
+
+		// Only request the keys that were deposited since the last fetch
+		newOperatorKeys := make([][]byte, 0)
+		for offset := uint64(known.countKeys(operator)); offset < totalDeposited; offset += lidoKeysBatch {
+			limit := lidoKeysBatch
+			if offset+limit > totalDeposited {
+				limit = totalDeposited - offset
+			}
+			keys, err := getLidoSigningKeys(registry, opts, id, offset, limit)
+			if err != nil {
+				return err
+			}
+			newOperatorKeys = append(newOperatorKeys, keys...)
+		}
+		known.addKeys(operator, newOperatorKeys)
+		atomic.AddInt64(&newKeys, int64(len(newOperatorKeys)))
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(newKeys), nil
+}
+
+// Returns the operator of a module, created if unknown
+func (s *lidoOperatorSet) get(module string, id uint64) *LidoNodeOperator {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	operatorKey := fmt.Sprintf("%s/%d", module, id)
+	operator, exists := s.operators[operatorKey]
+	if !exists {
+		operator = &LidoNodeOperator{
+			Module: module,
+			Id:     id,
+			Keys:   make([][]byte, 0),
+		}
+		s.operators[operatorKey] = operator
+	}
+	return operator
+}
+
+func (s *lidoOperatorSet) countKeys(operator *LidoNodeOperator) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(operator.Keys)
+}
+
+func (s *lidoOperatorSet) addKeys(operator *LidoNodeOperator, keys [][]byte) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	operator.Keys = append(operator.Keys, keys...)
+}
+
+func (s *lidoOperatorSet) keys() [][]byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	keys := make([][]byte, 0)
+	for _, operator := range s.operators {
+		keys = append(keys, operator.Keys...)
+	}
+	return keys
+}
+
+func getLidoSigningKeys(registry contractCaller, opts *bind.CallOpts, id uint64, offset uint64, limit uint64) ([][]byte, error) {
+	var out []interface{}
+	err := registry.Call(opts, &out, "getSigningKeys",
+		new(big.Int).SetUint64(id),
+		new(big.Int).SetUint64(offset),
+		new(big.Int).SetUint64(limit))
+	if err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("could not get signing keys of node operator: %d", id))
+	}
+	return splitPubkeys(out[0].([]byte))
+}
+
+// The registry returns the keys concatenated, 48 bytes each
+func splitPubkeys(concatenated []byte) ([][]byte, error) {
+	if len(concatenated)%48 != 0 {
+		return nil, errors.New(fmt.Sprintf("length of keys is incorrect: %d", len(concatenated)))
+	}
+	keys := make([][]byte, 0, len(concatenated)/48)
+	for i := 0; i < len(concatenated); i += 48 {
+		key := make([]byte, 48)
+		copy(key, concatenated[i:i+48])
+		keys = append(keys, key)
+	}
+	return keys, nil
+}
+
+// Returns the keys of each node operator, indexed by its sub pool name.
+// Operators with the same name in different modules are merged
+func (s *lidoOperatorSet) nodeKeys() map[string][][]byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	subPools := make(map[string][][]byte, 0)
+	for _, operator := range s.operators {
+		subPool := LidoNodePrefix + operator.Name
+		subPools[subPool] = append(subPools[subPool], operator.Keys...)
+	}
+	return subPools
+}
+
+// Reset so that the operators that were renamed don't keep its series
+func setPrometheusLido(nodeKeys map[string][][]byte) {
+	prometheus.LidoNodeKeys.Reset()
+	for subPool, keys := range nodeKeys {
+		prometheus.LidoNodeKeys.WithLabelValues(
+			subPool).Set(float64(len(keys)))
+	}
+}
@@ -0,0 +1,76 @@
+package pools
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/big"
+	"testing"
+
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_splitPubkeys(t *testing.T) {
+	concatenated := make([]byte, 0)
+	for _, key := range expectedKeys {
+		concatenated = append(concatenated, key...)
+	}
+
+	keys, err := splitPubkeys(concatenated)
+	require.NoError(t, err)
+	require.Equal(t, expectedKeys, keys)
+
+	// Not a multiple of 48 bytes
+	_, err = splitPubkeys(concatenated[1:])
+	require.Error(t, err)
+}
+
+// Registry with the given amount of deposited keys of each operator
+type fakeLidoRegistry struct {
+	deposited []uint64
+}
+
+func (r *fakeLidoRegistry) Call(opts *bind.CallOpts, results *[]interface{}, method string, params ...interface{}) error {
+	switch method {
+	case "getNodeOperatorsCount":
+		*results = []interface{}{big.NewInt(int64(len(r.deposited)))}
+	case "getNodeOperator":
+		id := params[0].(*big.Int).Uint64()
+		*results = []interface{}{true, fmt.Sprintf("operator%d", id), common.Address{}, uint64(0), uint64(0), uint64(0), r.deposited[id]}
+	case "getSigningKeys":
+		id := params[0].(*big.Int).Uint64()
+		offset := params[1].(*big.Int).Uint64()
+		limit := params[2].(*big.Int).Uint64()
+		concatenated := make([]byte, 0)
+		for i := offset; i < offset+limit; i++ {
+			concatenated = append(concatenated, expectedKeys[int(id*2+i)%len(expectedKeys)]...)
+		}
+		*results = []interface{}{concatenated, []byte{}, []bool{}}
+	default:
+		return errors.New("unknown method: " + method)
+	}
+	return nil
+}
+
+func Test_fetchLidoModule(t *testing.T) {
+	registry := &fakeLidoRegistry{deposited: []uint64{2, 1}}
+	known := newLidoOperatorSet()
+
+	newKeys, err := fetchLidoModule(context.Background(), registry, "module", known)
+	require.NoError(t, err)
+	require.Equal(t, 3, newKeys)
+	require.Equal(t, 3, len(known.keys()))
+	require.Equal(t, map[string][][]byte{
+		"lido-operator0": {expectedKeys[0], expectedKeys[1]},
+		"lido-operator1": {expectedKeys[2]},
+	}, known.nodeKeys())
+
+	// Only the new deposits are requested
+	registry.deposited[1] = 2
+	newKeys, err = fetchLidoModule(context.Background(), registry, "module", known)
+	require.NoError(t, err)
+	require.Equal(t, 1, newKeys)
+	require.Equal(t, [][]byte{expectedKeys[2], expectedKeys[3]}, known.nodeKeys()["lido-operator1"])
+}
@@ -2,9 +2,11 @@ package pools
 
 import (
 	"bufio"
+	"context"
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
@@ -696,6 +698,26 @@ var PoolsAddresses = map[string][]string{
 	//},
 }
 
+// The hardcoded pools, the deposit addresses above and the rocketpool and lido
+// contracts, only exist in the mainnet deposit contract
+const mainnetDepositContract = "0x00000000219ab540356cbb839cbe05303d7705fa"
+const mainnetDepositChainId = 1
+
+// Fails if the pool is hardcoded but the chain, as of the spec of the beacon
+// node, deposits somewhere else. Pools read from files work in any chain, and
+// so does everything if the deposit contract is unknown
+func CheckDepositContract(poolName string, depositContract string, depositChainId uint64) error {
+	_, hardcoded := PoolsAddresses[poolName]
+	if !hardcoded || depositContract == "" {
+		return nil
+	}
+	if strings.EqualFold(depositContract, mainnetDepositContract) && depositChainId == mainnetDepositChainId {
+		return nil
+	}
+	return errors.Errorf("pool %s is only known in mainnet, the deposit contract is %s in chain %d, use a file with its keys instead",
+		poolName, depositContract, depositChainId)
+}
+
 func ReadCustomValidatorsFile(validatorKeysFile string) (validatorKeys [][]byte, err error) {
 	log.Info("Reading validator keys from .txt: ", validatorKeysFile)
 	validatorKeys = make([][]byte, 0)
@@ -782,3 +804,34 @@ func ReadEthstaValidatorsFile(validatorKeysFile string) (validatorKeys [][]byte,
 	log.Info("Done reading ", len(validatorKeys), " from ", validatorKeysFile)
 	return validatorKeys, nil
 }
+
+// First wait before retrying a failed fetch, doubled on each consecutive failure
+const minFetchRetry = 1 * time.Minute
+
+// Wait until the next fetch. After failures it is retried sooner, so that the
+// keys are not missing for a whole interval if the first fetch fails
+func fetchWait(failures int, interval time.Duration) time.Duration {
+	if failures == 0 {
+		return interval
+	}
+	wait := minFetchRetry
+	for i := 1; i < failures && wait < interval; i++ {
+		wait *= 2
+	}
+	if wait > interval {
+		return interval
+	}
+	return wait
+}
+
+// Waits for the next fetch, false once the context is cancelled
+func sleep(ctx context.Context, wait time.Duration) bool {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
@@ -3,6 +3,7 @@ package pools
 import (
 	"os"
 	"testing"
+	"time"
 
 	log "github.com/sirupsen/logrus"
 
@@ -115,3 +116,20 @@ func TestReadEthstaValidatorsFile(t *testing.T) {
 		require.Equal(t, expectedKeysEthsta[i], key)
 	}
 }
+
+func Test_FetchWait(t *testing.T) {
+	require.Equal(t, time.Hour, fetchWait(0, time.Hour))
+	require.Equal(t, time.Minute, fetchWait(1, time.Hour))
+	require.Equal(t, 4*time.Minute, fetchWait(3, time.Hour))
+	require.Equal(t, time.Hour, fetchWait(10, time.Hour))
+}
+
+func Test_CheckDepositContract(t *testing.T) {
+	require.NoError(t, CheckDepositContract("kraken", "0x00000000219ab540356cBB839Cbe05303d7705Fa", 1))
+	require.NoError(t, CheckDepositContract("rocketpool", "", 0))
+	require.NoError(t, CheckDepositContract("pool.txt", "0x4242424242424242424242424242424242424242", 17000))
+
+	require.Error(t, CheckDepositContract("kraken", "0x4242424242424242424242424242424242424242", 17000))
+	// Mainnet address in another chain
+	require.Error(t, CheckDepositContract("rocketpool", "0x00000000219ab540356cbb839cbe05303d7705fa", 560048))
+}
@@ -0,0 +1,282 @@
+package pools
+
+import (
+	"hash/fnv"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/attestantio/go-eth2-client/spec/phase0"
+	log "github.com/sirupsen/logrus"
+)
+
+// Size of the buffer of each subscriber. Changes are dropped if full
+const keyChangesBuffer = 10000
+
+// Immutable set of keys of a pool at a given version. Keys must not be modified
+type KeySnapshot struct {
+	Pool string
+	// Empty if the pool is not a sub pool
+	Parent  string
+	Version uint64
+	Keys    [][]byte
+	Updated time.Time
+
+	// Of the keys as published, to skip the diff if they didn't change
+	fingerprint uint64
+}
+
+// Keys that were added or removed from a pool between two versions
+type KeyChange struct {
+	Pool    string
+	Parent  string
+	Version uint64
+	Added   [][]byte
+	Removed [][]byte
+	// True if the pool does not exist anymore
+	Deleted bool
+}
+
+// Concurrency safe registry of the keys of each pool. Key sources publish
+// new sets of keys and readers get consistent snapshots of them.
+type KeyRegistry struct {
+	mutex     sync.RWMutex
+	snapshots map[string]*KeySnapshot
+	// Last version of each pool, kept after removing it so that the
+	// version keeps increasing if it's added again
+	versions    map[string]uint64
+	ready       map[string]chan struct{}
+	subscribers []chan KeyChange
+}
+
+func NewKeyRegistry() *KeyRegistry {
+	return &KeyRegistry{
+		snapshots:   make(map[string]*KeySnapshot, 0),
+		versions:    make(map[string]uint64, 0),
+		ready:       make(map[string]chan struct{}, 0),
+		subscribers: make([]chan KeyChange, 0),
+	}
+}
+
+// Replaces the keys of a pool, bumping its version if they changed.
+func (r *KeyRegistry) Publish(pool string, keys [][]byte) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.publishLocked(pool, "", keys)
+}
+
+// Replaces all the sub pools of a parent pool. Sub pools that are not
+// present anymore are removed. Readers never see a partial update.
+func (r *KeyRegistry) PublishSubPools(parent string, subPools map[string][][]byte) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	for subPool, keys := range subPools {
+		r.publishLocked(subPool, parent, keys)
+	}
+
+	for pool, snapshot := range r.snapshots {
+		if snapshot.Parent != parent {
+			continue
+		}
+		if _, exists := subPools[pool]; !exists {
+			r.removeLocked(pool)
+		}
+	}
+}
+
+// Must be called with the lock held
+func (r *KeyRegistry) publishLocked(pool string, parent string, keys [][]byte) {
+	fingerprint := KeysFingerprint(keys)
+	prev, exists := r.snapshots[pool]
+	if exists && prev.fingerprint == fingerprint && len(prev.Keys) == len(keys) {
+		r.refreshLocked(prev, fingerprint)
+		return
+	}
+
+	// Copy so that the caller can't modify the snapshot
+	newKeys := make([][]byte, len(keys))
+	copy(newKeys, keys)
+
+	var prevKeys [][]byte
+	if exists {
+		prevKeys = prev.Keys
+	}
+
+	added, removed := diffKeys(prevKeys, newKeys)
+	if exists && len(added) == 0 && len(removed) == 0 {
+		// Same keys in another order
+		r.refreshLocked(prev, fingerprint)
+		return
+	}
+
+	snapshot := &KeySnapshot{
+		Pool:    pool,
+		Parent:  parent,
+		Version: r.versions[pool] + 1,
+		Keys:    newKeys,
+		Updated: time.Now(),
+
+		fingerprint: fingerprint,
+	}
+	r.snapshots[pool] = snapshot
+	r.versions[pool] = snapshot.Version
+	r.notify(KeyChange{
+		Pool:    pool,
+		Parent:  parent,
+		Version: snapshot.Version,
+		Added:   added,
+		Removed: removed,
+	})
+
+	ready := r.getReady(pool)
+	select {
+	case <-ready:
+	default:
+		close(ready)
+	}
+}
+
+// Must be called with the lock held. Same keys, only refresh when they were
+// last seen. The fingerprint is the one of the keys as published, that may be
+// in another order
+func (r *KeyRegistry) refreshLocked(prev *KeySnapshot, fingerprint uint64) {
+	refreshed := *prev
+	refreshed.Updated = time.Now()
+	refreshed.fingerprint = fingerprint
+	r.snapshots[prev.Pool] = &refreshed
+}
+
+// Must be called with the lock held
+func (r *KeyRegistry) removeLocked(pool string) {
+	prev, exists := r.snapshots[pool]
+	if !exists {
+		return
+	}
+	delete(r.snapshots, pool)
+	r.versions[pool] = prev.Version + 1
+	r.notify(KeyChange{
+		Pool:    pool,
+		Parent:  prev.Parent,
+		Version: prev.Version + 1,
+		Added:   make([][]byte, 0),
+		Removed: prev.Keys,
+		Deleted: true,
+	})
+}
+
+// Must be called with the lock held
+func (r *KeyRegistry) notify(change KeyChange) {
+	for _, subscriber := range r.subscribers {
+		select {
+		case subscriber <- change:
+		default:
+			log.Warn("Key changes subscriber is full, dropping change of pool: ", change.Pool)
+		}
+	}
+}
+
+// Must be called with the lock held
+func (r *KeyRegistry) getReady(pool string) chan struct{} {
+	ready, exists := r.ready[pool]
+	if !exists {
+		ready = make(chan struct{})
+		r.ready[pool] = ready
+	}
+	return ready
+}
+
+// Returns the latest snapshot of a pool, false if no keys were published yet.
+func (r *KeyRegistry) Snapshot(pool string) (*KeySnapshot, bool) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	snapshot, exists := r.snapshots[pool]
+	return snapshot, exists
+}
+
+// Returns the latest snapshot of each sub pool of a parent, sorted by name.
+func (r *KeyRegistry) SubPools(parent string) []*KeySnapshot {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	subPools := make([]*KeySnapshot, 0)
+	for _, snapshot := range r.snapshots {
+		if parent != "" && snapshot.Parent == parent {
+			subPools = append(subPools, snapshot)
+		}
+	}
+	sort.Slice(subPools, func(i, j int) bool {
+		return subPools[i].Pool < subPools[j].Pool
+	})
+	return subPools
+}
+
+// Returns when the keys of each pool were last published, without sub pools.
+func (r *KeyRegistry) LastUpdated() map[string]time.Time {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	updated := make(map[string]time.Time, 0)
+	for pool, snapshot := range r.snapshots {
+		if snapshot.Parent == "" {
+			updated[pool] = snapshot.Updated
+		}
+	}
+	return updated
+}
+
+// Returns a channel that is closed once the keys of the pool are published for the first time.
+func (r *KeyRegistry) Ready(pool string) <-chan struct{} {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return r.getReady(pool)
+}
+
+// Returns a channel where all the changes in the keys of any pool are sent.
+func (r *KeyRegistry) Subscribe() <-chan KeyChange {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	subscriber := make(chan KeyChange, keyChangesBuffer)
+	r.subscribers = append(r.subscribers, subscriber)
+	return subscriber
+}
+
+// Keys are compared as arrays, cheaper than encoding them
+func diffKeys(prevKeys [][]byte, newKeys [][]byte) ([][]byte, [][]byte) {
+	prevSet := make(map[phase0.BLSPubKey]bool, len(prevKeys))
+	for _, key := range prevKeys {
+		prevSet[toPubKey(key)] = true
+	}
+	newSet := make(map[phase0.BLSPubKey]bool, len(newKeys))
+	for _, key := range newKeys {
+		newSet[toPubKey(key)] = true
+	}
+
+	added := make([][]byte, 0)
+	for _, key := range newKeys {
+		if !prevSet[toPubKey(key)] {
+			added = append(added, key)
+		}
+	}
+
+	removed := make([][]byte, 0)
+	for _, key := range prevKeys {
+		if !newSet[toPubKey(key)] {
+			removed = append(removed, key)
+		}
+	}
+	return added, removed
+}
+
+func toPubKey(key []byte) phase0.BLSPubKey {
+	var pubKey phase0.BLSPubKey
+	copy(pubKey[:], key)
+	return pubKey
+}
+
+// Changes if any key or their order changes
+func KeysFingerprint(keys [][]byte) uint64 {
+	hash := fnv.New64a()
+	for _, key := range keys {
+		hash.Write(key)
+	}
+	return hash.Sum64()
+}
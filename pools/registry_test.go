@@ -0,0 +1,105 @@
+package pools
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func Test_KeyRegistry_Publish(t *testing.T) {
+	registry := NewKeyRegistry()
+	changes := registry.Subscribe()
+	ready := registry.Ready("pool")
+
+	_, exists := registry.Snapshot("pool")
+	require.False(t, exists)
+
+	registry.Publish("pool", [][]byte{expectedKeys[0], expectedKeys[1]})
+	<-ready
+
+	snapshot, exists := registry.Snapshot("pool")
+	require.True(t, exists)
+	require.Equal(t, uint64(1), snapshot.Version)
+	require.Equal(t, [][]byte{expectedKeys[0], expectedKeys[1]}, snapshot.Keys)
+
+	change := <-changes
+	require.Equal(t, "pool", change.Pool)
+	require.Equal(t, [][]byte{expectedKeys[0], expectedKeys[1]}, change.Added)
+	require.Equal(t, 0, len(change.Removed))
+
+	// Same keys, same version and no change is notified
+	registry.Publish("pool", [][]byte{expectedKeys[1], expectedKeys[0]})
+	snapshot, _ = registry.Snapshot("pool")
+	require.Equal(t, uint64(1), snapshot.Version)
+	require.Equal(t, 0, len(changes))
+
+	// Unchanged since the last publish, only refreshed
+	updated := snapshot.Updated
+	registry.Publish("pool", [][]byte{expectedKeys[1], expectedKeys[0]})
+	snapshot, _ = registry.Snapshot("pool")
+	require.Equal(t, uint64(1), snapshot.Version)
+	require.Equal(t, [][]byte{expectedKeys[0], expectedKeys[1]}, snapshot.Keys)
+	require.False(t, snapshot.Updated.Before(updated))
+	require.Equal(t, 0, len(changes))
+
+	registry.Publish("pool", [][]byte{expectedKeys[1], expectedKeys[2]})
+	snapshot, _ = registry.Snapshot("pool")
+	require.Equal(t, uint64(2), snapshot.Version)
+
+	change = <-changes
+	require.Equal(t, [][]byte{expectedKeys[2]}, change.Added)
+	require.Equal(t, [][]byte{expectedKeys[0]}, change.Removed)
+}
+
+func Test_KeyRegistry_PublishSubPools(t *testing.T) {
+	registry := NewKeyRegistry()
+
+	registry.PublishSubPools("parent", map[string][][]byte{
+		"parent-b": {expectedKeys[1]},
+		"parent-a": {expectedKeys[0]},
+	})
+
+	subPools := registry.SubPools("parent")
+	require.Equal(t, 2, len(subPools))
+	require.Equal(t, "parent-a", subPools[0].Pool)
+	require.Equal(t, "parent-b", subPools[1].Pool)
+	require.Equal(t, "parent", subPools[0].Parent)
+
+	// Sub pools that are not published anymore are removed
+	registry.PublishSubPools("parent", map[string][][]byte{
+		"parent-b": {expectedKeys[1]},
+	})
+
+	subPools = registry.SubPools("parent")
+	require.Equal(t, 1, len(subPools))
+	require.Equal(t, "parent-b", subPools[0].Pool)
+
+	_, exists := registry.Snapshot("parent-a")
+	require.False(t, exists)
+
+	// Versions keep increasing if a removed sub pool is added again
+	registry.PublishSubPools("parent", map[string][][]byte{
+		"parent-a": {expectedKeys[0]},
+		"parent-b": {expectedKeys[1]},
+	})
+	snapshot, exists := registry.Snapshot("parent-a")
+	require.True(t, exists)
+	require.Equal(t, uint64(3), snapshot.Version)
+}
+
+func Test_KeyRegistry_LastUpdated(t *testing.T) {
+	registry := NewKeyRegistry()
+	registry.Publish("rocketpool", [][]byte{expectedKeys[0]})
+	registry.PublishSubPools("rocketpool", map[string][][]byte{
+		"rocketpool-0x01": {expectedKeys[0]},
+	})
+
+	updated := registry.LastUpdated()
+	require.Equal(t, 1, len(updated))
+	first := updated["rocketpool"]
+	require.False(t, first.IsZero())
+
+	// Refreshed even if the keys didn't change
+	registry.Publish("rocketpool", [][]byte{expectedKeys[0]})
+	require.True(t, registry.LastUpdated()["rocketpool"].After(first))
+}
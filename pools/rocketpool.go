@@ -1,123 +1,473 @@
 package pools
 
 import (
+	"context"
+	"encoding/json"
 	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/ethereum/go-ethereum/accounts/abi/bind"
 	"github.com/ethereum/go-ethereum/common"
 	"github.com/pkg/errors"
 	log "github.com/sirupsen/logrus"
 
+	"github.com/alrevuelta/eth-pools-metrics/prometheus"
+	"github.com/alrevuelta/eth-pools-metrics/schemas"
 	"github.com/rocket-pool/rocketpool-go/minipool"
 	"github.com/rocket-pool/rocketpool-go/rocketpool"
 	"github.com/rocket-pool/rocketpool-go/utils/client"
+	"github.com/rocket-pool/rocketpool-go/utils/eth"
 )
 
-type RocketpoolMinipool struct {
-	Address     []byte
-	Pubkey      []byte
-	NodeAddress []byte
+// A node operator and the minipools it runs
+type RocketpoolNode struct {
+	Address       []byte
+	SmoothingPool bool
+	Minipools     []*schemas.RocketpoolMinipool
 }
 
 // Mainnet rocket pool contract
 var rocketStorage = "0x1d8f8f00cfa6758d7bE78336684788Fb0ee0Fa46"
 
-// Memory cache of already known minipools and its data
-var MinipoolsByAddress map[string]*RocketpoolMinipool = make(map[string]*RocketpoolMinipool, 0)
+// Prefix used to name the sub pool of each node operator
+const RocketPoolNodePrefix = "rocketpool-"
 
-var RocketPoolKeys [][]byte
+// Memory cache of already known minipools and its data, by address. Owned by
+// a single fetcher, the keys are published in the registry
+type minipoolSet struct {
+	mutex     sync.Mutex
+	minipools map[string]*schemas.RocketpoolMinipool
+}
+
+func newMinipoolSet() *minipoolSet {
+	return &minipoolSet{
+		minipools: make(map[string]*schemas.RocketpoolMinipool, 0),
+	}
+}
+
+// Number of concurrent requests to the execution endpoint when fetching minipools
+// or lido node operators
+var eth1Workers = 20
+
+// Minipools in a final status, its status is not fetched again
+var finalMinipoolStatus = map[string]bool{
+	"Dissolved": true,
+}
+
+// Persistent storage for the minipools, so that they are not fetched again on restart
+type MinipoolCache interface {
+	LoadMinipools() ([]*schemas.RocketpoolMinipool, error)
+	StoreMinipools(minipools []*schemas.RocketpoolMinipool) error
+}
+
+// Publishes the rocketpool keys and its node operators as sub pools in the registry.
+// Cache is optional, nil if no persistence is wanted. Stops when the context is cancelled
+func RocketPoolFetcher(ctx context.Context, eth1Address string, cache MinipoolCache, registry *KeyRegistry) {
+	known := newMinipoolSet()
+	if cache != nil {
+		minipools, err := cache.LoadMinipools()
+		if err != nil {
+			log.Error("could not load rocketpool minipools from cache: ", err)
+		}
+		for _, mp := range minipools {
+			known.set(common.BytesToAddress(mp.Address), mp)
+		}
+		if len(minipools) != 0 {
+			log.Info("Loaded ", len(minipools), " rocketpool minipools from cache")
+			publishRocketPool(registry, known.keys(), known.groupByNode())
+		}
+	}
 
-func RocketPoolFetcher(eth1Address string) {
 	todoSetAsFlag := 60 * time.Minute
-	ticker := time.NewTicker(todoSetAsFlag)
-	for ; true; <-ticker.C {
-		keys, err := GetRocketPoolKeys(eth1Address)
+	failures := 0
+	for ok := true; ok; ok = sleep(ctx, fetchWait(failures, todoSetAsFlag)) {
+		keys, nodes, err := getRocketPoolKeys(ctx, eth1Address, known)
 		if err != nil {
-			log.Error("could not get rocketpool keys: ", err)
+			if ctx.Err() != nil {
+				return
+			}
+			failures++
+			log.Error("could not get rocketpool keys, retrying in ", fetchWait(failures, todoSetAsFlag), ": ", err)
+			continue
+		}
+		failures = 0
+		publishRocketPool(registry, keys, nodes)
+
+		if cache != nil {
+			err = cache.StoreMinipools(known.all())
+			if err != nil {
+				log.Error("could not store rocketpool minipools in cache: ", err)
+			}
 		}
-		RocketPoolKeys = keys
 	}
 }
 
-func GetRocketPoolKeys(eth1Address string) ([][]byte, error) {
+func publishRocketPool(registry *KeyRegistry, keys [][]byte, nodes map[string]*RocketpoolNode) {
+	registry.Publish("rocketpool", keys)
+	registry.PublishSubPools("rocketpool", rocketPoolNodeKeys(nodes))
+}
+
+// Returns all the rocketpool keys and the node operators. Only the new minipools
+// are fetched, the known ones just refresh its status. The calls are cancelled
+// with the context
+func getRocketPoolKeys(ctx context.Context, eth1Address string, known *minipoolSet) ([][]byte, map[string]*RocketpoolNode, error) {
 	log.Info("Fetching rocket pool keys")
 	t0 := time.Now()
 	proxy := client.NewEth1ClientProxy(60*time.Second, eth1Address)
 	rp, err := rocketpool.NewRocketPool(proxy, common.HexToAddress(rocketStorage))
 	if err != nil {
-		return nil, errors.Wrap(err, fmt.Sprintf("bad contract address: %s", rocketStorage))
+		return nil, nil, errors.Wrap(err, fmt.Sprintf("bad contract address: %s", rocketStorage))
 	}
 
-	minipools, err := minipool.GetMinipoolAddresses(rp, nil)
+	opts := &bind.CallOpts{Context: ctx}
+	minipools, err := minipool.GetMinipoolAddresses(rp, opts)
 	if err != nil {
-		return nil, errors.Wrap(err, "error getting minipool addresses")
+		return nil, nil, errors.Wrap(err, "error getting minipool addresses")
 	}
 
-	statsNew := 0
-	statsCache := 0
+	var statsNew, statsCache int64
 
 	// Get the validator pubkey for each minipool
-	for _, minipoolAddress := range minipools {
+	err = forEachAddress(ctx, minipools, eth1Workers, func(minipoolAddress common.Address) error {
+		info, exists := known.get(minipoolAddress)
 
 		// Since this should not change, avoid fetching already known mini pools
-		if _, exists := MinipoolsByAddress[minipoolAddress.Hex()]; exists {
-			statsCache++
-		} else {
-			info, err := getMiniPoolInfo(rp, minipoolAddress)
-
+		if exists {
+			atomic.AddInt64(&statsCache, 1)
+			if finalMinipoolStatus[info.Status] {
+				return nil
+			}
+			// The status is the only field that changes over time
+			status, err := getMiniPoolStatus(rp, minipoolAddress, opts)
 			if err != nil {
-				return nil, errors.Wrap(err, fmt.Sprintf("could not get minipool info: %s", minipoolAddress.Hex()))
+				return errors.Wrap(err, fmt.Sprintf("could not get minipool status: %s", minipoolAddress.Hex()))
 			}
+			known.setStatus(minipoolAddress, status)
+			return nil
+		}
 
-			MinipoolsByAddress[minipoolAddress.Hex()] = info
-			statsNew++
+		info, err := getMiniPoolInfo(rp, minipoolAddress, opts)
+		if err != nil {
+			return errors.Wrap(err, fmt.Sprintf("could not get minipool info: %s", minipoolAddress.Hex()))
 		}
+		known.set(minipoolAddress, info)
+		atomic.AddInt64(&statsNew, 1)
+		return nil
+	})
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	nodes := known.groupByNode()
+	err = setSmoothingPoolStates(rp, nodes, opts)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "could not get rocketpool node operators")
 	}
 
 	log.WithFields(log.Fields{
 		"NewDetectedKeys": statsNew,
 		"CachedKeys":      statsCache,
+		"NodeOperators":   len(nodes),
 		"Duration":        time.Since(t0),
 	}).Info("RocketPool Keys:")
 
-	return getKeys(), nil
+	setPrometheusRocketPool(nodes)
+
+	return known.keys(), nodes, nil
+}
+
+// Runs fn for each address using a bounded number of concurrent workers.
+// Returns the first error, if any
+func forEachAddress(ctx context.Context, addresses []common.Address, workers int, fn func(common.Address) error) error {
+	return forEachIndex(ctx, uint64(len(addresses)), workers, func(i uint64) error {
+		return fn(addresses[i])
+	})
+}
+
+// Runs fn for each index in [0, n) using a bounded number of concurrent workers.
+// Returns the first error, if any. No more indexes are handed out once the
+// context is cancelled, the ones in progress are waited for
+func forEachIndex(ctx context.Context, n uint64, workers int, fn func(uint64) error) error {
+	jobs := make(chan uint64)
+	errs := make(chan error, n)
+	var wg sync.WaitGroup
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range jobs {
+				if err := fn(index); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+
+feed:
+	for i := uint64(0); i < n; i++ {
+		select {
+		case jobs <- i:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	close(errs)
+
+	if err := <-errs; err != nil {
+		return err
+	}
+	return ctx.Err()
 }
 
 func getMiniPoolInfo(
 	rp *rocketpool.RocketPool,
-	address common.Address) (*RocketpoolMinipool, error) {
+	address common.Address,
+	opts *bind.CallOpts) (*schemas.RocketpoolMinipool, error) {
 
 	mp, err := minipool.NewMinipool(rp, address)
 	if err != nil {
 		return nil, errors.Wrap(err, "error creating minipool")
 	}
 
-	nodeAddress, err := mp.GetNodeAddress(nil)
+	nodeAddress, err := mp.GetNodeAddress(opts)
 	if err != nil {
 		return nil, errors.Wrap(err, "could not get node address of minipool")
 	}
 
+	nodeFee, err := mp.GetNodeFee(opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get node fee of minipool")
+	}
+
+	nodeDeposit, err := mp.GetNodeDepositBalance(opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get node deposit balance of minipool")
+	}
+
+	status, err := mp.GetStatus(opts)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get status of minipool")
+	}
+
 	pubkey, err := minipool.GetMinipoolPubkey(
 		rp,
 		common.BytesToAddress(address.Bytes()),
-		nil)
+		opts)
 
 	if err != nil {
 		return nil, errors.Wrap(err, fmt.Sprintf("could not get minipool key: %s", address))
 	}
 
-	info := &RocketpoolMinipool{
+	info := &schemas.RocketpoolMinipool{
 		Address:     address.Bytes(),
 		NodeAddress: nodeAddress.Bytes(),
 		Pubkey:      pubkey.Bytes(),
+		NodeFee:     nodeFee,
+		BondEth:     eth.WeiToEth(nodeDeposit),
+		Status:      status.String(),
 	}
 	return info, nil
 }
 
-func getKeys() [][]byte {
-	keys := make([][]byte, 0)
-	for _, element := range MinipoolsByAddress {
+func getMiniPoolStatus(
+	rp *rocketpool.RocketPool,
+	address common.Address,
+	opts *bind.CallOpts) (string, error) {
+
+	mp, err := minipool.NewMinipool(rp, address)
+	if err != nil {
+		return "", errors.Wrap(err, "error creating minipool")
+	}
+
+	status, err := mp.GetStatus(opts)
+	if err != nil {
+		return "", err
+	}
+	return status.String(), nil
+}
+
+func (s *minipoolSet) get(address common.Address) (*schemas.RocketpoolMinipool, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	mp, exists := s.minipools[address.Hex()]
+	return mp, exists
+}
+
+func (s *minipoolSet) set(address common.Address, mp *schemas.RocketpoolMinipool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.minipools[address.Hex()] = mp
+}
+
+func (s *minipoolSet) setStatus(address common.Address, status string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if mp, exists := s.minipools[address.Hex()]; exists {
+		mp.Status = status
+	}
+}
+
+// Groups the known minipools by node operator
+func (s *minipoolSet) groupByNode() map[string]*RocketpoolNode {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	nodes := make(map[string]*RocketpoolNode, 0)
+	for _, mp := range s.minipools {
+		nodeAddress := common.BytesToAddress(mp.NodeAddress).Hex()
+		node, exists := nodes[nodeAddress]
+		if !exists {
+			node = &RocketpoolNode{
+				Address:   mp.NodeAddress,
+				Minipools: make([]*schemas.RocketpoolMinipool, 0),
+			}
+			nodes[nodeAddress] = node
+		}
+		node.Minipools = append(node.Minipools, mp)
+	}
+	return nodes
+}
+
+// Fetches whether each node has opted in the smoothing pool
+func setSmoothingPoolStates(rp *rocketpool.RocketPool, nodes map[string]*RocketpoolNode, opts *bind.CallOpts) error {
+	nodeManager, err := rp.GetContract("rocketNodeManager")
+	if err != nil {
+		return errors.Wrap(err, "could not get rocketNodeManager contract")
+	}
+
+	nodeAddresses := make([]common.Address, 0, len(nodes))
+	for nodeAddress := range nodes {
+		nodeAddresses = append(nodeAddresses, common.HexToAddress(nodeAddress))
+	}
+
+	// Each worker writes to a different node, no need to lock
+	return forEachAddress(opts.Context, nodeAddresses, eth1Workers, func(nodeAddress common.Address) error {
+		inSmoothingPool := new(bool)
+		if err := nodeManager.Call(opts, inSmoothingPool, "getSmoothingPoolRegistrationState", nodeAddress); err != nil {
+			return errors.Wrap(err, fmt.Sprintf("could not get smoothing pool state: %s", nodeAddress.Hex()))
+		}
+		nodes[nodeAddress.Hex()].SmoothingPool = *inSmoothingPool
+		return nil
+	})
+}
+
+// Returns the keys of each node operator, indexed by its sub pool name
+func rocketPoolNodeKeys(nodes map[string]*RocketpoolNode) map[string][][]byte {
+	subPools := make(map[string][][]byte, 0)
+	for nodeAddress, node := range nodes {
+		keys := make([][]byte, 0)
+		for _, mp := range node.Minipools {
+			keys = append(keys, mp.Pubkey)
+		}
+		subPools[RocketPoolNodePrefix+nodeAddress] = keys
+	}
+	return subPools
+}
+
+func (s *minipoolSet) keys() [][]byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	keys := make([][]byte, 0, len(s.minipools))
+	for _, element := range s.minipools {
 		keys = append(keys, element.Pubkey)
 	}
 	return keys
 }
+
+func (s *minipoolSet) all() []*schemas.RocketpoolMinipool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	minipools := make([]*schemas.RocketpoolMinipool, 0, len(s.minipools))
+	for _, element := range s.minipools {
+		minipools = append(minipools, element)
+	}
+	return minipools
+}
+
+// Stores the minipools as a json file in disk
+type FileMinipoolCache struct {
+	path string
+}
+
+func NewFileMinipoolCache(path string) *FileMinipoolCache {
+	return &FileMinipoolCache{
+		path: path,
+	}
+}
+
+func (c *FileMinipoolCache) LoadMinipools() ([]*schemas.RocketpoolMinipool, error) {
+	minipools := make([]*schemas.RocketpoolMinipool, 0)
+	content, err := os.ReadFile(c.path)
+	if os.IsNotExist(err) {
+		return minipools, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &minipools); err != nil {
+		return nil, errors.Wrap(err, fmt.Sprintf("could not decode minipools cache: %s", c.path))
+	}
+	return minipools, nil
+}
+
+func (c *FileMinipoolCache) StoreMinipools(minipools []*schemas.RocketpoolMinipool) error {
+	content, err := json.Marshal(minipools)
+	if err != nil {
+		return err
+	}
+	// Write to a temporal file first so that a crash does not leave a corrupted cache
+	tmpPath := c.path + ".tmp"
+	if err := os.WriteFile(tmpPath, content, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, c.path)
+}
+
+// Reset so that the nodes that left don't keep its series
+func setPrometheusRocketPool(nodes map[string]*RocketpoolNode) {
+	prometheus.RocketPoolMinipools.Reset()
+	prometheus.RocketPoolNodeMinipools.Reset()
+	prometheus.RocketPoolNodeBond.Reset()
+	prometheus.RocketPoolNodeFee.Reset()
+	prometheus.RocketPoolNodeSmoothingPool.Reset()
+	for nodeAddress, node := range nodes {
+		subPool := RocketPoolNodePrefix + nodeAddress
+		totalBond := float64(0)
+		totalFee := float64(0)
+		for _, mp := range node.Minipools {
+			prometheus.RocketPoolMinipools.WithLabelValues(
+				mp.Status,
+				fmt.Sprintf("%g", mp.BondEth)).Inc()
+			totalBond += mp.BondEth
+			totalFee += mp.NodeFee
+		}
+
+		prometheus.RocketPoolNodeMinipools.WithLabelValues(
+			subPool).Set(float64(len(node.Minipools)))
+
+		prometheus.RocketPoolNodeBond.WithLabelValues(
+			subPool).Set(totalBond)
+
+		prometheus.RocketPoolNodeFee.WithLabelValues(
+			subPool).Set(totalFee / float64(len(node.Minipools)))
+
+		prometheus.RocketPoolNodeSmoothingPool.WithLabelValues(
+			subPool).Set(float64(boolToUint64(node.SmoothingPool)))
+	}
+}
+
+func boolToUint64(in bool) uint64 {
+	if in {
+		return uint64(1)
+	}
+	return uint64(0)
+}
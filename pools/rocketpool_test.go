@@ -0,0 +1,75 @@
+package pools
+
+import (
+	"context"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+
+	"github.com/alrevuelta/eth-pools-metrics/schemas"
+	"github.com/ethereum/go-ethereum/common"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFileMinipoolCache(t *testing.T) {
+	cacheFile := filepath.Join(t.TempDir(), "minipools_cache.json")
+
+	cache := NewFileMinipoolCache(cacheFile)
+
+	// No file yet, returns no minipools
+	minipools, err := cache.LoadMinipools()
+	require.NoError(t, err)
+	require.Equal(t, 0, len(minipools))
+
+	stored := []*schemas.RocketpoolMinipool{
+		{Address: []byte{1}, Pubkey: expectedKeys[0], NodeAddress: []byte{10}, NodeFee: 0.15, BondEth: 16, Status: "Staking"},
+		{Address: []byte{2}, Pubkey: expectedKeys[1], NodeAddress: []byte{10}, NodeFee: 0.14, BondEth: 8, Status: "Prelaunch"},
+	}
+
+	err = cache.StoreMinipools(stored)
+	require.NoError(t, err)
+
+	minipools, err = cache.LoadMinipools()
+	require.NoError(t, err)
+	require.Equal(t, stored, minipools)
+}
+
+func TestMinipoolSetGroupsByNode(t *testing.T) {
+	known := newMinipoolSet()
+	known.set(common.BytesToAddress([]byte{1}), &schemas.RocketpoolMinipool{Address: []byte{1}, Pubkey: expectedKeys[0], NodeAddress: []byte{10}, Status: "Staking"})
+	known.set(common.BytesToAddress([]byte{2}), &schemas.RocketpoolMinipool{Address: []byte{2}, Pubkey: expectedKeys[1], NodeAddress: []byte{10}, Status: "Prelaunch"})
+	known.set(common.BytesToAddress([]byte{3}), &schemas.RocketpoolMinipool{Address: []byte{3}, Pubkey: expectedKeys[2], NodeAddress: []byte{11}, Status: "Staking"})
+
+	known.setStatus(common.BytesToAddress([]byte{2}), "Staking")
+	mp, exists := known.get(common.BytesToAddress([]byte{2}))
+	require.True(t, exists)
+	require.Equal(t, "Staking", mp.Status)
+
+	nodes := known.groupByNode()
+	require.Equal(t, 2, len(nodes))
+	require.Equal(t, 2, len(nodes[common.BytesToAddress([]byte{10}).Hex()].Minipools))
+	require.Equal(t, 3, len(known.keys()))
+	require.Equal(t, 3, len(known.all()))
+}
+
+func Test_forEachIndex_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var done int64
+	err := forEachIndex(ctx, 1000, 2, func(index uint64) error {
+		if atomic.AddInt64(&done, 1) == 10 {
+			cancel()
+		}
+		return nil
+	})
+	require.ErrorIs(t, err, context.Canceled)
+	require.Less(t, atomic.LoadInt64(&done), int64(1000))
+
+	// All indexes if not cancelled
+	done = 0
+	err = forEachIndex(context.Background(), 1000, 2, func(index uint64) error {
+		atomic.AddInt64(&done, 1)
+		return nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, int64(1000), done)
+}
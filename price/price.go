@@ -1,6 +1,7 @@
 package price
 
 import (
+	"context"
 	"time"
 
 	"github.com/alrevuelta/eth-pools-metrics/config"
@@ -18,7 +19,12 @@ type Price struct {
 	coingecko  *gecko.Client
 }
 
+// Must be created once the chain spec is loaded, the prices are stored with
+// the epoch they were fetched in
 func NewPrice(postgresEndpoint string) (*Price, error) {
+	if config.GenesisTime.IsZero() {
+		return nil, errors.New("unknown genesis time, the chain spec is not loaded")
+	}
 
 	cg := gecko.NewClient(nil)
 
@@ -41,19 +47,26 @@ func NewPrice(postgresEndpoint string) (*Price, error) {
 	}, nil
 }
 
-func (p *Price) GetEthPrice() {
-	id := ""
-	if config.Network == "mainnet" {
-		id = "ethereum"
-	} else if config.Network == "gnosis" {
-		id = "gnosis"
-	} else {
-		log.Fatal("Network not supported: ", config.Network)
+// Id in coingecko of the native token, testnets and devnets have no price
+func coingeckoId(network string) (string, bool) {
+	switch network {
+	case "mainnet":
+		return "ethereum", true
+	case "gnosis":
+		return "gnosis", true
+	}
+	return "", false
+}
+
+func (p *Price) GetEthPrice() error {
+	id, supported := coingeckoId(config.Network)
+	if !supported {
+		return errors.New("network not supported: " + config.Network)
 	}
 
 	sp, err := p.coingecko.SimplePrice([]string{id}, vc)
 	if err != nil {
-		log.Error(err)
+		return errors.Wrap(err, "could not get the price")
 	}
 
 	eth := (*sp)[id]
@@ -65,17 +78,38 @@ func (p *Price) GetEthPrice() {
 	if p.postgresql != nil {
 		err := p.postgresql.StoreEthPrice(ethPriceUsd)
 		if err != nil {
-			log.Error(err)
+			return errors.Wrap(err, "could not store the price")
 		}
 	}
+	return nil
 }
 
-func (p *Price) Run() {
+// Updates the price until the context is cancelled
+func (p *Price) Run(ctx context.Context) {
+	if _, supported := coingeckoId(config.Network); !supported {
+		log.Info("No price for network ", config.Network)
+		return
+	}
 	todoSetAsFlag := 30 * time.Minute
 	ticker := time.NewTicker(todoSetAsFlag)
-	for ; true; <-ticker.C {
-		p.GetEthPrice()
+	defer ticker.Stop()
+	for {
+		if err := p.GetEthPrice(); err != nil {
+			log.Error(err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *Price) Close() error {
+	if p.postgresql != nil {
+		return p.postgresql.Close()
 	}
+	return nil
 }
 
 func logPrice(price float32) {
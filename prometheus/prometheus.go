@@ -3,17 +3,28 @@ package prometheus
 import (
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
 )
 
-func Run(port int) {
+// Serves the metrics and the health endpoints in the background, the returned
+// server is used to stop it
+func Run(port int, health http.Handler) *http.Server {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/", health)
+	server := &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: mux}
 	go func() {
-		http.Handle("/metrics", promhttp.Handler())
-		http.ListenAndServe(fmt.Sprintf(":%d", port), nil)
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			log.Error("Prometheus server stopped: ", err)
+		}
 	}()
+	return server
 }
 
 var (
@@ -231,6 +242,7 @@ var (
 		},
 		[]string{
 			"pool",
+			"parent",
 		},
 	)
 
@@ -242,6 +254,7 @@ var (
 		},
 		[]string{
 			"pool",
+			"parent",
 		},
 	)
 
@@ -277,6 +290,7 @@ var (
 		},
 		[]string{
 			"pool",
+			"parent",
 		},
 	)
 
@@ -288,6 +302,7 @@ var (
 		},
 		[]string{
 			"pool",
+			"parent",
 		},
 	)
 
@@ -299,6 +314,7 @@ var (
 		},
 		[]string{
 			"pool",
+			"parent",
 		},
 	)
 
@@ -310,6 +326,7 @@ var (
 		},
 		[]string{
 			"pool",
+			"parent",
 		},
 	)
 
@@ -321,6 +338,7 @@ var (
 		},
 		[]string{
 			"pool",
+			"parent",
 		},
 	)
 
@@ -332,6 +350,7 @@ var (
 		},
 		[]string{
 			"pool",
+			"parent",
 		},
 	)
 
@@ -343,6 +362,7 @@ var (
 		},
 		[]string{
 			"pool",
+			"parent",
 		},
 	)
 
@@ -354,6 +374,7 @@ var (
 		},
 		[]string{
 			"pool",
+			"parent",
 		},
 	)
 
@@ -365,6 +386,7 @@ var (
 		},
 		[]string{
 			"pool",
+			"parent",
 		},
 	)
 
@@ -376,6 +398,7 @@ var (
 		},
 		[]string{
 			"pool",
+			"parent",
 		},
 	)
 
@@ -394,4 +417,472 @@ var (
 			Help:      "Total validators",
 		},
 	)
+
+	RocketPoolMinipools = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "validators",
+			Name:      "rocketpool_minipools",
+			Help:      "Number of rocket pool minipools by status and bond size in ETH",
+		},
+		[]string{
+			"status",
+			"bond",
+		},
+	)
+
+	RocketPoolNodeMinipools = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "validators",
+			Name:      "rocketpool_node_minipools",
+			Help:      "Number of minipools run by each rocket pool node operator",
+		},
+		[]string{
+			"pool",
+		},
+	)
+
+	RocketPoolNodeBond = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "validators",
+			Name:      "rocketpool_node_bond_eth",
+			Help:      "ETH bonded by each rocket pool node operator across its minipools",
+		},
+		[]string{
+			"pool",
+		},
+	)
+
+	RocketPoolNodeFee = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "validators",
+			Name:      "rocketpool_node_fee",
+			Help:      "Average commission fee of the minipools of each rocket pool node operator",
+		},
+		[]string{
+			"pool",
+		},
+	)
+
+	RocketPoolNodeSmoothingPool = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "validators",
+			Name:      "rocketpool_node_smoothing_pool",
+			Help:      "1 if the rocket pool node operator is opted in the smoothing pool, 0 otherwise",
+		},
+		[]string{
+			"pool",
+		},
+	)
+
+	LidoNodeKeys = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "validators",
+			Name:      "lido_node_keys",
+			Help:      "Number of deposited keys of each lido node operator",
+		},
+		[]string{
+			"pool",
+		},
+	)
+
+	PoolKeysVersion = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "validators",
+			Name:      "pool_keys_version",
+			Help:      "Version of the set of keys of each pool, increased every time it changes",
+		},
+		[]string{
+			"pool",
+		},
+	)
+
+	PoolKeysAdded = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "validators",
+			Name:      "pool_keys_added",
+			Help:      "Number of keys added to each pool (since startup)",
+		},
+		[]string{
+			"pool",
+		},
+	)
+
+	PoolKeysRemoved = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "validators",
+			Name:      "pool_keys_removed",
+			Help:      "Number of keys removed from each pool (since startup)",
+		},
+		[]string{
+			"pool",
+		},
+	)
+
+	RollingParticipationRate = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "validators",
+			Name:      "rolling_participation_rate",
+			Help:      "Rate of correct source, target and head votes over a time window",
+		},
+		[]string{
+			"pool",
+			"window",
+		},
+	)
+
+	RollingRewards = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "validators",
+			Name:      "rolling_rewards",
+			Help:      "Earned minus lost balance in Gwei over a time window",
+		},
+		[]string{
+			"pool",
+			"window",
+		},
+	)
+
+	RollingConsensusApr = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "validators",
+			Name:      "rolling_consensus_apr",
+			Help:      "Annualized consensus rewards over the effective balance in a time window",
+		},
+		[]string{
+			"pool",
+			"window",
+		},
+	)
+
+	RollingAttestationEffectiveness = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "validators",
+			Name:      "rolling_attestation_effectiveness",
+			Help:      "Correct votes weighted by its rewards over a time window",
+		},
+		[]string{
+			"pool",
+			"window",
+		},
+	)
+
+	RollingProposalSuccessRate = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "validators",
+			Name:      "rolling_proposal_success_rate",
+			Help:      "Proposed blocks over scheduled ones in a time window",
+		},
+		[]string{
+			"pool",
+			"window",
+		},
+	)
+
+	NetworkRatio = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "validators",
+			Name:      "network_ratio",
+			Help:      "Rolling metric of a pool divided by the same metric of the whole network",
+		},
+		[]string{
+			"pool",
+			"window",
+			"metric",
+		},
+	)
+
+	MissedAttestationStreaks = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "validators",
+			Name:      "missed_attestation_streaks",
+			Help:      "Validators missing its attestations for less or equal consecutive epochs than le",
+		},
+		[]string{
+			"pool",
+			"le",
+		},
+	)
+
+	MissedAttestationStreak = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "validators",
+			Name:      "missed_attestation_streak",
+			Help:      "Consecutive epochs missing its attestations of the validators with the longest streaks",
+		},
+		[]string{
+			"pool",
+			"validator_index",
+		},
+	)
+
+	OfflineValidators = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "validators",
+			Name:      "offline_validators",
+			Help:      "Validators missing its attestations for longer than the offline threshold",
+		},
+		[]string{
+			"pool",
+		},
+	)
+
+	UpcomingProposals = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "validators",
+			Name:      "upcoming_proposals",
+			Help:      "Pending proposals of the pool in the current and next epoch",
+		},
+		[]string{
+			"pool",
+		},
+	)
+
+	SyncCommitteeValidators = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "validators",
+			Name:      "sync_committee_validators",
+			Help:      "Validators of the pool in the current and next sync committee",
+		},
+		[]string{
+			"pool",
+			"period",
+		},
+	)
+
+	BeaconNodeHealthy = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "validators",
+			Name:      "beacon_node_healthy",
+			Help:      "If the beacon node is synced and not behind the others",
+		},
+		[]string{
+			"endpoint",
+		},
+	)
+
+	BeaconNodeHeadSlot = promauto.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "validators",
+			Name:      "beacon_node_head_slot",
+			Help:      "Head slot of the beacon node in the last health check",
+		},
+		[]string{
+			"endpoint",
+		},
+	)
+
+	BeaconNodeFailovers = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "validators",
+			Name:      "beacon_node_failovers",
+			Help:      "Requests to the beacon node that failed and were retried in another one",
+		},
+		[]string{
+			"endpoint",
+		},
+	)
+
+	StateRootMismatches = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "validators",
+			Name:      "state_root_mismatches",
+			Help:      "State roots of the beacon node that didn't match the ones of the other nodes",
+		},
+		[]string{
+			"endpoint",
+		},
+	)
+
+	LastProcessedEpoch = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "validators",
+			Name:      "last_processed_epoch",
+			Help:      "Last epoch that was processed by the loop",
+		},
+	)
+
+	LastProcessedEpochTimestamp = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "validators",
+			Name:      "last_processed_epoch_timestamp_seconds",
+			Help:      "Unix time when the last epoch was processed",
+		},
+	)
+
+	SkippedEpochs = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "validators",
+			Name:      "skipped_epochs",
+			Help:      "Epochs skipped because the exporter was lagging, queued to be retried",
+		},
+	)
+
+	QueuedEpochs = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "validators",
+			Name:      "queued_epochs",
+			Help:      "Epochs that failed or were skipped and are pending to be retried",
+		},
+	)
+
+	FailedEpochs = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Namespace: "validators",
+			Name:      "failed_epochs",
+			Help:      "Epochs that were given up on after running out of retries",
+		},
+	)
+
+	StageDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "validators",
+			Name:      "stage_duration_seconds",
+			Help:      "Duration of each stage of processing an epoch: state_fetch, duties, pool and epoch",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 16),
+		},
+		[]string{
+			"stage",
+		},
+	)
+
+	BeaconRequestDuration = promauto.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace: "validators",
+			Name:      "beacon_request_duration_seconds",
+			Help:      "Duration of the requests to each beacon node by api path",
+			Buckets:   prometheus.ExponentialBuckets(0.01, 2, 16),
+		},
+		[]string{
+			"endpoint",
+			"path",
+		},
+	)
+
+	BeaconRequestErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "validators",
+			Name:      "beacon_request_errors",
+			Help:      "Failed requests to each beacon node by api path",
+		},
+		[]string{
+			"endpoint",
+			"path",
+		},
+	)
+
+	PostgresWriteErrors = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "validators",
+			Name:      "postgres_write_errors",
+			Help:      "Failed writes to each postgres table",
+		},
+		[]string{
+			"table",
+		},
+	)
 )
+
+// Deletes the series of a pool that doesn't exist anymore. Only series with
+// known label values can be deleted, so the rolling windows are needed.
+func DeletePool(pool string, parent string, windows []string) {
+	for _, vec := range []*prometheus.GaugeVec{
+		TotalBalanceMetrics,
+		ActiveValidatorsMetrics,
+		IncorrectSourceMetrics,
+		IncorrectTargetMetrics,
+		IncorrectHeadMetrics,
+		EpochEarnedAmountMetrics,
+		EpochLostAmountMetrics,
+		DeltaEpochBalanceMetrics,
+		CumulativeConsensusRewards,
+		NumOfSyncCommitteeValidators,
+		NOfProposedBlocks,
+		NOfMissedBlocks,
+	} {
+		vec.DeleteLabelValues(pool, parent)
+	}
+	for _, vec := range []*prometheus.GaugeVec{
+		RocketPoolNodeMinipools,
+		RocketPoolNodeBond,
+		RocketPoolNodeFee,
+		RocketPoolNodeSmoothingPool,
+		LidoNodeKeys,
+		PoolKeysVersion,
+		OfflineValidators,
+		UpcomingProposals,
+	} {
+		vec.DeleteLabelValues(pool)
+	}
+	PoolKeysAdded.DeleteLabelValues(pool)
+	PoolKeysRemoved.DeleteLabelValues(pool)
+	SyncCommitteeValidators.DeleteLabelValues(pool, "current")
+	SyncCommitteeValidators.DeleteLabelValues(pool, "next")
+
+	for _, window := range windows {
+		for _, vec := range []*prometheus.GaugeVec{
+			RollingParticipationRate,
+			RollingRewards,
+			RollingConsensusApr,
+			RollingAttestationEffectiveness,
+			RollingProposalSuccessRate,
+		} {
+			vec.DeleteLabelValues(pool, window)
+		}
+	}
+}
+
+// Seconds until the next proposal of each pool, calculated when scraped
+type nextProposalCollector struct {
+	desc          *prometheus.Desc
+	nextProposals func(now time.Time) map[string]time.Time
+}
+
+func (c *nextProposalCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *nextProposalCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	for pool, next := range c.nextProposals(now) {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, next.Sub(now).Seconds(), pool)
+	}
+}
+
+func RegisterNextProposals(nextProposals func(now time.Time) map[string]time.Time) {
+	prometheus.MustRegister(&nextProposalCollector{
+		desc: prometheus.NewDesc(
+			"validators_seconds_until_next_proposal",
+			"Seconds until the next proposal of the pool, if any in the current or next epoch",
+			[]string{"pool"},
+			nil),
+		nextProposals: nextProposals,
+	})
+}
+
+// Seconds since the keys of each pool were last fetched, calculated when scraped
+type keysAgeCollector struct {
+	desc        *prometheus.Desc
+	keysUpdated func() map[string]time.Time
+}
+
+func (c *keysAgeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *keysAgeCollector) Collect(ch chan<- prometheus.Metric) {
+	now := time.Now()
+	for pool, updated := range c.keysUpdated() {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, now.Sub(updated).Seconds(), pool)
+	}
+}
+
+func RegisterKeysAge(keysUpdated func() map[string]time.Time) {
+	prometheus.MustRegister(&keysAgeCollector{
+		desc: prometheus.NewDesc(
+			"validators_keys_age_seconds",
+			"Seconds since the keys of the pool were last fetched from its source",
+			[]string{"pool"},
+			nil),
+		keysUpdated: keysUpdated,
+	})
+}
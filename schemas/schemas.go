@@ -25,6 +25,8 @@ type ValidatorPerformanceMetrics struct {
 	EffectiveBalance       *big.Int
 	TotalRewards           *big.Int
 	DeltaEpochBalance      *big.Int
+	// Calculated before the epoch was finalized, to be recalculated
+	Provisional bool
 }
 
 type ValidatorStatusMetrics struct {
@@ -54,6 +56,7 @@ type RewardsMetrics struct {
 
 type ProposalDutiesMetrics struct {
 	Epoch     uint64
+	Time      time.Time
 	Scheduled []Duty
 	Proposed  []Duty
 	Missed    []Duty
@@ -64,3 +67,123 @@ type Duty struct {
 	Slot     uint64
 	Graffiti string
 }
+
+type RocketpoolMinipool struct {
+	Address     []byte
+	Pubkey      []byte
+	NodeAddress []byte
+	NodeFee     float64
+	// Node deposit (bond) in ETH, 16 or 8 depending on the minipool type
+	BondEth float64
+	Status  string
+}
+
+// Epoch that could not be calculated and is retried later
+type FailedEpoch struct {
+	Epoch     uint64
+	Attempts  uint64
+	NextRetry time.Time
+	LastError string
+}
+
+// Metrics of a pool in a given epoch, as served by the api
+type PoolSummary struct {
+	Pool                   string    `json:"pool"`
+	Epoch                  uint64    `json:"epoch"`
+	Time                   time.Time `json:"time"`
+	NOfTotalVotes          uint64    `json:"total_votes"`
+	NOfIncorrectSource     uint64    `json:"incorrect_source"`
+	NOfIncorrectTarget     uint64    `json:"incorrect_target"`
+	NOfIncorrectHead       uint64    `json:"incorrect_head"`
+	NOfValidatingKeys      uint64    `json:"validating_keys"`
+	NOfValsWithLessBalance uint64    `json:"validators_with_less_balance"`
+	// In Gwei
+	EarnedBalance      int64  `json:"earned_balance"`
+	LosedBalance       int64  `json:"lost_balance"`
+	EffectiveBalance   int64  `json:"effective_balance"`
+	NOfScheduledBlocks uint64 `json:"scheduled_blocks"`
+	NOfProposedBlocks  uint64 `json:"proposed_blocks"`
+	Provisional        bool   `json:"provisional"`
+}
+
+// Scheduled block proposal of a validator of a pool
+type PoolProposal struct {
+	Pool     string    `json:"pool"`
+	Epoch    uint64    `json:"epoch"`
+	Slot     uint64    `json:"slot"`
+	Time     time.Time `json:"time"`
+	ValIndex uint64    `json:"validator_index"`
+	Proposed bool      `json:"proposed"`
+}
+
+// Epoch where a validator missed its attestation or lost balance
+type ValidatorEpoch struct {
+	Pool              string    `json:"pool"`
+	Epoch             uint64    `json:"epoch"`
+	Time              time.Time `json:"time"`
+	MissedAttestation bool      `json:"missed_attestation"`
+	LessBalance       bool      `json:"less_balance"`
+}
+
+type ValidatorHistory struct {
+	ValIndex  uint64           `json:"validator_index"`
+	Epochs    []ValidatorEpoch `json:"epochs"`
+	Proposals []PoolProposal   `json:"proposals"`
+}
+
+// Metrics of a pool aggregated over the epochs of a time window
+type PoolAggregate struct {
+	Pool               string  `json:"pool"`
+	Window             string  `json:"window"`
+	NOfEpochs          uint64  `json:"epochs"`
+	NOfTotalVotes      uint64  `json:"total_votes"`
+	NOfIncorrectSource uint64  `json:"incorrect_source"`
+	NOfIncorrectTarget uint64  `json:"incorrect_target"`
+	NOfIncorrectHead   uint64  `json:"incorrect_head"`
+	ParticipationRate  float64 `json:"participation_rate"`
+	// In Gwei. Rewards are earned minus lost balance. Effective balance is
+	// summed over all epochs
+	EarnedBalance      int64  `json:"earned_balance"`
+	LosedBalance       int64  `json:"lost_balance"`
+	Rewards            int64  `json:"rewards"`
+	EffectiveBalance   int64  `json:"effective_balance"`
+	NOfScheduledBlocks uint64 `json:"scheduled_blocks"`
+	NOfProposedBlocks  uint64 `json:"proposed_blocks"`
+	// Annualized consensus layer rewards over the effective balance
+	ConsensusApr float64 `json:"consensus_apr"`
+	// Correct votes weighted by its rewards (source 14, target 26, head 14)
+	AttestationEffectiveness float64 `json:"attestation_effectiveness"`
+	// Zero if there were no scheduled blocks
+	ProposalSuccessRate float64 `json:"proposal_success_rate"`
+}
+
+// Consecutive epochs a validator has been missing its attestations
+type ValidatorStreak struct {
+	Pool     string `json:"pool"`
+	ValIndex uint64 `json:"validator_index"`
+	Epochs   uint64 `json:"epochs"`
+	// First epoch of the streak
+	Since uint64 `json:"since"`
+	// Last epoch the validator missed its attestation
+	LastEpoch uint64 `json:"last_epoch"`
+}
+
+type UpcomingProposal struct {
+	ValIndex uint64    `json:"validator_index"`
+	Slot     uint64    `json:"slot"`
+	Time     time.Time `json:"time"`
+}
+
+// Upcoming duties of the validators of a pool
+type PoolLookahead struct {
+	Pool string `json:"pool"`
+	// Head epoch when it was calculated
+	Epoch uint64 `json:"epoch"`
+	// Proposals of the current and next epoch that are still pending
+	Proposals            []UpcomingProposal `json:"proposals"`
+	CurrentSyncCommittee []uint64           `json:"current_sync_committee"`
+	NextSyncCommittee    []uint64           `json:"next_sync_committee"`
+	// When the next sync committee starts
+	NextSyncCommitteeEpoch uint64    `json:"next_sync_committee_epoch"`
+	NextSyncCommitteeTime  time.Time `json:"next_sync_committee_time"`
+}
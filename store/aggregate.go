@@ -0,0 +1,80 @@
+package store
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/alrevuelta/eth-pools-metrics/config"
+	"github.com/alrevuelta/eth-pools-metrics/schemas"
+)
+
+// Altair weights of each vote in the attestation rewards
+const (
+	sourceWeight = 14
+	targetWeight = 26
+	headWeight   = 14
+)
+
+// Aggregates the summaries of a pool. Filtering them by window is up to the caller
+func AggregateSummaries(
+	poolName string,
+	window time.Duration,
+	summaries []schemas.PoolSummary) schemas.PoolAggregate {
+
+	aggregate := schemas.PoolAggregate{
+		Pool:   poolName,
+		Window: WindowLabel(window),
+	}
+
+	for _, summary := range summaries {
+		aggregate.NOfEpochs++
+		aggregate.NOfTotalVotes += summary.NOfTotalVotes
+		aggregate.NOfIncorrectSource += summary.NOfIncorrectSource
+		aggregate.NOfIncorrectTarget += summary.NOfIncorrectTarget
+		aggregate.NOfIncorrectHead += summary.NOfIncorrectHead
+		aggregate.EarnedBalance += summary.EarnedBalance
+		aggregate.LosedBalance += summary.LosedBalance
+		aggregate.EffectiveBalance += summary.EffectiveBalance
+		aggregate.NOfScheduledBlocks += summary.NOfScheduledBlocks
+		aggregate.NOfProposedBlocks += summary.NOfProposedBlocks
+	}
+
+	aggregate.Rewards = aggregate.EarnedBalance + aggregate.LosedBalance
+	if aggregate.NOfTotalVotes != 0 {
+		incorrect := aggregate.NOfIncorrectSource + aggregate.NOfIncorrectTarget + aggregate.NOfIncorrectHead
+		aggregate.ParticipationRate = 1 - float64(incorrect)/float64(aggregate.NOfTotalVotes)
+
+		// Each validator has 3 votes per epoch
+		maxWeight := float64(aggregate.NOfTotalVotes/3) * (sourceWeight + targetWeight + headWeight)
+		lostWeight := float64(aggregate.NOfIncorrectSource*sourceWeight +
+			aggregate.NOfIncorrectTarget*targetWeight +
+			aggregate.NOfIncorrectHead*headWeight)
+		aggregate.AttestationEffectiveness = 1 - lostWeight/maxWeight
+	}
+	if aggregate.EffectiveBalance != 0 {
+		// Summed over all epochs, so this is the average reward per epoch
+		epochReward := float64(aggregate.Rewards) / float64(aggregate.EffectiveBalance)
+		aggregate.ConsensusApr = epochReward * epochsPerYear()
+	}
+	if aggregate.NOfScheduledBlocks != 0 {
+		aggregate.ProposalSuccessRate = float64(aggregate.NOfProposedBlocks) / float64(aggregate.NOfScheduledBlocks)
+	}
+	return aggregate
+}
+
+func epochsPerYear() float64 {
+	secondsPerEpoch := float64(config.SlotsInEpoch * config.SecondsPerSlot)
+	return 365.25 * 24 * 3600 / secondsPerEpoch
+}
+
+// Human readable window, eg 1h or 7d
+func WindowLabel(window time.Duration) string {
+	day := 24 * time.Hour
+	if window >= day && window%day == 0 {
+		return fmt.Sprintf("%dd", window/day)
+	}
+	if window >= time.Hour && window%time.Hour == 0 {
+		return fmt.Sprintf("%dh", window/time.Hour)
+	}
+	return window.String()
+}
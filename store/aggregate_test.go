@@ -0,0 +1,77 @@
+package store
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/alrevuelta/eth-pools-metrics/schemas"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_AggregateSummaries(t *testing.T) {
+	aggregate := AggregateSummaries("pool1", time.Hour, []schemas.PoolSummary{
+		{NOfTotalVotes: 300, NOfIncorrectTarget: 6, EarnedBalance: 1000, LosedBalance: -100, NOfScheduledBlocks: 1, NOfProposedBlocks: 1},
+		{NOfTotalVotes: 300, NOfIncorrectHead: 6, EarnedBalance: 2000, LosedBalance: -50, NOfScheduledBlocks: 1},
+	})
+	require.Equal(t, "1h", aggregate.Window)
+	require.Equal(t, uint64(2), aggregate.NOfEpochs)
+	require.Equal(t, uint64(600), aggregate.NOfTotalVotes)
+	require.InDelta(t, 0.98, aggregate.ParticipationRate, 1e-9)
+	require.Equal(t, int64(2850), aggregate.Rewards)
+	require.Equal(t, uint64(2), aggregate.NOfScheduledBlocks)
+	require.Equal(t, uint64(1), aggregate.NOfProposedBlocks)
+
+	// 6 incorrect target and 6 head out of 200 validators
+	require.InDelta(t, 1-float64(6*26+6*14)/float64(200*54), aggregate.AttestationEffectiveness, 1e-9)
+	require.Equal(t, 0.5, aggregate.ProposalSuccessRate)
+
+	empty := AggregateSummaries("pool1", time.Hour, []schemas.PoolSummary{})
+	require.Equal(t, float64(0), empty.ParticipationRate)
+	require.Equal(t, float64(0), empty.ConsensusApr)
+}
+
+func Test_AggregateConsensusApr(t *testing.T) {
+	// 32 Eth earning 0.0001 Eth per epoch, with 225 epochs per day in mainnet
+	summaries := []schemas.PoolSummary{
+		{EffectiveBalance: 32e9, EarnedBalance: 1e5},
+		{EffectiveBalance: 32e9, EarnedBalance: 1e5},
+	}
+	aggregate := AggregateSummaries("pool1", 24*time.Hour, summaries)
+	require.InDelta(t, 1e5/32e9*225*365.25, aggregate.ConsensusApr, 1e-9)
+}
+
+func Test_WindowLabel(t *testing.T) {
+	require.Equal(t, "1h", WindowLabel(time.Hour))
+	require.Equal(t, "1d", WindowLabel(24*time.Hour))
+	require.Equal(t, "7d", WindowLabel(7*24*time.Hour))
+	require.Equal(t, "36h", WindowLabel(36*time.Hour))
+	require.Equal(t, "30m0s", WindowLabel(30*time.Minute))
+}
+
+func Test_MemoryAggregatesByWindow(t *testing.T) {
+	memory := NewMemory(10)
+	now := time.Now()
+	memory.StoreValidatorPerformance(schemas.ValidatorPerformanceMetrics{
+		PoolName: "pool1", Epoch: 1, Time: now.Add(-2 * time.Hour),
+		NOfTotalVotes: 30, EarnedBalance: big.NewInt(10), LosedBalance: big.NewInt(0),
+	})
+	memory.StoreValidatorPerformance(schemas.ValidatorPerformanceMetrics{
+		PoolName: "pool1", Epoch: 2, Time: now,
+		NOfTotalVotes: 30, EarnedBalance: big.NewInt(20), LosedBalance: big.NewInt(0),
+	})
+
+	aggregates, err := memory.GetPoolAggregates("pool1", []time.Duration{time.Hour, 24 * time.Hour}, now)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(aggregates))
+	require.Equal(t, uint64(1), aggregates[0].NOfEpochs)
+	require.Equal(t, int64(20), aggregates[0].Rewards)
+	require.Equal(t, uint64(2), aggregates[1].NOfEpochs)
+	require.Equal(t, int64(30), aggregates[1].Rewards)
+
+	// Ending at an older epoch, eg retried
+	aggregates, err = memory.GetPoolAggregates("pool1", []time.Duration{time.Hour}, now.Add(-2*time.Hour))
+	require.NoError(t, err)
+	require.Equal(t, uint64(1), aggregates[0].NOfEpochs)
+	require.Equal(t, int64(10), aggregates[0].Rewards)
+}
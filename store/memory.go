@@ -0,0 +1,237 @@
+package store
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/alrevuelta/eth-pools-metrics/config"
+	"github.com/alrevuelta/eth-pools-metrics/schemas"
+)
+
+// Metrics of a pool in an epoch. Performance and proposals are stored one after
+// the other by the same pool calculation, either one can be missing if it failed
+type memoryEpoch struct {
+	summary            schemas.PoolSummary
+	indexesMissedAtt   []uint64
+	indexesLessBalance []uint64
+	proposals          []schemas.PoolProposal
+}
+
+// Keeps the last n epochs of each pool in memory, used to calculate rolling
+// aggregates and to serve the api when no database is available
+type Memory struct {
+	mutex     sync.RWMutex
+	maxEpochs int
+	// Sorted by epoch, oldest first
+	pools map[string][]*memoryEpoch
+}
+
+func NewMemory(maxEpochs int) *Memory {
+	return &Memory{
+		maxEpochs: maxEpochs,
+		pools:     make(map[string][]*memoryEpoch, 0),
+	}
+}
+
+func (m *Memory) StoreValidatorPerformance(performance schemas.ValidatorPerformanceMetrics) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	entry := m.getEntry(performance.PoolName, performance.Epoch)
+	scheduled := entry.summary.NOfScheduledBlocks
+	proposed := entry.summary.NOfProposedBlocks
+
+	entry.summary = schemas.PoolSummary{
+		Pool:                   performance.PoolName,
+		Epoch:                  performance.Epoch,
+		Time:                   performance.Time,
+		NOfTotalVotes:          performance.NOfTotalVotes,
+		NOfIncorrectSource:     performance.NOfIncorrectSource,
+		NOfIncorrectTarget:     performance.NOfIncorrectTarget,
+		NOfIncorrectHead:       performance.NOfIncorrectHead,
+		NOfValidatingKeys:      performance.NOfValidatingKeys,
+		NOfValsWithLessBalance: performance.NOfValsWithLessBalance,
+		NOfScheduledBlocks:     scheduled,
+		NOfProposedBlocks:      proposed,
+		Provisional:            performance.Provisional,
+	}
+	if performance.EarnedBalance != nil {
+		entry.summary.EarnedBalance = performance.EarnedBalance.Int64()
+	}
+	if performance.LosedBalance != nil {
+		entry.summary.LosedBalance = performance.LosedBalance.Int64()
+	}
+	if performance.EffectiveBalance != nil {
+		entry.summary.EffectiveBalance = performance.EffectiveBalance.Int64()
+	}
+	entry.indexesMissedAtt = performance.IndexesMissedAtt
+	entry.indexesLessBalance = performance.IndexesLessBalance
+}
+
+func (m *Memory) StoreProposalDuties(poolName string, proposals schemas.ProposalDutiesMetrics) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	entry := m.getEntry(poolName, proposals.Epoch)
+	entry.summary.NOfScheduledBlocks = uint64(len(proposals.Scheduled))
+	entry.summary.NOfProposedBlocks = uint64(len(proposals.Proposed))
+	entry.proposals = ToPoolProposals(poolName, proposals)
+}
+
+// Must be called with the lock held. Creates the entry if it doesn't exist,
+// dropping the oldest one if the pool is full
+func (m *Memory) getEntry(poolName string, epoch uint64) *memoryEpoch {
+	entries := m.pools[poolName]
+	i := sort.Search(len(entries), func(i int) bool {
+		return entries[i].summary.Epoch >= epoch
+	})
+	if i < len(entries) && entries[i].summary.Epoch == epoch {
+		return entries[i]
+	}
+
+	entry := &memoryEpoch{
+		summary: schemas.PoolSummary{
+			Pool:  poolName,
+			Epoch: epoch,
+		},
+	}
+	entries = append(entries, nil)
+	copy(entries[i+1:], entries[i:])
+	entries[i] = entry
+	if len(entries) > m.maxEpochs {
+		entries = entries[len(entries)-m.maxEpochs:]
+	}
+	m.pools[poolName] = entries
+	return entry
+}
+
+func (m *Memory) GetPools() ([]string, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	pools := make([]string, 0, len(m.pools))
+	for pool := range m.pools {
+		pools = append(pools, pool)
+	}
+	sort.Strings(pools)
+	return pools, nil
+}
+
+func (m *Memory) GetPoolSummaries(poolName string, from uint64, to uint64) ([]schemas.PoolSummary, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	summaries := make([]schemas.PoolSummary, 0)
+	for _, entry := range m.pools[poolName] {
+		if entry.summary.Epoch >= from && entry.summary.Epoch <= to {
+			summaries = append(summaries, entry.summary)
+		}
+	}
+	return summaries, nil
+}
+
+// Returns the aggregates of a pool over each window, ending at the given time
+func (m *Memory) GetPoolAggregates(poolName string, windows []time.Duration, end time.Time) ([]schemas.PoolAggregate, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	aggregates := make([]schemas.PoolAggregate, 0, len(windows))
+	for _, window := range windows {
+		summaries := make([]schemas.PoolSummary, 0)
+		for _, entry := range m.pools[poolName] {
+			// Entries without time only have the proposals so far
+			if entry.summary.Time.IsZero() ||
+				!entry.summary.Time.After(end.Add(-window)) || entry.summary.Time.After(end) {
+				continue
+			}
+			summaries = append(summaries, entry.summary)
+		}
+		aggregates = append(aggregates, AggregateSummaries(poolName, window, summaries))
+	}
+	return aggregates, nil
+}
+
+func (m *Memory) GetPoolProposals(poolName string, from uint64, to uint64) ([]schemas.PoolProposal, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	proposals := make([]schemas.PoolProposal, 0)
+	for _, entry := range m.pools[poolName] {
+		if entry.summary.Epoch >= from && entry.summary.Epoch <= to {
+			proposals = append(proposals, entry.proposals...)
+		}
+	}
+	return proposals, nil
+}
+
+func (m *Memory) GetValidatorHistory(valIndex uint64) (*schemas.ValidatorHistory, error) {
+	m.mutex.RLock()
+	defer m.mutex.RUnlock()
+
+	history := &schemas.ValidatorHistory{
+		ValIndex:  valIndex,
+		Epochs:    make([]schemas.ValidatorEpoch, 0),
+		Proposals: make([]schemas.PoolProposal, 0),
+	}
+
+	pools := make([]string, 0, len(m.pools))
+	for pool := range m.pools {
+		pools = append(pools, pool)
+	}
+	sort.Strings(pools)
+
+	for _, pool := range pools {
+		for _, entry := range m.pools[pool] {
+			missedAtt := contains(entry.indexesMissedAtt, valIndex)
+			lessBalance := contains(entry.indexesLessBalance, valIndex)
+			if missedAtt || lessBalance {
+				history.Epochs = append(history.Epochs, schemas.ValidatorEpoch{
+					Pool:              pool,
+					Epoch:             entry.summary.Epoch,
+					Time:              config.EpochTime(entry.summary.Epoch),
+					MissedAttestation: missedAtt,
+					LessBalance:       lessBalance,
+				})
+			}
+			for _, proposal := range entry.proposals {
+				if proposal.ValIndex == valIndex {
+					history.Proposals = append(history.Proposals, proposal)
+				}
+			}
+		}
+	}
+	return history, nil
+}
+
+// Flattens the scheduled duties of a pool, flagging the ones that were proposed
+func ToPoolProposals(poolName string, proposals schemas.ProposalDutiesMetrics) []schemas.PoolProposal {
+	poolProposals := make([]schemas.PoolProposal, 0, len(proposals.Scheduled))
+	for _, duty := range proposals.Scheduled {
+		proposed := false
+		for _, block := range proposals.Proposed {
+			if block.Slot == duty.Slot && block.ValIndex == duty.ValIndex {
+				proposed = true
+				break
+			}
+		}
+		poolProposals = append(poolProposals, schemas.PoolProposal{
+			Pool:     poolName,
+			Epoch:    proposals.Epoch,
+			Slot:     duty.Slot,
+			Time:     config.SlotTime(duty.Slot),
+			ValIndex: duty.ValIndex,
+			Proposed: proposed,
+		})
+	}
+	return poolProposals
+}
+
+func contains(indexes []uint64, index uint64) bool {
+	for _, i := range indexes {
+		if i == index {
+			return true
+		}
+	}
+	return false
+}
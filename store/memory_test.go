@@ -0,0 +1,110 @@
+package store
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/alrevuelta/eth-pools-metrics/config"
+	"github.com/alrevuelta/eth-pools-metrics/schemas"
+	"github.com/stretchr/testify/require"
+)
+
+func Test_MemoryKeepsLastEpochs(t *testing.T) {
+	memory := NewMemory(3)
+	for epoch := uint64(10); epoch < 15; epoch++ {
+		memory.StoreValidatorPerformance(schemas.ValidatorPerformanceMetrics{
+			PoolName:         "pool1",
+			Epoch:            epoch,
+			NOfTotalVotes:    epoch,
+			EarnedBalance:    big.NewInt(100),
+			LosedBalance:     big.NewInt(-20),
+			IndexesMissedAtt: []uint64{7},
+		})
+	}
+
+	summaries, err := memory.GetPoolSummaries("pool1", 0, 100)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(summaries))
+	require.Equal(t, uint64(12), summaries[0].Epoch)
+	require.Equal(t, uint64(14), summaries[2].Epoch)
+	require.Equal(t, int64(100), summaries[2].EarnedBalance)
+	require.Equal(t, int64(-20), summaries[2].LosedBalance)
+
+	summaries, err = memory.GetPoolSummaries("pool1", 13, 13)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(summaries))
+
+	pools, err := memory.GetPools()
+	require.NoError(t, err)
+	require.Equal(t, []string{"pool1"}, pools)
+}
+
+func Test_MemoryMergesProposals(t *testing.T) {
+	require.True(t, config.ApplyNetworkPreset("mainnet"))
+	memory := NewMemory(10)
+	memory.StoreProposalDuties("pool1", schemas.ProposalDutiesMetrics{
+		Epoch: 5,
+		Scheduled: []schemas.Duty{
+			{ValIndex: 7, Slot: 160},
+			{ValIndex: 8, Slot: 161},
+		},
+		Proposed: []schemas.Duty{
+			{ValIndex: 8, Slot: 161},
+		},
+	})
+	memory.StoreValidatorPerformance(schemas.ValidatorPerformanceMetrics{
+		PoolName:           "pool1",
+		Epoch:              5,
+		NOfTotalVotes:      30,
+		IndexesLessBalance: []uint64{7},
+	})
+
+	summaries, err := memory.GetPoolSummaries("pool1", 0, 100)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(summaries))
+	require.Equal(t, uint64(30), summaries[0].NOfTotalVotes)
+	require.Equal(t, uint64(2), summaries[0].NOfScheduledBlocks)
+	require.Equal(t, uint64(1), summaries[0].NOfProposedBlocks)
+
+	proposals, err := memory.GetPoolProposals("pool1", 5, 5)
+	require.NoError(t, err)
+	require.Equal(t, []schemas.PoolProposal{
+		{Pool: "pool1", Epoch: 5, Slot: 160, Time: config.SlotTime(160), ValIndex: 7, Proposed: false},
+		{Pool: "pool1", Epoch: 5, Slot: 161, Time: config.SlotTime(161), ValIndex: 8, Proposed: true},
+	}, proposals)
+
+	history, err := memory.GetValidatorHistory(7)
+	require.NoError(t, err)
+	require.Equal(t, []schemas.ValidatorEpoch{
+		{Pool: "pool1", Epoch: 5, Time: config.EpochTime(5), MissedAttestation: false, LessBalance: true},
+	}, history.Epochs)
+	require.Equal(t, 1, len(history.Proposals))
+	require.False(t, history.Proposals[0].Proposed)
+}
+
+func Test_MemoryReplacesProvisionalResults(t *testing.T) {
+	memory := NewMemory(10)
+	memory.StoreValidatorPerformance(schemas.ValidatorPerformanceMetrics{
+		PoolName:         "pool1",
+		Epoch:            5,
+		NOfTotalVotes:    10,
+		IndexesMissedAtt: []uint64{7, 8},
+		Provisional:      true,
+	})
+	memory.StoreValidatorPerformance(schemas.ValidatorPerformanceMetrics{
+		PoolName:         "pool1",
+		Epoch:            5,
+		NOfTotalVotes:    11,
+		IndexesMissedAtt: []uint64{7},
+	})
+
+	summaries, err := memory.GetPoolSummaries("pool1", 5, 5)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(summaries))
+	require.Equal(t, uint64(11), summaries[0].NOfTotalVotes)
+	require.False(t, summaries[0].Provisional)
+
+	history, err := memory.GetValidatorHistory(8)
+	require.NoError(t, err)
+	require.Equal(t, 0, len(history.Epochs))
+}
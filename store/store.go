@@ -0,0 +1,17 @@
+package store
+
+import (
+	"time"
+
+	"github.com/alrevuelta/eth-pools-metrics/schemas"
+)
+
+// Source of the stored metrics, postgres or in memory
+type Store interface {
+	GetPools() ([]string, error)
+	GetPoolSummaries(poolName string, from uint64, to uint64) ([]schemas.PoolSummary, error)
+	GetPoolProposals(poolName string, from uint64, to uint64) ([]schemas.PoolProposal, error)
+	// Each window ends at the given time
+	GetPoolAggregates(poolName string, windows []time.Duration, end time.Time) ([]schemas.PoolAggregate, error)
+	GetValidatorHistory(valIndex uint64) (*schemas.ValidatorHistory, error)
+}